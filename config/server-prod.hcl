@@ -1,3 +1,7 @@
+variables {
+  nats_pass = env("FEE_NATS_PASS", "")
+}
+
 xorm {
   datasource = ["topai:tjLjIVjsVbtqDQ4SEkUm@tcp(top-maas-prod-db.mysql.database.azure.com:3306)/top_maas?charset=utf8mb4&parseTime=true&loc=Local"]
   show_sql = true
@@ -6,10 +10,71 @@ xorm {
 natsmq  {
   url       = "nats://127.0.0.1:4222"
   user      = ""
-  pass      = ""
+  pass      = var.nats_pass
   topic     = "billing.nodeUsage"
   consumer  = "fee-consumer"
   worker_group      = "fee-worker-group"
   buffer_size       = 1024
   ack_wait_mintues  = 5
+  reconnect_wait    = 2   # 秒
+  max_reconnects    = -1  # -1 表示无限重连
+  max_deliver       = 5   # 超过后转入死信主题
+  dead_letter       = "billing.deadLetter"
+  subjects = {
+    user_consume    = "billing.userConsume"
+    budget_exceeded = "billing.budgetExceeded"
+  }
+  mode              = "push"  # pull 时按空闲容量批量拉取
+  # fetch_batch     = 256     # 拉取模式每批最多拉取的消息数，默认 buffer_size
+  # fetch_wait      = 5       # 秒
+  stream {
+    name      = "billing"
+    retention = "limits"
+    max_age   = 720  # 小时
+    replicas  = 3
+  }
+  # urls            = ["nats://10.0.0.1:4222", "nats://10.0.0.2:4222"]
+  # creds_file      = "/etc/fee/nats.creds"   # 或 nkey_seed_file，二者不能与 user 同时使用
+  # tls {
+  #   ca_file   = "/etc/fee/nats-ca.pem"
+  #   cert_file = "/etc/fee/nats-client.pem"
+  #   key_file  = "/etc/fee/nats-client-key.pem"
+  # }
+}
+
+http {
+  internal_secret = env("FEE_INTERNAL_SECRET")
+}
+
+settlement {
+  node_share_percent     = 70
+  provider_share_percent = 0
+}
+
+pricing {
+  reload_interval = 60
+}
+
+health {
+  max_consumer_lag = 10000
+}
+
+outbox {
+  interval       = 1    # 秒
+  batch_size     = 100
+  max_backoff    = 300  # 秒
+  retention_days = 7
+}
+
+# 多钱包扣费顺序：按 priority 用各类型钱包的余额支付，余额都不足时由 overdraft 类型透支
+wallet {
+  priority  = ["promo", "credit", "onchain"]
+  overdraft = "credit"
+}
+
+# 调用时间的允许范围（秒）：超前当前时间超过 max_clock_skew 或早于 max_lateness 的调用转入死信主题
+report {
+  max_clock_skew = 300
+  max_lateness   = 604800
+  # strict_caller_key = true  # api_key 导入完成后开启：caller_key 未登记的调用转入死信主题，默认按 caller 扣费
 }
@@ -0,0 +1,282 @@
+-- 上游服务商成本价
+CREATE TABLE provider_price (
+  id BIGINT PRIMARY KEY AUTO_INCREMENT,
+  actual_provider_id VARCHAR(64) NOT NULL COMMENT '实际服务商id',
+  actual_model VARCHAR(128) NOT NULL COMMENT '实际模型',
+  input_price INT DEFAULT 0 COMMENT '输入token成本价',
+  output_price INT DEFAULT 0 COMMENT '输出token成本价',
+  cache_price INT DEFAULT 0 COMMENT '缓存token成本价',
+  status VARCHAR(12) DEFAULT NULL COMMENT '状态',
+  last_update BIGINT DEFAULT NULL COMMENT '最后更新时间',
+  UNIQUE KEY uk_provider_model (actual_provider_id, actual_model)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COMMENT = '上游服务商成本价';
+
+ALTER TABLE user_consume
+ADD COLUMN actual_model VARCHAR(128) DEFAULT NULL COMMENT '实际模型' AFTER actual_provider_id,
+ADD COLUMN provider_cost BIGINT DEFAULT 0 COMMENT '上游成本' AFTER actual_model,
+ADD COLUMN margin BIGINT DEFAULT 0 COMMENT '毛利' AFTER provider_cost;
+
+-- 节点/服务商结算
+CREATE TABLE settlement_period (
+  id BIGINT PRIMARY KEY AUTO_INCREMENT COMMENT '主键，自增',
+  period_start BIGINT NOT NULL COMMENT '周期开始时间',
+  period_end BIGINT NOT NULL COMMENT '周期结束时间',
+  status VARCHAR(16) DEFAULT 'open' COMMENT '状态: open/locked',
+  locked_at BIGINT DEFAULT 0 COMMENT '锁定时间',
+  created_at BIGINT DEFAULT NULL COMMENT '创建时间',
+  UNIQUE KEY uk_period_start (period_start)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COMMENT = '结算周期';
+
+CREATE TABLE settlement_statement (
+  id BIGINT PRIMARY KEY AUTO_INCREMENT COMMENT '主键，自增',
+  period_id BIGINT NOT NULL COMMENT '结算周期id',
+  party_type VARCHAR(16) NOT NULL COMMENT '结算方类型: node/provider',
+  party_id VARCHAR(64) NOT NULL COMMENT '结算方id',
+  calls BIGINT DEFAULT 0 COMMENT '调用次数',
+  gross_amount BIGINT DEFAULT 0 COMMENT '用户消费总额',
+  provider_cost BIGINT DEFAULT 0 COMMENT '上游成本',
+  share_percent DOUBLE DEFAULT 0 COMMENT '分成比例',
+  payout_amount BIGINT DEFAULT 0 COMMENT '应结算金额',
+  created_at BIGINT DEFAULT NULL COMMENT '创建时间',
+  INDEX idx_period (period_id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COMMENT = '结算单';
+
+ALTER TABLE user_consume
+ADD COLUMN settle_period_id BIGINT DEFAULT 0 COMMENT '结算周期id' AFTER consume_type,
+ADD INDEX idx_settle_period (settle_period_id);
+
+-- 用户充值记录（由充值服务写入）
+CREATE TABLE user_recharge (
+  id BIGINT PRIMARY KEY AUTO_INCREMENT COMMENT '主键，自增',
+  user_id BIGINT NOT NULL COMMENT '用户ID',
+  wallet_id BIGINT DEFAULT 0 COMMENT '钱包id',
+  amount BIGINT DEFAULT 0 COMMENT '充值数量',
+  source VARCHAR(64) DEFAULT NULL COMMENT '充值来源',
+  created_at BIGINT DEFAULT NULL COMMENT '创建时间',
+  INDEX idx_user_id (user_id),
+  INDEX idx_created_at (created_at)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COMMENT = '用户充值记录';
+
+-- 用户月度账单
+CREATE TABLE user_statement (
+  id BIGINT PRIMARY KEY AUTO_INCREMENT COMMENT '主键，自增',
+  user_id BIGINT NOT NULL COMMENT '用户ID',
+  month VARCHAR(7) NOT NULL COMMENT '账单月份',
+  opening_balance BIGINT DEFAULT 0 COMMENT '期初余额',
+  top_ups BIGINT DEFAULT 0 COMMENT '充值总额',
+  consumed BIGINT DEFAULT 0 COMMENT '消费总额',
+  discounts BIGINT DEFAULT 0 COMMENT '折扣总额',
+  closing_balance BIGINT DEFAULT 0 COMMENT '期末余额',
+  content MEDIUMTEXT COMMENT '账单明细JSON',
+  created_at BIGINT DEFAULT NULL COMMENT '创建时间',
+  UNIQUE KEY uk_user_month (user_id, month)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COMMENT = '用户月度账单';
+
+-- 用量汇总（小时/天）
+CREATE TABLE usage_rollup_hourly (
+  id BIGINT PRIMARY KEY AUTO_INCREMENT COMMENT '主键，自增',
+  bucket BIGINT NOT NULL COMMENT '时间桶起点',
+  user_id BIGINT NOT NULL COMMENT '用户ID',
+  model_id VARCHAR(64) NOT NULL DEFAULT '' COMMENT '模型id',
+  actual_provider_id VARCHAR(64) NOT NULL DEFAULT '' COMMENT '服务商id',
+  node_id VARCHAR(64) NOT NULL DEFAULT '' COMMENT '节点id',
+  calls BIGINT DEFAULT 0 COMMENT '调用次数',
+  input_tokens BIGINT DEFAULT 0 COMMENT '输入token数',
+  output_tokens BIGINT DEFAULT 0 COMMENT '输出token数',
+  cache_tokens BIGINT DEFAULT 0 COMMENT '缓存token数',
+  images BIGINT DEFAULT 0 COMMENT '图片数',
+  video_seconds DOUBLE DEFAULT 0 COMMENT '视频秒数',
+  total_consumed BIGINT DEFAULT 0 COMMENT '消费总额',
+  updated_at BIGINT DEFAULT NULL COMMENT '更新时间',
+  UNIQUE KEY uk_rollup (bucket, user_id, model_id, actual_provider_id, node_id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COMMENT = '小时用量汇总';
+
+CREATE TABLE usage_rollup_daily LIKE usage_rollup_hourly;
+ALTER TABLE usage_rollup_daily COMMENT = '天用量汇总';
+
+-- 消费记录按月分表：user_consume_YYYYMM 及 user_consume_detail_{text,image,video}_YYYYMM
+-- 由计费服务在每月首次写入时自动创建，结构与 user_consume 等单表一致；
+-- 分表之前写入 user_consume 的历史记录仍会被账单、结算、汇总等查询一并读取。
+
+-- 图片/视频价格（美元），valid_from 起生效，同一规格以最新生效的记录为准
+CREATE TABLE image_price (
+  id BIGINT PRIMARY KEY AUTO_INCREMENT,
+  model VARCHAR(64) NOT NULL COMMENT '模型',
+  quality VARCHAR(32) NOT NULL COMMENT '质量',
+  size VARCHAR(32) NOT NULL COMMENT '尺寸',
+  price DOUBLE DEFAULT NULL COMMENT '单价(美元)',
+  valid_from BIGINT NOT NULL COMMENT '生效时间',
+  status VARCHAR(12) DEFAULT NULL COMMENT '状态',
+  last_update BIGINT DEFAULT NULL COMMENT '最后更新时间',
+  KEY idx_image_price (model, quality, size)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COMMENT = '图片生成价格';
+
+CREATE TABLE video_price (
+  id BIGINT PRIMARY KEY AUTO_INCREMENT,
+  model VARCHAR(64) NOT NULL COMMENT '模型',
+  resolution VARCHAR(32) NOT NULL COMMENT '分辨率',
+  price DOUBLE DEFAULT NULL COMMENT '每秒单价(美元)',
+  valid_from BIGINT NOT NULL COMMENT '生效时间',
+  status VARCHAR(12) DEFAULT NULL COMMENT '状态',
+  last_update BIGINT DEFAULT NULL COMMENT '最后更新时间',
+  KEY idx_video_price (model, resolution)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COMMENT = '视频生成价格';
+
+-- 生效区间：价格版本在 [valid_from, valid_to) 内生效，valid_to 为 0 表示长期有效
+-- 按上报中的调用时间 timestamp 查价，迟到的上报仍按调用发生时的价格计费
+CREATE TABLE model_price (
+  id BIGINT PRIMARY KEY AUTO_INCREMENT,
+  model_id VARCHAR(128) NOT NULL COMMENT '模型ID',
+  input_price INT DEFAULT NULL,
+  output_price INT DEFAULT NULL,
+  cache_price INT DEFAULT NULL,
+  valid_from BIGINT NOT NULL COMMENT '生效时间',
+  valid_to BIGINT DEFAULT 0 COMMENT '失效时间',
+  last_update BIGINT DEFAULT NULL COMMENT '最后更新时间',
+  KEY idx_model_price (model_id, valid_from)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COMMENT = '模型售价版本，覆盖 models_info 中的价格';
+
+ALTER TABLE provider_price
+  ADD COLUMN valid_from BIGINT NOT NULL DEFAULT 0 COMMENT '生效时间' AFTER cache_price,
+  ADD COLUMN valid_to BIGINT DEFAULT 0 COMMENT '失效时间' AFTER valid_from,
+  DROP INDEX uk_provider_model,
+  ADD UNIQUE KEY uk_provider_model (actual_provider_id, actual_model, valid_from);
+
+ALTER TABLE image_price ADD COLUMN valid_to BIGINT DEFAULT 0 COMMENT '失效时间' AFTER valid_from;
+ALTER TABLE video_price ADD COLUMN valid_to BIGINT DEFAULT 0 COMMENT '失效时间' AFTER valid_from;
+
+-- 代币与法币汇率，保留历史；某一时刻使用 valid_from 最新且不晚于该时刻的汇率
+CREATE TABLE exchange_rate (
+  id BIGINT PRIMARY KEY AUTO_INCREMENT COMMENT '主键，自增',
+  currency VARCHAR(8) NOT NULL COMMENT '法币',
+  micro_coins BIGINT NOT NULL COMMENT '1单位法币对应的微代币',
+  valid_from BIGINT NOT NULL COMMENT '生效时间',
+  created_at BIGINT DEFAULT NULL COMMENT '创建时间',
+  KEY idx_currency_from (currency, valid_from)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COMMENT = '代币汇率';
+
+-- 图片明细关联消费记录并记录图片数，用于用量汇总
+ALTER TABLE user_consume_detail_image
+  ADD COLUMN consume_id BIGINT DEFAULT NULL COMMENT '消费记录id' AFTER id,
+  ADD COLUMN count BIGINT DEFAULT 1 COMMENT '图片数' AFTER size;
+
+-- 事务性发件箱：消费事件与扣费在同一事务中写入，由 relay 发布到 NATS（Nats-Msg-Id 为事件 id，见 msg_id）
+CREATE TABLE outbox (
+  id BIGINT PRIMARY KEY AUTO_INCREMENT COMMENT '主键，自增',
+  subject VARCHAR(128) NOT NULL COMMENT '主题',
+  payload MEDIUMBLOB NOT NULL COMMENT '消息内容',
+  status VARCHAR(16) NOT NULL DEFAULT 'pending' COMMENT '状态',
+  attempts INT DEFAULT 0 COMMENT '发布失败次数',
+  next_attempt_at BIGINT DEFAULT 0 COMMENT '下次发布时间',
+  last_error VARCHAR(512) DEFAULT '' COMMENT '最近一次发布错误',
+  sent_at BIGINT DEFAULT 0 COMMENT '发送时间',
+  created_at BIGINT DEFAULT NULL COMMENT '创建时间',
+  KEY idx_status_next (status, next_attempt_at)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COMMENT = '待发布消息';
+
+-- 发件箱保存事件 id，发布时作为 Nats-Msg-Id
+ALTER TABLE outbox
+  ADD COLUMN msg_id VARCHAR(64) NOT NULL COMMENT '消息id' AFTER id,
+  ADD UNIQUE KEY uk_msg_id (msg_id);
+
+-- 调用方 API key：caller_key 解析为所属用户和扣费钱包，按日、按月累计消费并限额（微代币，0 表示不限）
+CREATE TABLE api_key (
+  id BIGINT PRIMARY KEY AUTO_INCREMENT COMMENT '主键，自增',
+  key_id VARCHAR(64) NOT NULL COMMENT 'key id',
+  user_id BIGINT NOT NULL COMMENT '所属用户',
+  wallet_id BIGINT DEFAULT 0 COMMENT '扣费钱包，0 表示用户默认钱包',
+  name VARCHAR(64) DEFAULT '' COMMENT '名称',
+  status VARCHAR(16) NOT NULL DEFAULT 'enabled' COMMENT '状态',
+  daily_limit BIGINT DEFAULT 0 COMMENT '每日限额',
+  monthly_limit BIGINT DEFAULT 0 COMMENT '每月限额',
+  day_spent BIGINT DEFAULT 0 COMMENT '当日已消费',
+  day_start BIGINT DEFAULT 0 COMMENT '当日开始时间',
+  month_spent BIGINT DEFAULT 0 COMMENT '当月已消费',
+  month_start BIGINT DEFAULT 0 COMMENT '当月开始时间',
+  last_used_at BIGINT DEFAULT 0 COMMENT '最后使用时间',
+  created_at BIGINT DEFAULT NULL COMMENT '创建时间',
+  updated_at BIGINT DEFAULT NULL COMMENT '更新时间',
+  UNIQUE KEY uk_key_id (key_id),
+  KEY idx_user_id (user_id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COMMENT = '调用方 API key';
+
+-- 组织（团队）钱包：组织钱包是 user_wallet 中 org_id 为组织id、user_id 为 0 的记录
+ALTER TABLE user_wallet
+  ADD COLUMN org_id BIGINT(12) DEFAULT 0 COMMENT '组织钱包的组织id，个人钱包为 0' AFTER user_id,
+  ADD KEY idx_org_id (org_id);
+
+CREATE TABLE organization (
+  id BIGINT PRIMARY KEY AUTO_INCREMENT COMMENT '主键，自增',
+  name VARCHAR(128) NOT NULL COMMENT '名称',
+  wallet_id BIGINT DEFAULT 0 COMMENT '组织钱包',
+  created_at BIGINT DEFAULT NULL COMMENT '创建时间',
+  updated_at BIGINT DEFAULT NULL COMMENT '更新时间'
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COMMENT = '组织';
+
+CREATE TABLE org_member (
+  id BIGINT PRIMARY KEY AUTO_INCREMENT COMMENT '主键，自增',
+  org_id BIGINT NOT NULL COMMENT '组织id',
+  user_id BIGINT NOT NULL COMMENT '用户id',
+  role VARCHAR(16) NOT NULL DEFAULT 'member' COMMENT '角色',
+  status VARCHAR(16) NOT NULL DEFAULT 'active' COMMENT '状态',
+  daily_limit BIGINT DEFAULT 0 COMMENT '每日限额',
+  monthly_limit BIGINT DEFAULT 0 COMMENT '每月限额',
+  day_spent BIGINT DEFAULT 0 COMMENT '当日已消费',
+  day_start BIGINT DEFAULT 0 COMMENT '当日开始时间',
+  month_spent BIGINT DEFAULT 0 COMMENT '当月已消费',
+  month_start BIGINT DEFAULT 0 COMMENT '当月开始时间',
+  created_at BIGINT DEFAULT NULL COMMENT '创建时间',
+  updated_at BIGINT DEFAULT NULL COMMENT '更新时间',
+  UNIQUE KEY uk_org_user (org_id, user_id),
+  KEY idx_user_id (user_id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COMMENT = '组织成员';
+
+ALTER TABLE api_key
+  ADD COLUMN org_id BIGINT DEFAULT 0 COMMENT '扣费钱包所属组织' AFTER wallet_id,
+  ADD KEY idx_org_id (org_id);
+
+-- 消费记录记录扣费钱包和组织，按月分表启动时自动补列，分表之前的历史单表需要手动执行
+ALTER TABLE user_consume
+  ADD COLUMN wallet_id BIGINT DEFAULT 0 COMMENT '扣费钱包' AFTER caller,
+  ADD COLUMN org_id BIGINT DEFAULT 0 COMMENT '组织id' AFTER wallet_id,
+  ADD KEY idx_org_id (org_id);
+
+-- 多钱包：wallet_type 为 credit/promo/onchain，未设置按 credit 处理
+UPDATE user_wallet SET wallet_type = 'credit' WHERE wallet_type IS NULL OR wallet_type = '';
+ALTER TABLE user_wallet ADD KEY idx_user_type (user_id, wallet_type);
+
+-- 消费在各钱包上的分摊，按月分表启动时自动创建，分表之前的历史单表需要手动执行
+CREATE TABLE user_consume_detail_wallet (
+  id BIGINT PRIMARY KEY AUTO_INCREMENT COMMENT '主键，自增',
+  consume_id BIGINT DEFAULT NULL COMMENT '消费记录id',
+  wallet_id BIGINT NOT NULL COMMENT '钱包id',
+  wallet_type VARCHAR(32) DEFAULT '' COMMENT '钱包类型',
+  amount BIGINT DEFAULT 0 COMMENT '扣费数量',
+  balance_after BIGINT DEFAULT 0 COMMENT '扣费后余额',
+  created_at BIGINT DEFAULT NULL COMMENT '创建时间',
+  KEY idx_consume_id (consume_id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COMMENT = '消费钱包分摊明细';
+
+-- 消费预算：按日、按月限制用户（可限定 API key 或模型）的消费，金额为微代币
+CREATE TABLE budget (
+  id BIGINT PRIMARY KEY AUTO_INCREMENT COMMENT '主键，自增',
+  user_id BIGINT NOT NULL COMMENT '用户id',
+  key_id VARCHAR(64) DEFAULT '' COMMENT 'API key',
+  model_id VARCHAR(64) DEFAULT '' COMMENT '模型id',
+  `window` VARCHAR(16) NOT NULL COMMENT '窗口',
+  limit_amount BIGINT NOT NULL COMMENT '预算',
+  action VARCHAR(16) NOT NULL DEFAULT 'flag' COMMENT '超出后的处理',
+  status VARCHAR(16) NOT NULL DEFAULT 'enabled' COMMENT '状态',
+  spent BIGINT DEFAULT 0 COMMENT '窗口内已消费',
+  window_start BIGINT DEFAULT 0 COMMENT '窗口开始时间',
+  exceeded_window BIGINT DEFAULT 0 COMMENT '已发布超预算事件的窗口',
+  created_at BIGINT DEFAULT NULL COMMENT '创建时间',
+  updated_at BIGINT DEFAULT NULL COMMENT '更新时间',
+  KEY idx_user_id (user_id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COMMENT = '消费预算';
+
+-- 没有上游成本（图片、视频及未配置成本价的模型）的记录 has_cost 为 0、margin 为 0，不计入成本和毛利统计
+-- 按月分表启动时自动补列，已有数据在各月分表（user_consume_YYYYMM）和历史单表上分别执行
+ALTER TABLE user_consume ADD COLUMN has_cost TINYINT(1) DEFAULT 0 COMMENT '是否有上游成本' AFTER margin;
+UPDATE user_consume SET has_cost = 1 WHERE provider_cost > 0;
+UPDATE user_consume SET margin = 0 WHERE has_cost = 0;
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/deepissue/core/option"
+	"github.com/deepissue/fee_server/config"
+	"github.com/deepissue/fee_server/services"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// startCommand 启动计费服务
+type startCommand struct {
+	opts *option.Options
+}
+
+func (c *startCommand) Execute(args []string) error {
+	start(c.opts)
+	return nil
+}
+
+// settleCommand 生成节点/服务商结算单并锁定结算周期
+type settleCommand struct {
+	opts   *option.Options
+	Period string `long:"period" description:"Billing period to settle, formatted as YYYY-MM (defaults to last month)"`
+	Output string `long:"output" default:"." description:"Directory to write the statement JSON and CSV files"`
+}
+
+func (c *settleCommand) Execute(args []string) error {
+	initialize(c.opts)
+	cfg, err := config.LoadConfig(c.opts.ConfigFile)
+	if err != nil {
+		return err
+	}
+	db, err := newEngine(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	period := c.Period
+	if period == "" {
+		period = services.PreviousMonth(time.Now())
+	}
+	begin, end, err := services.MonthPeriod(period)
+	if err != nil {
+		return err
+	}
+
+	settlement, err := services.NewSettlementService(db, services.NewConsumePartition(db), cfg.Settlement)
+	if err != nil {
+		return err
+	}
+	report, err := settlement.Settle(begin, end)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(c.Output, 0o755); err != nil {
+		return err
+	}
+	name := filepath.Join(c.Output, fmt.Sprintf("settlement_%s", period))
+	if err := writeFile(name+".json", report.WriteJSON); err != nil {
+		return err
+	}
+	if err := writeFile(name+".csv", report.WriteCSV); err != nil {
+		return err
+	}
+	logrus.Infof("settlement statement for %s written to %s.{json,csv}", period, name)
+	return nil
+}
+
+// configCommand 配置文件工具
+type configCommand struct {
+	Check configCheckCommand `command:"check" description:"Parse and validate the config file"`
+}
+
+func (c *configCommand) Execute(args []string) error {
+	return errors.New("please specify a config subcommand")
+}
+
+type configCheckCommand struct {
+	opts *option.Options
+}
+
+func (c *configCheckCommand) Execute(args []string) error {
+	if _, err := config.LoadConfig(c.opts.ConfigFile); err != nil {
+		return fmt.Errorf("config %s is invalid:\n%w", c.opts.ConfigFile, err)
+	}
+	fmt.Printf("config %s is valid\n", c.opts.ConfigFile)
+	return nil
+}
+
+// rollupCommand 用量汇总表维护
+type rollupCommand struct {
+	Backfill rollupBackfillCommand `command:"backfill" description:"Rebuild hourly and daily usage rollups from raw consume records"`
+}
+
+func (c *rollupCommand) Execute(args []string) error {
+	return errors.New("please specify a rollup subcommand")
+}
+
+type rollupBackfillCommand struct {
+	opts *option.Options
+	From string `long:"from" required:"true" description:"First day to rebuild, formatted as YYYY-MM-DD"`
+	To   string `long:"to" required:"true" description:"Last day to rebuild (inclusive), formatted as YYYY-MM-DD"`
+}
+
+func (c *rollupBackfillCommand) Execute(args []string) error {
+	initialize(c.opts)
+	from, err := time.ParseInLocation("2006-01-02", c.From, time.Local)
+	if err != nil {
+		return err
+	}
+	to, err := time.ParseInLocation("2006-01-02", c.To, time.Local)
+	if err != nil {
+		return err
+	}
+	cfg, err := config.LoadConfig(c.opts.ConfigFile)
+	if err != nil {
+		return err
+	}
+	db, err := newEngine(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return services.NewRollupService(db, services.NewConsumePartition(db)).Backfill(from, to.AddDate(0, 0, 1))
+}
+
+// pricingCommand 图片/视频价格表导入导出
+type pricingCommand struct {
+	Import pricingImportCommand `command:"import" description:"Import image/video prices from YAML files into the database"`
+	Export pricingExportCommand `command:"export" description:"Export the image/video prices in effect to YAML files"`
+}
+
+func (c *pricingCommand) Execute(args []string) error {
+	return errors.New("please specify a pricing subcommand")
+}
+
+type pricingImportCommand struct {
+	opts      *option.Options
+	Image     string `long:"image" description:"Image pricing YAML file"`
+	Video     string `long:"video" description:"Video pricing YAML file"`
+	ValidFrom string `long:"valid-from" description:"Time the prices take effect, formatted as YYYY-MM-DD HH:MM:SS (defaults to now)"`
+	ValidTo   string `long:"valid-to" description:"Time the prices stop applying, formatted as YYYY-MM-DD HH:MM:SS (defaults to open-ended)"`
+}
+
+func (c *pricingImportCommand) Execute(args []string) error {
+	initialize(c.opts)
+	if c.Image == "" && c.Video == "" {
+		return errors.New("please specify --image and/or --video")
+	}
+	validFrom := time.Now()
+	if c.ValidFrom != "" {
+		var err error
+		if validFrom, err = time.ParseInLocation(time.DateTime, c.ValidFrom, time.Local); err != nil {
+			return err
+		}
+	}
+	var validTo time.Time
+	if c.ValidTo != "" {
+		var err error
+		if validTo, err = time.ParseInLocation(time.DateTime, c.ValidTo, time.Local); err != nil {
+			return err
+		}
+	}
+
+	var image *services.PricingConfig
+	if c.Image != "" {
+		sheet, err := services.ReadPricingConfig(c.Image)
+		if err != nil {
+			return err
+		}
+		image = &sheet
+	}
+	var video *services.VideoPricingConfig
+	if c.Video != "" {
+		sheet, err := services.ReadVideoPricingConfig(c.Video)
+		if err != nil {
+			return err
+		}
+		video = &sheet
+	}
+
+	cfg, err := config.LoadConfig(c.opts.ConfigFile)
+	if err != nil {
+		return err
+	}
+	db, err := newEngine(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := services.NewPriceService(context.Background(), db).ImportMediaPricing(image, video, validFrom, validTo); err != nil {
+		return err
+	}
+	logrus.Infof("pricing imported, effective from %s", validFrom.Format(time.DateTime))
+	return nil
+}
+
+type pricingExportCommand struct {
+	opts   *option.Options
+	At     string `long:"at" description:"Export the prices in effect at this time, formatted as YYYY-MM-DD HH:MM:SS (defaults to now)"`
+	Output string `long:"output" default:"." description:"Directory to write image_pricing.yml and video_pricing.yml"`
+}
+
+func (c *pricingExportCommand) Execute(args []string) error {
+	initialize(c.opts)
+	at := time.Now()
+	if c.At != "" {
+		var err error
+		if at, err = time.ParseInLocation(time.DateTime, c.At, time.Local); err != nil {
+			return err
+		}
+	}
+	cfg, err := config.LoadConfig(c.opts.ConfigFile)
+	if err != nil {
+		return err
+	}
+	db, err := newEngine(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	services.InitImageDefault()
+	services.InitVideoDefault()
+	if err := services.NewPriceService(context.Background(), db).RefreshMediaPricing(at); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(c.Output, 0o755); err != nil {
+		return err
+	}
+	for name, value := range map[string]any{
+		"image_pricing.yml": services.ImagePricing.Export(),
+		"video_pricing.yml": services.VideoPricing.Export(),
+	} {
+		err := writeFile(filepath.Join(c.Output, name), func(w io.Writer) error {
+			enc := yaml.NewEncoder(w)
+			defer enc.Close()
+			return enc.Encode(value)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	logrus.Infof("pricing in effect at %s written to %s", at.Format(time.DateTime), c.Output)
+	return nil
+}
+
+func writeFile(name string, write func(w io.Writer) error) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -1,26 +1,84 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/gohcl"
 	"github.com/hashicorp/hcl/v2/hclparse"
-	"github.com/sirupsen/logrus"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
 )
 
 // NatsMQConfig
 // url       = "nats://47.128.253.184:4222"
+// urls      = ["nats://10.0.0.1:4222", "nats://10.0.0.2:4222"] // 集群种子地址，与 url 合并使用
 // user      = "agentcp-mq"
 // pass      = ""
+// creds_file      = "/etc/nats/fee.creds" // JWT + NKey 凭证文件
+// nkey_seed_file  = ""                    // 仅 NKey 认证时的种子文件
+// reconnect_wait  = 2                     // 重连间隔（秒）
+// max_reconnects  = -1                    // 最大重连次数，-1 表示无限重连
 // topic     = "modelgate"
 type NatsMQConfig struct {
-	Url            string `json:"url" hcl:"url"`
-	User           string `json:"user" hcl:"user"`
-	Pass           string `json:"pass" hcl:"pass"`
-	Topic          string `json:"topic" hcl:"topic"`
-	Consumer       string `json:"consumer" hcl:"consumer"`
-	BufferSize     int    `json:"buffer_size" hcl:"buffer_size"`
-	WorkerGroup    string `json:"worker_group" hcl:"worker_group"`
-	AckWaitMintues int    `json:"ack_wait_mintues" hcl:"ack_wait_mintues"`
+	Url            string            `json:"url" hcl:"url,optional"`
+	Urls           []string          `json:"urls" hcl:"urls,optional"`
+	User           string            `json:"user" hcl:"user,optional"`
+	Pass           string            `json:"pass" hcl:"pass,optional"`
+	CredsFile      string            `json:"creds_file" hcl:"creds_file,optional"`
+	NkeySeedFile   string            `json:"nkey_seed_file" hcl:"nkey_seed_file,optional"`
+	TLS            *NatsTLSConfig    `json:"tls" hcl:"tls,block"`
+	ReconnectWait  int               `json:"reconnect_wait" hcl:"reconnect_wait,optional"`
+	MaxReconnects  *int              `json:"max_reconnects" hcl:"max_reconnects,optional"`
+	Topic          string            `json:"topic" hcl:"topic"`
+	Consumer       string            `json:"consumer" hcl:"consumer"`
+	BufferSize     int               `json:"buffer_size" hcl:"buffer_size"`
+	WorkerGroup    string            `json:"worker_group" hcl:"worker_group"`
+	AckWaitMintues int               `json:"ack_wait_mintues" hcl:"ack_wait_mintues"`
+	DrainTimeout   int               `json:"drain_timeout" hcl:"drain_timeout,optional"` // 停止时等待处理中消息的时间（秒），默认 30
+	MaxDeliver     int               `json:"max_deliver" hcl:"max_deliver,optional"`     // 最大投递次数，超过后转入死信主题，默认 5
+	DeadLetter     string            `json:"dead_letter" hcl:"dead_letter,optional"`     // 死信主题，默认 billing.deadLetter
+	Mode           string            `json:"mode" hcl:"mode,optional"`                   // push 或 pull，默认 push
+	FetchBatch     int               `json:"fetch_batch" hcl:"fetch_batch,optional"`     // 拉取模式每批最多拉取的消息数，默认 buffer_size
+	FetchWait      int               `json:"fetch_wait" hcl:"fetch_wait,optional"`       // 拉取模式每次等待消息的时间（秒），默认 5
+	Subjects       map[string]string `json:"subjects" hcl:"subjects,optional"`           // 按事件类型覆盖发布主题，如 { user_consume = "billing.userConsume" }
+	Stream         *NatsStreamConfig `json:"stream" hcl:"stream,block"`
+}
+
+// Servers 返回全部服务器地址
+func (c *NatsMQConfig) Servers() []string {
+	var servers []string
+	if c.Url != "" {
+		servers = append(servers, c.Url)
+	}
+	return append(servers, c.Urls...)
+}
+
+// NatsTLSConfig NATS TLS 配置
+// ca_file   = "/etc/nats/ca.pem"
+// cert_file = "/etc/nats/client.pem" // 客户端证书，双向认证时配置
+// key_file  = "/etc/nats/client-key.pem"
+type NatsTLSConfig struct {
+	CaFile   string `json:"ca_file" hcl:"ca_file,optional"`
+	CertFile string `json:"cert_file" hcl:"cert_file,optional"`
+	KeyFile  string `json:"key_file" hcl:"key_file,optional"`
+}
+
+// NatsStreamConfig JetStream 流配置，启动时按此创建或更新流
+// name      = "billing"
+// subjects  = ["billing.>"]  // 默认为输入、输出和死信主题
+// retention = "limits"       // limits、interest 或 workqueue
+// max_age   = 720            // 小时，0 表示不过期
+// replicas  = 3
+type NatsStreamConfig struct {
+	Name      string   `json:"name" hcl:"name,optional"`
+	Subjects  []string `json:"subjects" hcl:"subjects,optional"`
+	Retention string   `json:"retention" hcl:"retention,optional"`
+	MaxAge    int      `json:"max_age" hcl:"max_age,optional"`
+	Replicas  int      `json:"replicas" hcl:"replicas,optional"`
 }
 
 type XormConfig struct {
@@ -29,26 +87,279 @@ type XormConfig struct {
 	Driver     string   `json:"driver" hcl:"driver"`
 }
 
+// SettlementConfig 节点/服务商结算分成配置
+// node_share_percent     = 70
+// provider_share_percent = 0
+type SettlementConfig struct {
+	NodeSharePercent     float64 `json:"node_share_percent" hcl:"node_share_percent,optional"`
+	ProviderSharePercent float64 `json:"provider_share_percent" hcl:"provider_share_percent,optional"`
+}
+
+// HttpConfig HTTP 接口配置
+// internal_secret = "" // 内部接口 X-Internal-Secret
+type HttpConfig struct {
+	InternalSecret string `json:"internal_secret" hcl:"internal_secret"`
+}
+
+// PriceSheetConfig 图片/视频价格表，价格存储在 image_price / video_price 表中
+// reload_interval = 60 // 从数据库重新加载价格的间隔（秒）
+type PriceSheetConfig struct {
+	ReloadInterval int `json:"reload_interval" hcl:"reload_interval,optional"`
+}
+
+// HealthConfig 就绪检查配置
+// max_consumer_lag = 10000 // 消费者积压（未投递 + 未确认）超过该值时未就绪，0 表示不检查
+type HealthConfig struct {
+	MaxConsumerLag int64 `json:"max_consumer_lag" hcl:"max_consumer_lag,optional"`
+}
+
+// OutboxConfig 发件箱配置，扣费事务中写入的消息由后台按此发布到 NATS
+// interval       = 1   // 轮询间隔（秒）
+// batch_size     = 100 // 每次发布的最大条数
+// max_backoff    = 300 // 发布失败后重试的最大间隔（秒）
+// retention_days = 7   // 已发送消息的保留天数
+type OutboxConfig struct {
+	Interval      int `json:"interval" hcl:"interval,optional"`
+	BatchSize     int `json:"batch_size" hcl:"batch_size,optional"`
+	MaxBackoff    int `json:"max_backoff" hcl:"max_backoff,optional"`
+	RetentionDays int `json:"retention_days" hcl:"retention_days,optional"`
+}
+
+// WalletConfig 用户有多个钱包时的扣费规则，API key 指定了钱包时只从该钱包扣费
+// priority  = ["promo", "credit", "onchain"] // 按顺序用各类型钱包的余额支付，未列出的类型不参与扣费
+// overdraft = "credit"                        // 余额都不足时由该类型钱包透支剩余部分，用户没有该类型钱包时由最后一个钱包透支
+type WalletConfig struct {
+	Priority  []string `json:"priority" hcl:"priority,optional"`
+	Overdraft string   `json:"overdraft" hcl:"overdraft,optional"`
+}
+
+type ReportConfig struct {
+	MaxClockSkew    int  `json:"max_clock_skew" hcl:"max_clock_skew,optional"`       // 调用时间最多超前当前时间的秒数，默认 300
+	MaxLateness     int  `json:"max_lateness" hcl:"max_lateness,optional"`           // 调用时间最多落后当前时间的秒数，默认 7 天
+	StrictCallerKey bool `json:"strict_caller_key" hcl:"strict_caller_key,optional"` // caller_key 不在 api_key 中时拒绝，默认按 caller 扣费
+}
+
 type Config struct {
-	Nats NatsMQConfig `json:"natsmq" hcl:"natsmq,block"`
-	Xorm XormConfig   `json:"xorm" hcl:"xorm,block"`
+	Nats       NatsMQConfig      `json:"natsmq" hcl:"natsmq,block"`
+	Xorm       XormConfig        `json:"xorm" hcl:"xorm,block"`
+	Http       HttpConfig        `json:"http" hcl:"http,block"`
+	Settlement *SettlementConfig `json:"settlement" hcl:"settlement,block"`
+	Pricing    *PriceSheetConfig `json:"pricing" hcl:"pricing,block"`
+	Health     *HealthConfig     `json:"health" hcl:"health,block"`
+	Outbox     *OutboxConfig     `json:"outbox" hcl:"outbox,block"`
+	Wallet     *WalletConfig     `json:"wallet" hcl:"wallet,block"`
+	Report     *ReportConfig     `json:"report" hcl:"report,block"`
 }
 
-func LoadConfig(configPath string) *Config {
+// fileConfig 配置文件的第一遍解析：先取出 variables，其余内容在求值上下文建立后再解码
+type fileConfig struct {
+	Variables []*variablesBlock `hcl:"variables,block"`
+	Remain    hcl.Body          `hcl:",remain"`
+}
 
-	c := &Config{}
+// variablesBlock 配置变量，在其他块中以 var.<name> 引用
+//
+//	variables {
+//	  nats_pass = env("FEE_NATS_PASS", "")
+//	}
+type variablesBlock struct {
+	Attributes hcl.Attributes `hcl:",remain"`
+}
+
+// VarEnvPrefix 环境变量 FEE_VAR_<name> 覆盖同名配置变量
+const VarEnvPrefix = "FEE_VAR_"
+
+// envFunc env(name[, default]) 读取环境变量，未设置且没有默认值时报错
+var envFunc = function.New(&function.Spec{
+	Params:   []function.Parameter{{Name: "name", Type: cty.String}},
+	VarParam: &function.Parameter{Name: "default", Type: cty.String},
+	Type:     function.StaticReturnType(cty.String),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		name := args[0].AsString()
+		if value, ok := os.LookupEnv(name); ok {
+			return cty.StringVal(value), nil
+		}
+		if len(args) > 1 {
+			return args[1], nil
+		}
+		return cty.NilVal, fmt.Errorf("environment variable %s is not set", name)
+	},
+})
 
+// LoadConfig 加载并校验配置文件，解析、求值或校验失败都会返回错误
+func LoadConfig(configPath string) (*Config, error) {
 	parser := hclparse.NewParser()
-	file, err := parser.ParseHCLFile(configPath)
-	if err != nil {
-		// 处理错误
-		logrus.Error(err)
-	}
-	ctx := &hcl.EvalContext{}
-	diags := gohcl.DecodeBody(file.Body, ctx, c)
+	file, diags := parser.ParseHCLFile(configPath)
 	if diags.HasErrors() {
-		// 处理错误
-		// logrus.Error(diags.Error())
+		return nil, diags
+	}
+
+	var raw fileConfig
+	if diags := gohcl.DecodeBody(file.Body, nil, &raw); diags.HasErrors() {
+		return nil, diags
+	}
+
+	ctx := &hcl.EvalContext{
+		Functions: map[string]function.Function{"env": envFunc},
+	}
+	variables := map[string]cty.Value{}
+	for _, block := range raw.Variables {
+		for name, attr := range block.Attributes {
+			if value, ok := os.LookupEnv(VarEnvPrefix + name); ok {
+				variables[name] = cty.StringVal(value)
+				continue
+			}
+			value, diags := attr.Expr.Value(ctx)
+			if diags.HasErrors() {
+				return nil, diags
+			}
+			variables[name] = value
+		}
+	}
+	ctx.Variables = map[string]cty.Value{"var": cty.ObjectVal(variables)}
+
+	c := &Config{}
+	if diags := gohcl.DecodeBody(raw.Remain, ctx, c); diags.HasErrors() {
+		return nil, diags
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate 校验必填项和取值范围
+func (c *Config) Validate() error {
+	var errs []error
+	required := func(name, value string) {
+		if strings.TrimSpace(value) == "" {
+			errs = append(errs, fmt.Errorf("%s is required", name))
+		}
+	}
+
+	if len(c.Nats.Servers()) == 0 {
+		errs = append(errs, errors.New("natsmq.url or natsmq.urls is required"))
+	}
+	for i, url := range c.Nats.Urls {
+		required(fmt.Sprintf("natsmq.urls[%d]", i), url)
+	}
+	if c.Nats.CredsFile != "" && c.Nats.NkeySeedFile != "" {
+		errs = append(errs, errors.New("natsmq.creds_file and natsmq.nkey_seed_file are mutually exclusive"))
+	}
+	if (c.Nats.CredsFile != "" || c.Nats.NkeySeedFile != "") && c.Nats.User != "" {
+		errs = append(errs, errors.New("natsmq.user can not be combined with creds_file or nkey_seed_file"))
+	}
+	if tls := c.Nats.TLS; tls != nil && (tls.CertFile == "") != (tls.KeyFile == "") {
+		errs = append(errs, errors.New("natsmq.tls.cert_file and natsmq.tls.key_file must be set together"))
+	}
+	if c.Nats.ReconnectWait < 0 {
+		errs = append(errs, fmt.Errorf("natsmq.reconnect_wait must not be negative, got %d", c.Nats.ReconnectWait))
+	}
+	if c.Nats.MaxReconnects != nil && *c.Nats.MaxReconnects < -1 {
+		errs = append(errs, fmt.Errorf("natsmq.max_reconnects must be -1 or more, got %d", *c.Nats.MaxReconnects))
+	}
+	required("natsmq.topic", c.Nats.Topic)
+	required("natsmq.consumer", c.Nats.Consumer)
+	if c.Nats.BufferSize <= 0 {
+		errs = append(errs, fmt.Errorf("natsmq.buffer_size must be positive, got %d", c.Nats.BufferSize))
+	}
+	if c.Nats.AckWaitMintues <= 0 {
+		errs = append(errs, fmt.Errorf("natsmq.ack_wait_mintues must be positive, got %d", c.Nats.AckWaitMintues))
+	}
+
+	if c.Nats.DrainTimeout < 0 {
+		errs = append(errs, fmt.Errorf("natsmq.drain_timeout must not be negative, got %d", c.Nats.DrainTimeout))
+	}
+	switch c.Nats.Mode {
+	case "", "push", "pull":
+	default:
+		errs = append(errs, fmt.Errorf("natsmq.mode must be push or pull, got %q", c.Nats.Mode))
+	}
+	if c.Nats.FetchBatch < 0 {
+		errs = append(errs, fmt.Errorf("natsmq.fetch_batch must not be negative, got %d", c.Nats.FetchBatch))
+	}
+	if c.Nats.FetchWait < 0 {
+		errs = append(errs, fmt.Errorf("natsmq.fetch_wait must not be negative, got %d", c.Nats.FetchWait))
+	}
+	if c.Nats.MaxDeliver < 0 {
+		errs = append(errs, fmt.Errorf("natsmq.max_deliver must not be negative, got %d", c.Nats.MaxDeliver))
+	}
+	for eventType, subject := range c.Nats.Subjects {
+		required("natsmq.subjects."+eventType, subject)
+	}
+	if stream := c.Nats.Stream; stream != nil {
+		switch stream.Retention {
+		case "", "limits", "interest", "workqueue":
+		default:
+			errs = append(errs, fmt.Errorf("natsmq.stream.retention must be limits, interest or workqueue, got %q", stream.Retention))
+		}
+		if stream.MaxAge < 0 {
+			errs = append(errs, fmt.Errorf("natsmq.stream.max_age must not be negative, got %d", stream.MaxAge))
+		}
+		if stream.Replicas < 0 || stream.Replicas > 5 {
+			errs = append(errs, fmt.Errorf("natsmq.stream.replicas must be between 1 and 5, got %d", stream.Replicas))
+		}
+		for i, subject := range stream.Subjects {
+			required(fmt.Sprintf("natsmq.stream.subjects[%d]", i), subject)
+		}
+	}
+
+	required("xorm.driver", c.Xorm.Driver)
+	if len(c.Xorm.Datasource) == 0 {
+		errs = append(errs, errors.New("xorm.datasource is required"))
+	}
+	for i, ds := range c.Xorm.Datasource {
+		required(fmt.Sprintf("xorm.datasource[%d]", i), ds)
+	}
+
+	required("http.internal_secret", c.Http.InternalSecret)
+
+	if c.Settlement != nil {
+		percent := func(name string, value float64) {
+			if value < 0 || value > 100 {
+				errs = append(errs, fmt.Errorf("%s must be between 0 and 100, got %v", name, value))
+			}
+		}
+		percent("settlement.node_share_percent", c.Settlement.NodeSharePercent)
+		percent("settlement.provider_share_percent", c.Settlement.ProviderSharePercent)
+	}
+	if c.Pricing != nil && c.Pricing.ReloadInterval < 0 {
+		errs = append(errs, fmt.Errorf("pricing.reload_interval must not be negative, got %d", c.Pricing.ReloadInterval))
+	}
+	if c.Health != nil && c.Health.MaxConsumerLag < 0 {
+		errs = append(errs, fmt.Errorf("health.max_consumer_lag must not be negative, got %d", c.Health.MaxConsumerLag))
+	}
+	if o := c.Outbox; o != nil {
+		nonNegative := func(name string, value int) {
+			if value < 0 {
+				errs = append(errs, fmt.Errorf("%s must not be negative, got %d", name, value))
+			}
+		}
+		nonNegative("outbox.interval", o.Interval)
+		nonNegative("outbox.batch_size", o.BatchSize)
+		nonNegative("outbox.max_backoff", o.MaxBackoff)
+		nonNegative("outbox.retention_days", o.RetentionDays)
+	}
+	if w := c.Wallet; w != nil {
+		seen := map[string]bool{}
+		for i, walletType := range w.Priority {
+			required(fmt.Sprintf("wallet.priority[%d]", i), walletType)
+			if seen[walletType] {
+				errs = append(errs, fmt.Errorf("wallet.priority lists %q more than once", walletType))
+			}
+			seen[walletType] = true
+		}
+		if w.Overdraft != "" && len(w.Priority) > 0 && !seen[w.Overdraft] {
+			errs = append(errs, fmt.Errorf("wallet.overdraft %q is not in wallet.priority", w.Overdraft))
+		}
+	}
+	if r := c.Report; r != nil {
+		if r.MaxClockSkew < 0 {
+			errs = append(errs, fmt.Errorf("report.max_clock_skew must not be negative, got %d", r.MaxClockSkew))
+		}
+		if r.MaxLateness < 0 {
+			errs = append(errs, fmt.Errorf("report.max_lateness must not be negative, got %d", r.MaxLateness))
+		}
 	}
-	return c
+	return errors.Join(errs...)
 }
@@ -9,6 +9,7 @@ import (
 	"runtime"
 	"time"
 
+	"github.com/deepissue/core/authorities"
 	"github.com/deepissue/core/logging"
 	"github.com/deepissue/core/option"
 	"github.com/deepissue/core/server"
@@ -23,9 +24,17 @@ func main() {
 
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	opts := option.NewOptions()
+	opts.AddCommand("start", &startCommand{opts: opts})
+	opts.AddCommand("settle", &settleCommand{opts: opts})
+	opts.AddCommand("config", &configCommand{Check: configCheckCommand{opts: opts}})
+	opts.AddCommand("rollup", &rollupCommand{Backfill: rollupBackfillCommand{opts: opts}})
+	opts.AddCommand("pricing", &pricingCommand{Import: pricingImportCommand{opts: opts}, Export: pricingExportCommand{opts: opts}})
 	if err := opts.Parse(); err != nil {
 		return
 	}
+}
+
+func start(opts *option.Options) {
 	initialize(opts)
 	logger, err := logging.NewLogger(opts.Application, &opts.Log)
 	if err != nil {
@@ -38,9 +47,13 @@ func main() {
 		log.Fatal(err)
 		return
 	}
-	cfg := config.LoadConfig(opts.ConfigFile)
+	cfg, err := config.LoadConfig(opts.ConfigFile)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
 	logrus.Debugf("Loaded config: %v", cfg)
-	db, err := xorm.NewEngine(cfg.Xorm.Driver, cfg.Xorm.Datasource[0])
+	db, err := newEngine(cfg)
 	if err != nil {
 		log.Fatal(err)
 		return
@@ -51,13 +64,48 @@ func main() {
 		log.Fatal(err)
 		return
 	}
-	feeService.Start()
+	httpSrv, err := newHttpServer(srv, cfg)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	feeService.RegisterHandlers(httpSrv)
+	if err := httpSrv.Startup(); err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	if err := feeService.Start(); err != nil {
+		log.Fatal(err)
+		return
+	}
 	srv.HandleSignal(func() {
+		// 先停止消费并等待处理中的扣费完成，再关闭 HTTP 和数据库
 		feeService.Stop()
+		httpSrv.Stop()
+		if err := db.Close(); err != nil {
+			logrus.Errorf("close database: %v", err)
+		}
 	})
 
 }
 
+func newHttpServer(srv *server.Server, cfg *config.Config) (*server.HttpServer, error) {
+	tokens, err := authorities.NewNoopTokenHandler()
+	if err != nil {
+		return nil, err
+	}
+	authorization, err := authorities.NewAuthorization(&authorities.Settings{InternalSecret: cfg.Http.InternalSecret}, tokens)
+	if err != nil {
+		return nil, err
+	}
+	return srv.NewHttpServer(authorization)
+}
+
+func newEngine(cfg *config.Config) (*xorm.Engine, error) {
+	return xorm.NewEngine(cfg.Xorm.Driver, cfg.Xorm.Datasource[0])
+}
+
 func initialize(opts *option.Options) {
 	level, err := logrus.ParseLevel(opts.Log.Level)
 	if err != nil {
@@ -0,0 +1,38 @@
+package models
+
+const (
+	ApiKeyEnabled  = "enabled"
+	ApiKeyDisabled = "disabled"
+)
+
+// ApiKey 调用方 API key，上报中的 caller_key 为 KeyId
+// 一个用户可以有多个 key，每个 key 可以指定扣费钱包和按日、按月的消费限额（微代币，0 表示不限）
+// 钱包为组织钱包时，key 的所属用户必须是组织成员，消费同时计入成员限额
+type ApiKey struct {
+	ID           int64  `xorm:"pk autoincr comment('主键，自增')" json:"id"`                            // 主键，自增
+	KeyId        string `xorm:"varchar(64) notnull unique comment('key id')" json:"key_id"`        // key id
+	UserId       int64  `xorm:"bigint notnull index comment('所属用户')" json:"user_id"`               // 所属用户
+	WalletId     int64  `xorm:"bigint default 0 comment('扣费钱包，0 表示用户默认钱包')" json:"wallet_id"`      // 扣费钱包
+	OrgId        int64  `xorm:"bigint default 0 index comment('扣费钱包所属组织')" json:"org_id"`          // 扣费钱包所属组织，0 表示个人钱包
+	Name         string `xorm:"varchar(64) default '' comment('名称')" json:"name"`                  // 名称
+	Status       string `xorm:"varchar(16) notnull default 'enabled' comment('状态')" json:"status"` // enabled/disabled
+	SpendCounter `xorm:"extends"`
+	LastUsedAt   int64 `xorm:"bigint default 0 comment('最后使用时间')" json:"last_used_at"` // 最后使用时间
+	CreatedAt    int64 `xorm:"created_at comment('创建时间')" json:"created"`              // 创建时间
+	UpdatedAt    int64 `xorm:"updated_at comment('更新时间')" json:"updated"`              // 更新时间
+}
+
+func (ApiKey) TableName() string {
+	return "api_key"
+}
+
+// SpendCounter 按日、按月的消费限额和累计（微代币，限额为 0 表示不限）
+// DaySpent/MonthSpent 为 DayStart/MonthStart 开始的周期内已扣费金额，与扣费在同一事务中累加
+type SpendCounter struct {
+	DailyLimit   int64 `xorm:"bigint default 0 comment('每日限额')" json:"daily_limit"`   // 每日限额，0 表示不限
+	MonthlyLimit int64 `xorm:"bigint default 0 comment('每月限额')" json:"monthly_limit"` // 每月限额，0 表示不限
+	DaySpent     int64 `xorm:"bigint default 0 comment('当日已消费')" json:"day_spent"`    // 当日已消费
+	DayStart     int64 `xorm:"bigint default 0 comment('当日开始时间')" json:"day_start"`   // 当日开始时间
+	MonthSpent   int64 `xorm:"bigint default 0 comment('当月已消费')" json:"month_spent"`  // 当月已消费
+	MonthStart   int64 `xorm:"bigint default 0 comment('当月开始时间')" json:"month_start"` // 当月开始时间
+}
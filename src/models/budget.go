@@ -0,0 +1,35 @@
+package models
+
+const (
+	BudgetDaily   = "daily"
+	BudgetMonthly = "monthly"
+
+	BudgetActionFlag   = "flag"   // 超出后照常扣费，只记录并发布事件
+	BudgetActionReject = "reject" // 超出后照常扣费并发布事件，网关通过 budgets/check 拒绝本窗口内的后续调用
+
+	BudgetEnabled  = "enabled"
+	BudgetDisabled = "disabled"
+)
+
+// Budget 用户的消费预算，KeyId/ModelId 为空表示不限 key/模型
+// Spent 为 WindowStart 开始的窗口内已扣费金额（微代币），与扣费在同一事务中累加；
+// ExceededWindow 为已发布超预算事件的窗口开始时间，每个窗口只发布一次
+type Budget struct {
+	ID             int64  `xorm:"pk autoincr comment('主键，自增')" json:"id"`                             // 主键，自增
+	UserId         int64  `xorm:"bigint notnull index comment('用户id')" json:"user_id"`                // 用户id
+	KeyId          string `xorm:"varchar(64) default '' comment('API key')" json:"key_id"`            // API key，空表示全部
+	ModelId        string `xorm:"varchar(64) default '' comment('模型id')" json:"model_id"`             // 模型id，空表示全部
+	Window         string `xorm:"varchar(16) notnull comment('窗口')" json:"window"`                    // daily/monthly
+	LimitAmount    int64  `xorm:"bigint notnull comment('预算')" json:"limit_amount"`                   // 预算（微代币）
+	Action         string `xorm:"varchar(16) notnull default 'flag' comment('超出后的处理')" json:"action"` // flag/reject
+	Status         string `xorm:"varchar(16) notnull default 'enabled' comment('状态')" json:"status"`  // enabled/disabled
+	Spent          int64  `xorm:"bigint default 0 comment('窗口内已消费')" json:"spent"`                    // 窗口内已消费
+	WindowStart    int64  `xorm:"bigint default 0 comment('窗口开始时间')" json:"window_start"`             // 窗口开始时间
+	ExceededWindow int64  `xorm:"bigint default 0 comment('已发布超预算事件的窗口')" json:"exceeded_window"`     // 已发布超预算事件的窗口
+	CreatedAt      int64  `xorm:"created_at comment('创建时间')" json:"created"`                          // 创建时间
+	UpdatedAt      int64  `xorm:"updated_at comment('更新时间')" json:"updated"`                          // 更新时间
+}
+
+func (Budget) TableName() string {
+	return "budget"
+}
@@ -0,0 +1,14 @@
+package models
+
+// ExchangeRate 代币与法币的汇率，按 valid_from 保留历史，某一时刻使用 valid_from 最新且不晚于该时刻的汇率
+type ExchangeRate struct {
+	ID         int64  `xorm:"pk autoincr comment('主键，自增')" json:"id"`                                    // 主键，自增
+	Currency   string `xorm:"varchar(8) notnull index(idx_currency_from) comment('法币')" json:"currency"` // 法币 USD/CNY
+	MicroCoins int64  `xorm:"bigint notnull comment('1单位法币对应的微代币')" json:"micro_coins"`                  // 1 单位法币对应的微代币
+	ValidFrom  int64  `xorm:"bigint notnull index(idx_currency_from) comment('生效时间')" json:"valid_from"` // 生效时间
+	CreatedAt  int64  `xorm:"created_at comment('创建时间')" json:"created"`                                 // 创建时间
+}
+
+func (ExchangeRate) TableName() string {
+	return "exchange_rate"
+}
@@ -0,0 +1,39 @@
+package models
+
+const (
+	OrgMemberAdmin  = "admin"
+	OrgMemberMember = "member"
+
+	OrgMemberActive   = "active"
+	OrgMemberDisabled = "disabled"
+)
+
+// Organization 组织（团队），成员共用组织钱包
+// 组织钱包是 user_wallet 中 org_id 为组织id、user_id 为 0 的记录
+type Organization struct {
+	ID        int64  `xorm:"pk autoincr comment('主键，自增')" json:"id"`            // 主键，自增
+	Name      string `xorm:"varchar(128) notnull comment('名称')" json:"name"`    // 名称
+	WalletId  int64  `xorm:"bigint default 0 comment('组织钱包')" json:"wallet_id"` // 组织钱包
+	CreatedAt int64  `xorm:"created_at comment('创建时间')" json:"created"`         // 创建时间
+	UpdatedAt int64  `xorm:"updated_at comment('更新时间')" json:"updated"`         // 更新时间
+}
+
+func (Organization) TableName() string {
+	return "organization"
+}
+
+// OrgMember 组织成员及其在组织钱包上的消费限额
+type OrgMember struct {
+	ID           int64  `xorm:"pk autoincr comment('主键，自增')" json:"id"`                                  // 主键，自增
+	OrgId        int64  `xorm:"bigint notnull unique(uk_org_user) comment('组织id')" json:"org_id"`        // 组织id
+	UserId       int64  `xorm:"bigint notnull unique(uk_org_user) index comment('用户id')" json:"user_id"` // 用户id
+	Role         string `xorm:"varchar(16) notnull default 'member' comment('角色')" json:"role"`          // admin/member
+	Status       string `xorm:"varchar(16) notnull default 'active' comment('状态')" json:"status"`        // active/disabled
+	SpendCounter `xorm:"extends"`
+	CreatedAt    int64 `xorm:"created_at comment('创建时间')" json:"created"` // 创建时间
+	UpdatedAt    int64 `xorm:"updated_at comment('更新时间')" json:"updated"` // 更新时间
+}
+
+func (OrgMember) TableName() string {
+	return "org_member"
+}
@@ -0,0 +1,24 @@
+package models
+
+const (
+	OutboxPending = "pending"
+	OutboxSent    = "sent"
+)
+
+// Outbox 待发布到 NATS 的消息，与扣费在同一事务中写入，由 relay 发布后标记为已发送
+type Outbox struct {
+	ID            int64  `xorm:"pk autoincr comment('主键，自增')" json:"id"`                                                   // 主键，自增
+	MsgId         string `xorm:"varchar(64) notnull unique comment('消息id')" json:"msg_id"`                                 // 消息id，发布时作为 Nats-Msg-Id
+	Subject       string `xorm:"varchar(128) notnull comment('主题')" json:"subject"`                                        // 主题
+	Payload       []byte `xorm:"mediumblob notnull comment('消息内容')" json:"payload"`                                        // 消息内容
+	Status        string `xorm:"varchar(16) notnull default 'pending' index(idx_status_next) comment('状态')" json:"status"` // pending/sent
+	Attempts      int    `xorm:"int default 0 comment('发布失败次数')" json:"attempts"`                                          // 发布失败次数
+	NextAttemptAt int64  `xorm:"bigint default 0 index(idx_status_next) comment('下次发布时间')" json:"next_attempt_at"`         // 下次发布时间
+	LastError     string `xorm:"varchar(512) default '' comment('最近一次发布错误')" json:"last_error"`                            // 最近一次发布错误
+	SentAt        int64  `xorm:"bigint default 0 comment('发送时间')" json:"sent_at"`                                          // 发送时间
+	CreatedAt     int64  `xorm:"created_at comment('创建时间')" json:"created"`                                                // 创建时间
+}
+
+func (Outbox) TableName() string {
+	return "outbox"
+}
@@ -0,0 +1,33 @@
+package models
+
+// SettlementPeriod 结算周期，结算完成后锁定；锁定后到达的消费记录滚入下一期结算
+type SettlementPeriod struct {
+	ID          int64  `xorm:"pk autoincr comment('主键，自增')" json:"id"`                              // 主键，自增
+	PeriodStart int64  `xorm:"bigint notnull unique comment('周期开始时间')" json:"period_start"`         // 周期开始时间
+	PeriodEnd   int64  `xorm:"bigint notnull comment('周期结束时间')" json:"period_end"`                  // 周期结束时间
+	Status      string `xorm:"varchar(16) default 'open' comment('状态: open/locked')" json:"status"` // 状态
+	LockedAt    int64  `xorm:"bigint default 0 comment('锁定时间')" json:"locked_at"`                   // 锁定时间
+	CreatedAt   int64  `xorm:"created_at comment('创建时间')" json:"created"`                           // 创建时间
+}
+
+func (SettlementPeriod) TableName() string {
+	return "settlement_period"
+}
+
+// SettlementStatement 结算单，每个周期内每个节点/服务商一行
+type SettlementStatement struct {
+	ID           int64   `xorm:"pk autoincr comment('主键，自增')" json:"id"`                                // 主键，自增
+	PeriodId     int64   `xorm:"bigint notnull index comment('结算周期id')" json:"period_id"`               // 结算周期id
+	PartyType    string  `xorm:"varchar(16) notnull comment('结算方类型: node/provider')" json:"party_type"` // 结算方类型
+	PartyId      string  `xorm:"varchar(64) notnull comment('结算方id')" json:"party_id"`                  // 节点id或服务商id
+	Calls        int64   `xorm:"bigint default 0 comment('调用次数')" json:"calls"`                         // 调用次数
+	GrossAmount  int64   `xorm:"bigint default 0 comment('用户消费总额')" json:"gross_amount"`                // 用户消费总额
+	ProviderCost int64   `xorm:"bigint default 0 comment('上游成本')" json:"provider_cost"`                 // 上游成本
+	SharePercent float64 `xorm:"double default 0 comment('分成比例')" json:"share_percent"`                 // 分成比例(%)
+	PayoutAmount int64   `xorm:"bigint default 0 comment('应结算金额')" json:"payout_amount"`                // 应结算金额
+	CreatedAt    int64   `xorm:"created_at comment('创建时间')" json:"created"`                             // 创建时间
+}
+
+func (SettlementStatement) TableName() string {
+	return "settlement_statement"
+}
@@ -0,0 +1,24 @@
+package models
+
+const (
+	UsageRollupHourlyTable = "usage_rollup_hourly"
+	UsageRollupDailyTable  = "usage_rollup_daily"
+)
+
+// UsageRollup 用量汇总，按时间桶和 用户/模型/服务商/节点 聚合，小时表和天表共用结构
+type UsageRollup struct {
+	ID               int64   `xorm:"pk autoincr comment('主键，自增')" json:"id"`                                                      // 主键，自增
+	Bucket           int64   `xorm:"bigint notnull unique(uk_rollup) comment('时间桶起点')" json:"bucket"`                             // 时间桶起点
+	UserId           int64   `xorm:"bigint notnull unique(uk_rollup) comment('用户ID')" json:"user_id"`                             // 用户ID
+	ModelId          string  `xorm:"varchar(64) notnull default '' unique(uk_rollup) comment('模型id')" json:"model_id"`            // 模型id
+	ActualProviderId string  `xorm:"varchar(64) notnull default '' unique(uk_rollup) comment('服务商id')" json:"actual_provider_id"` // 实际服务商id
+	NodeId           string  `xorm:"varchar(64) notnull default '' unique(uk_rollup) comment('节点id')" json:"node_id"`             // 节点id
+	Calls            int64   `xorm:"bigint default 0 comment('调用次数')" json:"calls"`                                               // 调用次数
+	InputTokens      int64   `xorm:"bigint default 0 comment('输入token数')" json:"input_tokens"`                                    // 输入token数
+	OutputTokens     int64   `xorm:"bigint default 0 comment('输出token数')" json:"output_tokens"`                                   // 输出token数
+	CacheTokens      int64   `xorm:"bigint default 0 comment('缓存token数')" json:"cache_tokens"`                                    // 缓存token数
+	Images           int64   `xorm:"bigint default 0 comment('图片数')" json:"images"`                                               // 图片数
+	VideoSeconds     float64 `xorm:"double default 0 comment('视频秒数')" json:"video_seconds"`                                       // 视频秒数
+	TotalConsumed    int64   `xorm:"bigint default 0 comment('消费总额')" json:"total_consumed"`                                      // 消费总额
+	UpdatedAt        int64   `xorm:"updated_at comment('更新时间')" json:"updated"`                                                   // 更新时间
+}
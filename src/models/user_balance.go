@@ -6,9 +6,17 @@ import (
 	"time"
 )
 
+const (
+	WalletTypeCredit  = "credit"  // 充值余额，早期未设置类型的钱包按此处理
+	WalletTypePromo   = "promo"   // 赠送额度
+	WalletTypeOnchain = "onchain" // 链上钱包，WalletAddress 为链上地址
+)
+
+// UserWallet 用户钱包，一个用户可以有多个不同类型的钱包，扣费顺序见 config.WalletConfig
 type UserWallet struct {
 	Id            int64  `json:"id" xorm:"'id' pk autoincr BIGINT(12)"`
 	UserId        int64  `json:"user_id" xorm:"'user_id' BIGINT(12)"`
+	OrgId         int64  `json:"org_id" xorm:"'org_id' BIGINT(12) default 0"` // 组织钱包的组织id，个人钱包为 0
 	WalletType    string `json:"wallet_type" xorm:"'wallet_type' VARCHAR(32)"`
 	WalletAddress string `json:"wallet_address" xorm:"'wallet_address' VARCHAR(255)"`
 	Balance       int64  `json:"balance" xorm:"'balance' BIGINT(12)"`
@@ -16,6 +24,14 @@ type UserWallet struct {
 	UpdatedAt     int64  `json:"updated_at" xorm:"'updated_at' BIGINT(20)"`
 }
 
+// Type 返回钱包类型，未设置时为 WalletTypeCredit
+func (o *UserWallet) Type() string {
+	if o.WalletType == "" {
+		return WalletTypeCredit
+	}
+	return o.WalletType
+}
+
 func (o *UserWallet) TableName() string {
 	return "user_wallet"
 }
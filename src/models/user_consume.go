@@ -1,26 +1,47 @@
 package models
 
+import (
+	"fmt"
+	"time"
+)
+
 // UserConsumeRecord 表示用户消费记录
 type UserConsumeRecord struct {
 	ID               int64  `xorm:"pk autoincr comment('主键，自增')" json:"id"`                   // 主键，自增
 	UserId           int64  `xorm:"user_id int notnull index comment('用户ID')" json:"user_id"` // 用户ID
 	NodeId           string `json:"node_id" xorm:"'node_id' VARCHAR(64)"`
-	DiscountAmount   int64  `xorm:"bigint default 0 comment('折扣数量')" json:"discount_amount"`     // 折扣数量
-	TotalConsumed    int64  `xorm:"bigint default 0 comment('本次使用的币数量')" json:"total_consumed"`  // 本次扣费数量
-	Caller           string `xorm:"varchar(64) index comment('调用方')" json:"caller"`              // 调用方
-	Model            string `xorm:"varchar(64) comment('模型')" json:"model"`                      // 模型
-	ModelId          string `xorm:"varchar(64) comment('模型id')" json:"model_id"`                 // 模型id
-	ActualProvider   string `xorm:"varchar(64) comment('服务商')" son:"actual_provider"`            // 实际服务商
-	ActualProviderId string `xorm:"varchar(64) comment('服务商id')" json:"actual_provider_id"`      // 实际服务商id
-	ConsumeType      string `xorm:"varchar(255) default '' comment('消费类型')" json:"consume_type"` // 消费类型
-	CreatedAt        int64  `xorm:"created_at comment('创建时间')" json:"created"`                   // 创建时间
-	UpdatedAt        int64  `xorm:"updated_at comment('更新时间')" json:"updated"`                   // 更新时间
+	DiscountAmount   int64  `xorm:"bigint default 0 comment('折扣数量')" json:"discount_amount"`          // 折扣数量
+	TotalConsumed    int64  `xorm:"bigint default 0 comment('本次使用的币数量')" json:"total_consumed"`       // 本次扣费数量
+	Caller           string `xorm:"varchar(64) index comment('调用方')" json:"caller"`                   // 调用方
+	WalletId         int64  `xorm:"bigint default 0 comment('扣费钱包')" json:"wallet_id"`                // 第一个扣费钱包，多个钱包分摊时见钱包明细
+	OrgId            int64  `xorm:"bigint default 0 index comment('组织id')" json:"org_id"`             // 扣费钱包所属组织，0 表示个人钱包
+	Model            string `xorm:"varchar(64) comment('模型')" json:"model"`                           // 模型
+	ModelId          string `xorm:"varchar(64) comment('模型id')" json:"model_id"`                      // 模型id
+	ActualProvider   string `xorm:"varchar(64) comment('服务商')" json:"actual_provider"`                // 实际服务商
+	ActualProviderId string `xorm:"varchar(64) comment('服务商id')" json:"actual_provider_id"`           // 实际服务商id
+	ActualModel      string `xorm:"varchar(128) comment('实际模型')" json:"actual_model"`                 // 实际模型
+	ProviderCost     int64  `xorm:"bigint default 0 comment('上游成本')" json:"provider_cost"`            // 上游服务商成本
+	Margin           int64  `xorm:"bigint default 0 comment('毛利')" json:"margin"`                     // 毛利 = 扣费 - 成本，没有成本时为 0
+	HasCost          bool   `xorm:"default 0 comment('是否有上游成本')" json:"has_cost"`                     // 是否有上游成本，没有时不计入成本和毛利统计
+	ConsumeType      string `xorm:"varchar(255) default '' comment('消费类型')" json:"consume_type"`      // 消费类型
+	SettlePeriodId   int64  `xorm:"bigint default 0 index comment('结算周期id')" json:"settle_period_id"` // 结算周期id，0 表示未结算
+	CreatedAt        int64  `xorm:"created_at comment('创建时间')" json:"created"`                        // 创建时间
+	UpdatedAt        int64  `xorm:"updated_at comment('更新时间')" json:"updated"`                        // 更新时间
 }
 
 func (UserConsumeRecord) TableName() string {
 	return "user_consume"
 }
 
+func (UserConsumeRecord) GetSliceName(slice string) string {
+	return fmt.Sprintf("user_consume_%s", slice)
+}
+
+// Slice 返回记录所在分表的月份 YYYYMM；各月分表的 id 分别自增，id 只在同一月份内唯一
+func (o UserConsumeRecord) Slice() string {
+	return monthSlice(time.Unix(o.CreatedAt, 0))
+}
+
 type UserConsumeDetailText struct {
 	ID           int64 `xorm:"pk autoincr comment('主键，自增')" json:"id"`                    // 主键，自增
 	ConsumdId    int64 `xorm:"consume_id comment('消费记录id')" json:"consume_id"`            // 消费记录id
@@ -37,18 +58,28 @@ func (UserConsumeDetailText) TableName() string {
 	return "user_consume_detail_text"
 }
 
+func (UserConsumeDetailText) GetSliceName(slice string) string {
+	return fmt.Sprintf("user_consume_detail_text_%s", slice)
+}
+
 // UserConsumeDetailImage 图片消费明细，可能是多张
 type UserConsumeDetailImage struct {
-	ID        int64  `xorm:"pk autoincr comment('主键，自增')" json:"id"`        // 主键，自增
-	Quality   string `xorm:"varchar(64) comment('Quality')" json:"quality"` // Quality
-	Size      string `xorm:"varchar(64) comment('Size')" json:"size"`       // Size
-	CreatedAt int64  `xorm:"created_at comment('创建时间')" json:"created"`     // 创建时间
+	ID        int64  `xorm:"pk autoincr comment('主键，自增')" json:"id"`         // 主键，自增
+	ConsumdId int64  `xorm:"consume_id comment('消费记录id')" json:"consume_id"` // 消费记录id
+	Quality   string `xorm:"varchar(64) comment('Quality')" json:"quality"`  // Quality
+	Size      string `xorm:"varchar(64) comment('Size')" json:"size"`        // Size
+	Count     int64  `xorm:"bigint default 1 comment('图片数')" json:"count"`   // 图片数
+	CreatedAt int64  `xorm:"created_at comment('创建时间')" json:"created"`      // 创建时间
 }
 
 func (UserConsumeDetailImage) TableName() string {
 	return "user_consume_detail_image"
 }
 
+func (UserConsumeDetailImage) GetSliceName(slice string) string {
+	return fmt.Sprintf("user_consume_detail_image_%s", slice)
+}
+
 type UserConsumeDetailVideo struct {
 	ID        int64   `xorm:"pk autoincr comment('主键，自增')" json:"id"`         // 主键，自增
 	ConsumdId int64   `xorm:"consume_id comment('消费记录id')" json:"consume_id"` // 消费记录id
@@ -60,3 +91,75 @@ type UserConsumeDetailVideo struct {
 func (UserConsumeDetailVideo) TableName() string {
 	return "user_consume_detail_video"
 }
+
+func (UserConsumeDetailVideo) GetSliceName(slice string) string {
+	return fmt.Sprintf("user_consume_detail_video_%s", slice)
+}
+
+// UserConsumeDetailWallet 一次消费在各钱包上的扣费分摊，按扣费顺序写入
+type UserConsumeDetailWallet struct {
+	ID           int64  `xorm:"pk autoincr comment('主键，自增')" json:"id"`                    // 主键，自增
+	ConsumeId    int64  `xorm:"consume_id index comment('消费记录id')" json:"consume_id"`      // 消费记录id
+	WalletId     int64  `xorm:"bigint notnull comment('钱包id')" json:"wallet_id"`           // 钱包id
+	WalletType   string `xorm:"varchar(32) default '' comment('钱包类型')" json:"wallet_type"` // 钱包类型
+	Amount       int64  `xorm:"bigint default 0 comment('扣费数量')" json:"amount"`            // 从该钱包扣除的数量
+	BalanceAfter int64  `xorm:"bigint default 0 comment('扣费后余额')" json:"balance_after"`    // 扣费后余额
+	CreatedAt    int64  `xorm:"created_at comment('创建时间')" json:"created"`                 // 创建时间
+}
+
+func (UserConsumeDetailWallet) TableName() string {
+	return "user_consume_detail_wallet"
+}
+
+func (UserConsumeDetailWallet) GetSliceName(slice string) string {
+	return fmt.Sprintf("user_consume_detail_wallet_%s", slice)
+}
+
+// ConsumeTables 一个月份的消费记录表及其明细表
+type ConsumeTables struct {
+	Slice  string // 月份 YYYYMM，为空表示分表之前的历史单表
+	Record string
+	Text   string
+	Image  string
+	Video  string
+	Wallet string // 钱包分摊明细
+}
+
+func monthSlice(t time.Time) string {
+	return fmt.Sprintf("%d%02d", t.Year(), t.Month())
+}
+
+// ConsumeTablesOf 返回 t 所在月份的消费分表
+func ConsumeTablesOf(t time.Time) ConsumeTables {
+	slice := monthSlice(t)
+	return ConsumeTables{
+		Slice:  slice,
+		Record: UserConsumeRecord{}.GetSliceName(slice),
+		Text:   UserConsumeDetailText{}.GetSliceName(slice),
+		Image:  UserConsumeDetailImage{}.GetSliceName(slice),
+		Video:  UserConsumeDetailVideo{}.GetSliceName(slice),
+		Wallet: UserConsumeDetailWallet{}.GetSliceName(slice),
+	}
+}
+
+// LegacyConsumeTables 返回分表之前的历史单表
+func LegacyConsumeTables() ConsumeTables {
+	return ConsumeTables{
+		Record: UserConsumeRecord{}.TableName(),
+		Text:   UserConsumeDetailText{}.TableName(),
+		Image:  UserConsumeDetailImage{}.TableName(),
+		Video:  UserConsumeDetailVideo{}.TableName(),
+		Wallet: UserConsumeDetailWallet{}.TableName(),
+	}
+}
+
+// ConsumeTablesBetween 返回与 [start, end) 有交集的所有月份分表，按月份升序
+func ConsumeTablesBetween(start, end time.Time) []ConsumeTables {
+	var tables []ConsumeTables
+	month := time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, start.Location())
+	for month.Before(end) {
+		tables = append(tables, ConsumeTablesOf(month))
+		month = month.AddDate(0, 1, 0)
+	}
+	return tables
+}
@@ -0,0 +1,33 @@
+package models
+
+// UserRecharge 用户充值记录，由充值服务写入，计费服务只读
+type UserRecharge struct {
+	ID        int64  `xorm:"pk autoincr comment('主键，自增')" json:"id"`              // 主键，自增
+	UserId    int64  `xorm:"bigint notnull index comment('用户ID')" json:"user_id"` // 用户ID
+	WalletId  int64  `xorm:"bigint default 0 comment('钱包id')" json:"wallet_id"`   // 钱包id
+	Amount    int64  `xorm:"bigint default 0 comment('充值数量')" json:"amount"`      // 充值数量（微代币）
+	Source    string `xorm:"varchar(64) comment('充值来源')" json:"source"`           // 充值来源
+	CreatedAt int64  `xorm:"created_at index comment('创建时间')" json:"created"`     // 创建时间
+}
+
+func (UserRecharge) TableName() string {
+	return "user_recharge"
+}
+
+// UserStatement 用户月度账单
+type UserStatement struct {
+	ID             int64  `xorm:"pk autoincr comment('主键，自增')" json:"id"`                                // 主键，自增
+	UserId         int64  `xorm:"bigint notnull unique(uk_user_month) comment('用户ID')" json:"user_id"`   // 用户ID
+	Month          string `xorm:"varchar(7) notnull unique(uk_user_month) comment('账单月份')" json:"month"` // 账单月份 YYYY-MM
+	OpeningBalance int64  `xorm:"bigint default 0 comment('期初余额')" json:"opening_balance"`               // 期初余额
+	TopUps         int64  `xorm:"bigint default 0 comment('充值总额')" json:"top_ups"`                       // 充值总额
+	Consumed       int64  `xorm:"bigint default 0 comment('消费总额')" json:"consumed"`                      // 消费总额
+	Discounts      int64  `xorm:"bigint default 0 comment('折扣总额')" json:"discounts"`                     // 折扣总额
+	ClosingBalance int64  `xorm:"bigint default 0 comment('期末余额')" json:"closing_balance"`               // 期末余额
+	Content        string `xorm:"mediumtext comment('账单明细JSON')" json:"content"`                         // 账单明细
+	CreatedAt      int64  `xorm:"created_at comment('创建时间')" json:"created"`                             // 创建时间
+}
+
+func (UserStatement) TableName() string {
+	return "user_statement"
+}
@@ -0,0 +1,588 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.8
+// 	protoc        (unknown)
+// source: pb/usage.proto
+
+package pb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type LLMReport struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Calls         []*LLMCallData         `protobuf:"bytes,1,rep,name=calls,proto3" json:"calls,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LLMReport) Reset() {
+	*x = LLMReport{}
+	mi := &file_pb_usage_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LLMReport) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LLMReport) ProtoMessage() {}
+
+func (x *LLMReport) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_usage_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LLMReport.ProtoReflect.Descriptor instead.
+func (*LLMReport) Descriptor() ([]byte, []int) {
+	return file_pb_usage_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *LLMReport) GetCalls() []*LLMCallData {
+	if x != nil {
+		return x.Calls
+	}
+	return nil
+}
+
+type LLMCallData struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	Id               string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	NodeId           string                 `protobuf:"bytes,2,opt,name=node_id,json=nodeId,proto3" json:"node_id,omitempty"`
+	Model            string                 `protobuf:"bytes,3,opt,name=model,proto3" json:"model,omitempty"`
+	ModelId          string                 `protobuf:"bytes,4,opt,name=model_id,json=modelId,proto3" json:"model_id,omitempty"`
+	ActualModel      string                 `protobuf:"bytes,5,opt,name=actual_model,json=actualModel,proto3" json:"actual_model,omitempty"`
+	Provider         string                 `protobuf:"bytes,6,opt,name=provider,proto3" json:"provider,omitempty"`
+	ActualProvider   string                 `protobuf:"bytes,7,opt,name=actual_provider,json=actualProvider,proto3" json:"actual_provider,omitempty"`
+	ActualProviderId string                 `protobuf:"bytes,8,opt,name=actual_provider_id,json=actualProviderId,proto3" json:"actual_provider_id,omitempty"`
+	Caller           string                 `protobuf:"bytes,9,opt,name=caller,proto3" json:"caller,omitempty"`
+	CallerKey        string                 `protobuf:"bytes,10,opt,name=caller_key,json=callerKey,proto3" json:"caller_key,omitempty"`
+	ClientVersion    string                 `protobuf:"bytes,11,opt,name=client_version,json=clientVersion,proto3" json:"client_version,omitempty"`
+	AgentVersion     string                 `protobuf:"bytes,12,opt,name=agent_version,json=agentVersion,proto3" json:"agent_version,omitempty"`
+	Stream           bool                   `protobuf:"varint,13,opt,name=stream,proto3" json:"stream,omitempty"`
+	ReportType       string                 `protobuf:"bytes,14,opt,name=report_type,json=reportType,proto3" json:"report_type,omitempty"`
+	Timestamp        int64                  `protobuf:"varint,15,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	// Types that are valid to be assigned to Usage:
+	//
+	//	*LLMCallData_Text
+	//	*LLMCallData_Image
+	//	*LLMCallData_Video
+	Usage         isLLMCallData_Usage `protobuf_oneof:"usage"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LLMCallData) Reset() {
+	*x = LLMCallData{}
+	mi := &file_pb_usage_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LLMCallData) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LLMCallData) ProtoMessage() {}
+
+func (x *LLMCallData) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_usage_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LLMCallData.ProtoReflect.Descriptor instead.
+func (*LLMCallData) Descriptor() ([]byte, []int) {
+	return file_pb_usage_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *LLMCallData) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *LLMCallData) GetNodeId() string {
+	if x != nil {
+		return x.NodeId
+	}
+	return ""
+}
+
+func (x *LLMCallData) GetModel() string {
+	if x != nil {
+		return x.Model
+	}
+	return ""
+}
+
+func (x *LLMCallData) GetModelId() string {
+	if x != nil {
+		return x.ModelId
+	}
+	return ""
+}
+
+func (x *LLMCallData) GetActualModel() string {
+	if x != nil {
+		return x.ActualModel
+	}
+	return ""
+}
+
+func (x *LLMCallData) GetProvider() string {
+	if x != nil {
+		return x.Provider
+	}
+	return ""
+}
+
+func (x *LLMCallData) GetActualProvider() string {
+	if x != nil {
+		return x.ActualProvider
+	}
+	return ""
+}
+
+func (x *LLMCallData) GetActualProviderId() string {
+	if x != nil {
+		return x.ActualProviderId
+	}
+	return ""
+}
+
+func (x *LLMCallData) GetCaller() string {
+	if x != nil {
+		return x.Caller
+	}
+	return ""
+}
+
+func (x *LLMCallData) GetCallerKey() string {
+	if x != nil {
+		return x.CallerKey
+	}
+	return ""
+}
+
+func (x *LLMCallData) GetClientVersion() string {
+	if x != nil {
+		return x.ClientVersion
+	}
+	return ""
+}
+
+func (x *LLMCallData) GetAgentVersion() string {
+	if x != nil {
+		return x.AgentVersion
+	}
+	return ""
+}
+
+func (x *LLMCallData) GetStream() bool {
+	if x != nil {
+		return x.Stream
+	}
+	return false
+}
+
+func (x *LLMCallData) GetReportType() string {
+	if x != nil {
+		return x.ReportType
+	}
+	return ""
+}
+
+func (x *LLMCallData) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *LLMCallData) GetUsage() isLLMCallData_Usage {
+	if x != nil {
+		return x.Usage
+	}
+	return nil
+}
+
+func (x *LLMCallData) GetText() *TextUsage {
+	if x != nil {
+		if x, ok := x.Usage.(*LLMCallData_Text); ok {
+			return x.Text
+		}
+	}
+	return nil
+}
+
+func (x *LLMCallData) GetImage() *ImageUsage {
+	if x != nil {
+		if x, ok := x.Usage.(*LLMCallData_Image); ok {
+			return x.Image
+		}
+	}
+	return nil
+}
+
+func (x *LLMCallData) GetVideo() *VideoUsage {
+	if x != nil {
+		if x, ok := x.Usage.(*LLMCallData_Video); ok {
+			return x.Video
+		}
+	}
+	return nil
+}
+
+type isLLMCallData_Usage interface {
+	isLLMCallData_Usage()
+}
+
+type LLMCallData_Text struct {
+	Text *TextUsage `protobuf:"bytes,16,opt,name=text,proto3,oneof"`
+}
+
+type LLMCallData_Image struct {
+	Image *ImageUsage `protobuf:"bytes,17,opt,name=image,proto3,oneof"`
+}
+
+type LLMCallData_Video struct {
+	Video *VideoUsage `protobuf:"bytes,18,opt,name=video,proto3,oneof"`
+}
+
+func (*LLMCallData_Text) isLLMCallData_Usage() {}
+
+func (*LLMCallData_Image) isLLMCallData_Usage() {}
+
+func (*LLMCallData_Video) isLLMCallData_Usage() {}
+
+type TextUsage struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	InputTokens     int64                  `protobuf:"varint,1,opt,name=input_tokens,json=inputTokens,proto3" json:"input_tokens,omitempty"`
+	OutputTokens    int64                  `protobuf:"varint,2,opt,name=output_tokens,json=outputTokens,proto3" json:"output_tokens,omitempty"`
+	CacheTokens     int64                  `protobuf:"varint,3,opt,name=cache_tokens,json=cacheTokens,proto3" json:"cache_tokens,omitempty"`
+	ReasoningTokens int32                  `protobuf:"varint,4,opt,name=reasoning_tokens,json=reasoningTokens,proto3" json:"reasoning_tokens,omitempty"`
+	TokensPerSec    int32                  `protobuf:"varint,5,opt,name=tokens_per_sec,json=tokensPerSec,proto3" json:"tokens_per_sec,omitempty"`
+	Latency         float64                `protobuf:"fixed64,6,opt,name=latency,proto3" json:"latency,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *TextUsage) Reset() {
+	*x = TextUsage{}
+	mi := &file_pb_usage_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TextUsage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TextUsage) ProtoMessage() {}
+
+func (x *TextUsage) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_usage_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TextUsage.ProtoReflect.Descriptor instead.
+func (*TextUsage) Descriptor() ([]byte, []int) {
+	return file_pb_usage_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *TextUsage) GetInputTokens() int64 {
+	if x != nil {
+		return x.InputTokens
+	}
+	return 0
+}
+
+func (x *TextUsage) GetOutputTokens() int64 {
+	if x != nil {
+		return x.OutputTokens
+	}
+	return 0
+}
+
+func (x *TextUsage) GetCacheTokens() int64 {
+	if x != nil {
+		return x.CacheTokens
+	}
+	return 0
+}
+
+func (x *TextUsage) GetReasoningTokens() int32 {
+	if x != nil {
+		return x.ReasoningTokens
+	}
+	return 0
+}
+
+func (x *TextUsage) GetTokensPerSec() int32 {
+	if x != nil {
+		return x.TokensPerSec
+	}
+	return 0
+}
+
+func (x *TextUsage) GetLatency() float64 {
+	if x != nil {
+		return x.Latency
+	}
+	return 0
+}
+
+type ImageUsage struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Quality       string                 `protobuf:"bytes,1,opt,name=quality,proto3" json:"quality,omitempty"`
+	Size          string                 `protobuf:"bytes,2,opt,name=size,proto3" json:"size,omitempty"`
+	Count         int32                  `protobuf:"varint,3,opt,name=count,proto3" json:"count,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ImageUsage) Reset() {
+	*x = ImageUsage{}
+	mi := &file_pb_usage_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ImageUsage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ImageUsage) ProtoMessage() {}
+
+func (x *ImageUsage) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_usage_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ImageUsage.ProtoReflect.Descriptor instead.
+func (*ImageUsage) Descriptor() ([]byte, []int) {
+	return file_pb_usage_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ImageUsage) GetQuality() string {
+	if x != nil {
+		return x.Quality
+	}
+	return ""
+}
+
+func (x *ImageUsage) GetSize() string {
+	if x != nil {
+		return x.Size
+	}
+	return ""
+}
+
+func (x *ImageUsage) GetCount() int32 {
+	if x != nil {
+		return x.Count
+	}
+	return 0
+}
+
+type VideoUsage struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Seconds       float64                `protobuf:"fixed64,1,opt,name=seconds,proto3" json:"seconds,omitempty"`
+	Size          string                 `protobuf:"bytes,2,opt,name=size,proto3" json:"size,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *VideoUsage) Reset() {
+	*x = VideoUsage{}
+	mi := &file_pb_usage_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *VideoUsage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*VideoUsage) ProtoMessage() {}
+
+func (x *VideoUsage) ProtoReflect() protoreflect.Message {
+	mi := &file_pb_usage_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use VideoUsage.ProtoReflect.Descriptor instead.
+func (*VideoUsage) Descriptor() ([]byte, []int) {
+	return file_pb_usage_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *VideoUsage) GetSeconds() float64 {
+	if x != nil {
+		return x.Seconds
+	}
+	return 0
+}
+
+func (x *VideoUsage) GetSize() string {
+	if x != nil {
+		return x.Size
+	}
+	return ""
+}
+
+var File_pb_usage_proto protoreflect.FileDescriptor
+
+const file_pb_usage_proto_rawDesc = "" +
+	"\n" +
+	"\x0epb/usage.proto\x12\x03fee\"3\n" +
+	"\tLLMReport\x12&\n" +
+	"\x05calls\x18\x01 \x03(\v2\x10.fee.LLMCallDataR\x05calls\"\xd8\x04\n" +
+	"\vLLMCallData\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x17\n" +
+	"\anode_id\x18\x02 \x01(\tR\x06nodeId\x12\x14\n" +
+	"\x05model\x18\x03 \x01(\tR\x05model\x12\x19\n" +
+	"\bmodel_id\x18\x04 \x01(\tR\amodelId\x12!\n" +
+	"\factual_model\x18\x05 \x01(\tR\vactualModel\x12\x1a\n" +
+	"\bprovider\x18\x06 \x01(\tR\bprovider\x12'\n" +
+	"\x0factual_provider\x18\a \x01(\tR\x0eactualProvider\x12,\n" +
+	"\x12actual_provider_id\x18\b \x01(\tR\x10actualProviderId\x12\x16\n" +
+	"\x06caller\x18\t \x01(\tR\x06caller\x12\x1d\n" +
+	"\n" +
+	"caller_key\x18\n" +
+	" \x01(\tR\tcallerKey\x12%\n" +
+	"\x0eclient_version\x18\v \x01(\tR\rclientVersion\x12#\n" +
+	"\ragent_version\x18\f \x01(\tR\fagentVersion\x12\x16\n" +
+	"\x06stream\x18\r \x01(\bR\x06stream\x12\x1f\n" +
+	"\vreport_type\x18\x0e \x01(\tR\n" +
+	"reportType\x12\x1c\n" +
+	"\ttimestamp\x18\x0f \x01(\x03R\ttimestamp\x12$\n" +
+	"\x04text\x18\x10 \x01(\v2\x0e.fee.TextUsageH\x00R\x04text\x12'\n" +
+	"\x05image\x18\x11 \x01(\v2\x0f.fee.ImageUsageH\x00R\x05image\x12'\n" +
+	"\x05video\x18\x12 \x01(\v2\x0f.fee.VideoUsageH\x00R\x05videoB\a\n" +
+	"\x05usage\"\xe1\x01\n" +
+	"\tTextUsage\x12!\n" +
+	"\finput_tokens\x18\x01 \x01(\x03R\vinputTokens\x12#\n" +
+	"\routput_tokens\x18\x02 \x01(\x03R\foutputTokens\x12!\n" +
+	"\fcache_tokens\x18\x03 \x01(\x03R\vcacheTokens\x12)\n" +
+	"\x10reasoning_tokens\x18\x04 \x01(\x05R\x0freasoningTokens\x12$\n" +
+	"\x0etokens_per_sec\x18\x05 \x01(\x05R\ftokensPerSec\x12\x18\n" +
+	"\alatency\x18\x06 \x01(\x01R\alatency\"P\n" +
+	"\n" +
+	"ImageUsage\x12\x18\n" +
+	"\aquality\x18\x01 \x01(\tR\aquality\x12\x12\n" +
+	"\x04size\x18\x02 \x01(\tR\x04size\x12\x14\n" +
+	"\x05count\x18\x03 \x01(\x05R\x05count\":\n" +
+	"\n" +
+	"VideoUsage\x12\x18\n" +
+	"\aseconds\x18\x01 \x01(\x01R\aseconds\x12\x12\n" +
+	"\x04size\x18\x02 \x01(\tR\x04sizeB$Z\"github.com/deepissue/fee_server/pbb\x06proto3"
+
+var (
+	file_pb_usage_proto_rawDescOnce sync.Once
+	file_pb_usage_proto_rawDescData []byte
+)
+
+func file_pb_usage_proto_rawDescGZIP() []byte {
+	file_pb_usage_proto_rawDescOnce.Do(func() {
+		file_pb_usage_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_pb_usage_proto_rawDesc), len(file_pb_usage_proto_rawDesc)))
+	})
+	return file_pb_usage_proto_rawDescData
+}
+
+var file_pb_usage_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_pb_usage_proto_goTypes = []any{
+	(*LLMReport)(nil),   // 0: fee.LLMReport
+	(*LLMCallData)(nil), // 1: fee.LLMCallData
+	(*TextUsage)(nil),   // 2: fee.TextUsage
+	(*ImageUsage)(nil),  // 3: fee.ImageUsage
+	(*VideoUsage)(nil),  // 4: fee.VideoUsage
+}
+var file_pb_usage_proto_depIdxs = []int32{
+	1, // 0: fee.LLMReport.calls:type_name -> fee.LLMCallData
+	2, // 1: fee.LLMCallData.text:type_name -> fee.TextUsage
+	3, // 2: fee.LLMCallData.image:type_name -> fee.ImageUsage
+	4, // 3: fee.LLMCallData.video:type_name -> fee.VideoUsage
+	4, // [4:4] is the sub-list for method output_type
+	4, // [4:4] is the sub-list for method input_type
+	4, // [4:4] is the sub-list for extension type_name
+	4, // [4:4] is the sub-list for extension extendee
+	0, // [0:4] is the sub-list for field type_name
+}
+
+func init() { file_pb_usage_proto_init() }
+func file_pb_usage_proto_init() {
+	if File_pb_usage_proto != nil {
+		return
+	}
+	file_pb_usage_proto_msgTypes[1].OneofWrappers = []any{
+		(*LLMCallData_Text)(nil),
+		(*LLMCallData_Image)(nil),
+		(*LLMCallData_Video)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_pb_usage_proto_rawDesc), len(file_pb_usage_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   5,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_pb_usage_proto_goTypes,
+		DependencyIndexes: file_pb_usage_proto_depIdxs,
+		MessageInfos:      file_pb_usage_proto_msgTypes,
+	}.Build()
+	File_pb_usage_proto = out.File
+	file_pb_usage_proto_goTypes = nil
+	file_pb_usage_proto_depIdxs = nil
+}
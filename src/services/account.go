@@ -0,0 +1,342 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/deepissue/fee_server/config"
+	"github.com/deepissue/fee_server/models"
+	"github.com/sirupsen/logrus"
+	"xorm.io/xorm"
+)
+
+// Account 一次调用的计费账户
+type Account struct {
+	UserId   int64
+	WalletId int64  // 扣费钱包，0 表示用户默认钱包
+	OrgId    int64  // 扣费钱包为组织钱包时的组织id
+	KeyId    string // 调用使用的 API key，未携带时为空
+}
+
+// AccountService 将调用方解析为计费账户，并维护 API key 的消费限额
+type AccountService struct {
+	xorm       xorm.EngineInterface
+	partition  *ConsumePartition
+	strictKeys bool // caller_key 不在 api_key 中时拒绝，不按 caller 扣费
+}
+
+func NewAccountService(xorm xorm.EngineInterface, partition *ConsumePartition, c *config.ReportConfig) *AccountService {
+	return &AccountService{xorm: xorm, partition: partition, strictKeys: c != nil && c.StrictCallerKey}
+}
+
+// Resolve 按 caller_key 解析账户，未携带 caller_key 时 caller 即用户id
+// 同时携带时 caller 必须是 key 的所属用户，避免记错账户；caller_key 未登记时见 unknownKey
+func (m *AccountService) Resolve(call *LLMCallData) (Account, error) {
+	if call.CallerKey == "" {
+		return Account{UserId: call.UserId()}, nil
+	}
+	var key models.ApiKey
+	has, err := m.xorm.Where("key_id = ?", call.CallerKey).Get(&key)
+	if err != nil {
+		logrus.Errorf("fetch api key %s: %v", call.CallerKey, err)
+		return Account{}, err
+	}
+	if !has {
+		return m.unknownKey(call)
+	}
+	if call.Caller != "" && call.UserId() != key.UserId {
+		return Account{}, rejectf(RejectCallerMismatch, call.Id, "caller %s does not own key %q", call.Caller, call.CallerKey)
+	}
+	if key.Status != models.ApiKeyEnabled {
+		// 调用已经发生，仍然扣费，由网关负责拒绝已停用的 key
+		logrus.Warnf("usage reported for %s key %s of user %d", key.Status, key.KeyId, key.UserId)
+	}
+	return Account{UserId: key.UserId, WalletId: key.WalletId, OrgId: key.OrgId, KeyId: key.KeyId}, nil
+}
+
+// unknownKey caller_key 不在 api_key 中时的账户
+// 网关先于 key 导入上报 caller_key，默认在 caller 是合法用户id 时按 caller 扣用户默认钱包，不累计 key 的消费；
+// 开启 report.strict_caller_key 或 caller 为空时拒绝
+func (m *AccountService) unknownKey(call *LLMCallData) (Account, error) {
+	if !m.strictKeys {
+		if userId, err := call.ParseUserId(); err == nil {
+			metricUnknownCallerKey.Inc()
+			logrus.Debugf("caller key %q not found, billing user %d", call.CallerKey, userId)
+			return Account{UserId: userId}, nil
+		}
+	}
+	return Account{}, rejectf(RejectUnknownCallerKey, call.Id, "caller key %q not found", call.CallerKey)
+}
+
+// AddSpend 在扣费事务中累加 key 的当日、当月消费，组织钱包扣费时同时累加成员的消费，跨日、跨月时重新计数
+// 用量是事后上报的，超过限额时照常扣费并记录，由网关通过 Quota 拒绝后续调用；超限计数记入 metrics，提交后计数
+func (m *AccountService) AddSpend(session *xorm.Session, account Account, amount Money, at time.Time, metrics *txMetrics) error {
+	if account.KeyId == "" {
+		return nil
+	}
+	var key models.ApiKey
+	has, err := session.ForUpdate().Where("key_id = ?", account.KeyId).Get(&key)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return fmt.Errorf("api key not found: %s", account.KeyId)
+	}
+	addSpend(&key.SpendCounter, amount, at)
+	key.LastUsedAt = at.Unix()
+	key.UpdatedAt = at.Unix()
+	if _, err := session.ID(key.ID).Cols(spendColumns("last_used_at", "updated_at")...).Update(&key); err != nil {
+		logrus.Errorf("update api key %s spend: %v", key.KeyId, err)
+		return err
+	}
+	if exceeded := limitExceeded(&key.SpendCounter); exceeded != "" {
+		metrics.keyLimit = append(metrics.keyLimit, exceeded)
+		logrus.Warnf("api key %s of user %d exceeded its %s limit: day %d/%d, month %d/%d",
+			key.KeyId, key.UserId, exceeded, key.DaySpent, key.DailyLimit, key.MonthSpent, key.MonthlyLimit)
+	}
+
+	if account.OrgId == 0 {
+		return nil
+	}
+	var member models.OrgMember
+	has, err = session.ForUpdate().Where("org_id = ? AND user_id = ?", account.OrgId, account.UserId).Get(&member)
+	if err != nil {
+		return err
+	}
+	if !has {
+		// 成员已被移除但 key 仍在使用，照常扣费，由网关拒绝
+		logrus.Warnf("user %d billed to org %d without membership, key %s", account.UserId, account.OrgId, account.KeyId)
+		return nil
+	}
+	addSpend(&member.SpendCounter, amount, at)
+	member.UpdatedAt = at.Unix()
+	if _, err := session.ID(member.ID).Cols(spendColumns("updated_at")...).Update(&member); err != nil {
+		logrus.Errorf("update org %d member %d spend: %v", member.OrgId, member.UserId, err)
+		return err
+	}
+	if exceeded := limitExceeded(&member.SpendCounter); exceeded != "" {
+		metrics.memberLimit = append(metrics.memberLimit, exceeded)
+		logrus.Warnf("member %d of org %d exceeded its %s limit: day %d/%d, month %d/%d",
+			member.UserId, member.OrgId, exceeded, member.DaySpent, member.DailyLimit, member.MonthSpent, member.MonthlyLimit)
+	}
+	return nil
+}
+
+// spendColumns 累加消费时更新的列
+func spendColumns(extra ...string) []string {
+	return append([]string{"day_spent", "day_start", "month_spent", "month_start"}, extra...)
+}
+
+func addSpend(counter *models.SpendCounter, amount Money, at time.Time) {
+	resetSpendPeriods(counter, at)
+	counter.DaySpent += amount.Micro()
+	counter.MonthSpent += amount.Micro()
+}
+
+// resetSpendPeriods 当前时间已进入新的一天或一个月时清零对应的消费
+func resetSpendPeriods(counter *models.SpendCounter, at time.Time) {
+	day := time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, at.Location()).Unix()
+	month := time.Date(at.Year(), at.Month(), 1, 0, 0, 0, 0, at.Location()).Unix()
+	if counter.DayStart != day {
+		counter.DayStart, counter.DaySpent = day, 0
+	}
+	if counter.MonthStart != month {
+		counter.MonthStart, counter.MonthSpent = month, 0
+	}
+}
+
+// limitExceeded 返回已超过的限额周期（daily/monthly），未超过时为空
+func limitExceeded(counter *models.SpendCounter) string {
+	switch {
+	case counter.DailyLimit > 0 && counter.DaySpent >= counter.DailyLimit:
+		return "daily"
+	case counter.MonthlyLimit > 0 && counter.MonthSpent >= counter.MonthlyLimit:
+		return "monthly"
+	}
+	return ""
+}
+
+// SaveKey 按 key_id 创建或修改 API key，已累计的消费保持不变
+func (m *AccountService) SaveKey(args *ApiKeyArgs) (*models.ApiKey, error) {
+	if args.Status == "" {
+		args.Status = models.ApiKeyEnabled
+	}
+	if args.Status != models.ApiKeyEnabled && args.Status != models.ApiKeyDisabled {
+		return nil, fmt.Errorf("invalid status: %s", args.Status)
+	}
+	if args.DailyLimit < 0 || args.MonthlyLimit < 0 {
+		return nil, fmt.Errorf("limits must not be negative")
+	}
+	orgId, err := m.walletOrg(args.WalletId, args.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	var key models.ApiKey
+	has, err := m.xorm.Where("key_id = ?", args.KeyId).Get(&key)
+	if err != nil {
+		return nil, err
+	}
+	if has && key.UserId != args.UserId {
+		return nil, fmt.Errorf("key %s belongs to another user", args.KeyId)
+	}
+	key.KeyId = args.KeyId
+	key.UserId = args.UserId
+	key.WalletId = args.WalletId
+	key.OrgId = orgId
+	key.Name = args.Name
+	key.Status = args.Status
+	key.DailyLimit = args.DailyLimit
+	key.MonthlyLimit = args.MonthlyLimit
+	key.UpdatedAt = now
+	if has {
+		_, err = m.xorm.ID(key.ID).Cols("wallet_id", "org_id", "name", "status", "daily_limit", "monthly_limit", "updated_at").Update(&key)
+	} else {
+		key.CreatedAt = now
+		_, err = m.xorm.InsertOne(&key)
+	}
+	if err != nil {
+		logrus.Errorf("save api key %s: %v", args.KeyId, err)
+		return nil, err
+	}
+	return &key, nil
+}
+
+// walletOrg 校验 key 指定的钱包可以由用户使用：个人钱包必须属于该用户，组织钱包要求用户是组织的有效成员
+// 返回组织钱包的组织id，个人钱包为 0
+func (m *AccountService) walletOrg(walletId, userId int64) (int64, error) {
+	if walletId == 0 {
+		return 0, nil
+	}
+	wallet := models.UserWallet{Id: walletId}
+	if has, err := m.xorm.Get(&wallet); err != nil {
+		return 0, err
+	} else if !has {
+		return 0, fmt.Errorf("wallet not found: %d", walletId)
+	}
+	if wallet.OrgId == 0 {
+		if wallet.UserId != userId {
+			return 0, fmt.Errorf("wallet %d does not belong to user %d", walletId, userId)
+		}
+		return 0, nil
+	}
+	var member models.OrgMember
+	if has, err := m.xorm.Where("org_id = ? AND user_id = ?", wallet.OrgId, userId).Get(&member); err != nil {
+		return 0, err
+	} else if !has || member.Status != models.OrgMemberActive {
+		return 0, fmt.Errorf("user %d is not an active member of org %d", userId, wallet.OrgId)
+	}
+	return wallet.OrgId, nil
+}
+
+// CreateWallet 为用户新增一个指定类型的个人钱包，同一类型可以有多个钱包，链上钱包按地址区分
+func (m *AccountService) CreateWallet(args *WalletArgs) (*models.UserWallet, error) {
+	if !walletTypes[args.WalletType] {
+		return nil, fmt.Errorf("unknown wallet type: %s", args.WalletType)
+	}
+	if args.WalletType == models.WalletTypeOnchain && args.WalletAddress == "" {
+		return nil, fmt.Errorf("wallet_address is required for %s wallets", args.WalletType)
+	}
+	if args.WalletAddress != "" {
+		has, err := m.xorm.Where("user_id = ? AND org_id = 0 AND wallet_type = ? AND wallet_address = ?",
+			args.UserId, args.WalletType, args.WalletAddress).Exist(&models.UserWallet{})
+		if err != nil {
+			return nil, err
+		}
+		if has {
+			return nil, fmt.Errorf("%s wallet %s already exists", args.WalletType, args.WalletAddress)
+		}
+	}
+
+	now := time.Now().Unix()
+	wallet := models.UserWallet{
+		UserId:        args.UserId,
+		WalletType:    args.WalletType,
+		WalletAddress: args.WalletAddress,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if _, err := m.xorm.InsertOne(&wallet); err != nil {
+		logrus.Errorf("insert %s wallet of user %d: %v", args.WalletType, args.UserId, err)
+		return nil, err
+	}
+	return &wallet, nil
+}
+
+// Keys 返回用户的全部 API key
+func (m *AccountService) Keys(userId int64) ([]models.ApiKey, error) {
+	var keys []models.ApiKey
+	if err := m.xorm.Where("user_id = ?", userId).Asc("id").Find(&keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// KeyQuota API key 当前的可用额度，供网关在调用前检查
+type KeyQuota struct {
+	KeyId            string `json:"key_id"`
+	UserId           int64  `json:"user_id"`
+	OrgId            int64  `json:"org_id,omitempty"`
+	Allowed          bool   `json:"allowed"`
+	Reason           string `json:"reason,omitempty"`            // disabled/daily/monthly/member_disabled/member_daily/member_monthly
+	DailyRemaining   *int64 `json:"daily_remaining,omitempty"`   // 微代币，不限额时不返回
+	MonthlyRemaining *int64 `json:"monthly_remaining,omitempty"` // 微代币，不限额时不返回
+}
+
+// Quota 返回 key 当前是否可用及剩余额度，组织钱包的 key 同时受成员限额约束，剩余额度取两者较小值
+func (m *AccountService) Quota(keyId string) (*KeyQuota, error) {
+	var key models.ApiKey
+	has, err := m.xorm.Where("key_id = ?", keyId).Get(&key)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, fmt.Errorf("api key not found: %s", keyId)
+	}
+	now := time.Now()
+	quota := &KeyQuota{KeyId: key.KeyId, UserId: key.UserId, OrgId: key.OrgId, Allowed: true}
+	quota.limit(&key.SpendCounter, now, "")
+	if key.Status != models.ApiKeyEnabled {
+		quota.Allowed, quota.Reason = false, key.Status
+	}
+	if key.OrgId == 0 {
+		return quota, nil
+	}
+
+	var member models.OrgMember
+	has, err = m.xorm.Where("org_id = ? AND user_id = ?", key.OrgId, key.UserId).Get(&member)
+	if err != nil {
+		return nil, err
+	}
+	if !has || member.Status != models.OrgMemberActive {
+		if quota.Allowed {
+			quota.Allowed, quota.Reason = false, "member_disabled"
+		}
+		return quota, nil
+	}
+	quota.limit(&member.SpendCounter, now, "member_")
+	return quota, nil
+}
+
+// limit 按 counter 收紧剩余额度，超过限额时以 prefix+周期 作为拒绝原因
+func (q *KeyQuota) limit(counter *models.SpendCounter, now time.Time, prefix string) {
+	resetSpendPeriods(counter, now)
+	if counter.DailyLimit > 0 {
+		q.DailyRemaining = minRemaining(q.DailyRemaining, counter.DailyLimit-counter.DaySpent)
+	}
+	if counter.MonthlyLimit > 0 {
+		q.MonthlyRemaining = minRemaining(q.MonthlyRemaining, counter.MonthlyLimit-counter.MonthSpent)
+	}
+	if exceeded := limitExceeded(counter); exceeded != "" && q.Allowed {
+		q.Allowed, q.Reason = false, prefix+exceeded
+	}
+}
+
+func minRemaining(current *int64, remaining int64) *int64 {
+	remaining = max(remaining, 0)
+	if current != nil {
+		remaining = min(*current, remaining)
+	}
+	return &remaining
+}
@@ -0,0 +1,42 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/deepissue/fee_server/config"
+)
+
+// caller_key 未登记时默认按 caller 扣费，开启 strict_caller_key 或 caller 为空时拒绝
+func TestUnknownCallerKey(t *testing.T) {
+	lenient := NewAccountService(nil, nil, nil)
+	strict := NewAccountService(nil, nil, &config.ReportConfig{StrictCallerKey: true})
+	cases := []struct {
+		name     string
+		accounts *AccountService
+		caller   string
+		want     int64 // 0 表示拒绝
+	}{
+		{"fallback to caller", lenient, "42", 42},
+		{"no caller", lenient, "", 0},
+		{"caller is not a user id", lenient, "team-7", 0},
+		{"strict", strict, "42", 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			call := &LLMCallData{Id: "call-1", Caller: c.caller, CallerKey: "sk-unknown"}
+			account, err := c.accounts.unknownKey(call)
+			if c.want == 0 {
+				if reason := RejectReasonOf(err); reason != RejectUnknownCallerKey {
+					t.Fatalf("reason = %s, want %s (%v)", reason, RejectUnknownCallerKey, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if want := (Account{UserId: c.want}); account != want {
+				t.Errorf("account = %+v, want %+v", account, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,603 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/deepissue/core/server"
+	"github.com/deepissue/fee_server/models"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// StatementArgs 账单查询参数
+type StatementArgs struct {
+	UserId   int64  `form:"user_id" query:"user_id" binding:"required"`
+	Month    string `form:"month" query:"month" binding:"required"` // YYYY-MM
+	Format   string `form:"format" query:"format"`                  // json(默认)/csv/html
+	Currency string `form:"currency" query:"currency"`              // 展示币种 COIN(默认)/USD/CNY
+}
+
+// BalanceArgs 余额查询参数
+type BalanceArgs struct {
+	UserId   int64  `form:"user_id" query:"user_id" binding:"required"`
+	Currency string `form:"currency" query:"currency"` // 展示币种 COIN(默认)/USD/CNY
+}
+
+// ExchangeRateArgs 新增汇率参数
+type ExchangeRateArgs struct {
+	Currency   string `json:"currency" binding:"required"`
+	MicroCoins int64  `json:"micro_coins" binding:"required"` // 1 单位法币对应的微代币
+	ValidFrom  int64  `json:"valid_from"`                     // 生效时间，默认立即生效
+}
+
+// ExchangeRatesArgs 汇率历史查询参数
+type ExchangeRatesArgs struct {
+	Currency string `form:"currency" query:"currency" binding:"required"`
+}
+
+// ApiKeyArgs 创建或修改 API key
+type ApiKeyArgs struct {
+	KeyId        string `json:"key_id" binding:"required"`
+	UserId       int64  `json:"user_id" binding:"required"`
+	WalletId     int64  `json:"wallet_id"`
+	Name         string `json:"name"`
+	Status       string `json:"status"` // enabled(默认)/disabled
+	DailyLimit   int64  `json:"daily_limit"`
+	MonthlyLimit int64  `json:"monthly_limit"`
+}
+
+// WalletArgs 新增钱包参数
+type WalletArgs struct {
+	UserId        int64  `json:"user_id" binding:"required"`
+	WalletType    string `json:"wallet_type" binding:"required"` // credit/promo/onchain
+	WalletAddress string `json:"wallet_address"`                 // 链上钱包必填
+}
+
+// ApiKeysArgs 用户 API key 查询参数
+type ApiKeysArgs struct {
+	UserId int64 `form:"user_id" query:"user_id" binding:"required"`
+}
+
+// KeyQuotaArgs API key 额度查询参数
+type KeyQuotaArgs struct {
+	KeyId string `form:"key_id" query:"key_id" binding:"required"`
+}
+
+// BudgetArgs 创建或修改预算，id 为 0 时创建
+type BudgetArgs struct {
+	Id          int64  `json:"id"`
+	UserId      int64  `json:"user_id" binding:"required"`
+	KeyId       string `json:"key_id"`                          // 为空表示全部 key
+	ModelId     string `json:"model_id"`                        // 为空表示全部模型，图片/视频按 model 匹配
+	Window      string `json:"window" binding:"required"`       // daily/monthly
+	LimitAmount int64  `json:"limit_amount" binding:"required"` // 微代币
+	Action      string `json:"action"`                          // flag(默认)/reject
+	Status      string `json:"status"`                          // enabled(默认)/disabled
+}
+
+// BudgetsArgs 用户预算查询参数
+type BudgetsArgs struct {
+	UserId int64 `form:"user_id" query:"user_id" binding:"required"`
+}
+
+// BudgetCheckArgs 调用前预算检查参数
+type BudgetCheckArgs struct {
+	UserId  int64  `form:"user_id" query:"user_id" binding:"required"`
+	KeyId   string `form:"key_id" query:"key_id"`
+	ModelId string `form:"model_id" query:"model_id"`
+}
+
+// OrgArgs 创建组织参数
+type OrgArgs struct {
+	Name        string `json:"name" binding:"required"`
+	AdminUserId int64  `json:"admin_user_id" binding:"required"` // 组织管理员
+}
+
+// OrgMemberArgs 添加或修改组织成员
+type OrgMemberArgs struct {
+	OrgId        int64  `json:"org_id" binding:"required"`
+	UserId       int64  `json:"user_id" binding:"required"`
+	Role         string `json:"role"`   // admin/member(默认)
+	Status       string `json:"status"` // active(默认)/disabled
+	DailyLimit   int64  `json:"daily_limit"`
+	MonthlyLimit int64  `json:"monthly_limit"`
+}
+
+// OrgMembersArgs 组织成员查询参数
+type OrgMembersArgs struct {
+	OrgId int64 `form:"org_id" query:"org_id" binding:"required"`
+}
+
+// OrgSpendArgs 组织成员消费查询参数
+type OrgSpendArgs struct {
+	OrgId int64  `form:"org_id" query:"org_id" binding:"required"`
+	Month string `form:"month" query:"month" binding:"required"` // YYYY-MM
+}
+
+// MarginArgs 毛利汇总查询参数
+type MarginArgs struct {
+	Month string `form:"month" query:"month" binding:"required"` // YYYY-MM
+	By    string `form:"by" query:"by"`                          // model_id(默认)/actual_provider_id/node_id
+}
+
+// BelowCostArgs 低于成本计费记录查询参数
+type BelowCostArgs struct {
+	Month string `form:"month" query:"month" binding:"required"` // YYYY-MM
+	Limit int    `form:"limit" query:"limit"`                    // 默认 100，最多 1000
+}
+
+// RegisterHandlers 注册计费服务的 HTTP 接口
+func (m *FeeService) RegisterHandlers(h server.APIHandler) {
+	h.Get("healthz", &server.Handler{
+		Name:  "Liveness",
+		Tags:  []string{"monitoring"},
+		Func:  m.getHealthz,
+		Reply: HealthReport{},
+	})
+	h.Get("readyz", &server.Handler{
+		Name:  "Readiness",
+		Tags:  []string{"monitoring"},
+		Func:  m.getReadyz,
+		Reply: HealthReport{},
+	})
+	h.Get("metrics", &server.Handler{
+		Name: "Prometheus metrics",
+		Tags: []string{"monitoring"},
+		Func: m.getMetrics,
+	})
+	h.Internal(http.MethodGet, "statements", &server.Handler{
+		Name:  "User monthly statement",
+		Tags:  []string{"statement"},
+		Func:  m.getStatement,
+		Args:  StatementArgs{},
+		Reply: Statement{},
+	})
+	h.Internal(http.MethodGet, "balance", &server.Handler{
+		Name:  "User balance",
+		Tags:  []string{"currency"},
+		Func:  m.getBalance,
+		Args:  BalanceArgs{},
+		Reply: BalanceView{},
+	})
+	h.Internal(http.MethodGet, "exchange_rates", &server.Handler{
+		Name:  "Exchange rate history",
+		Tags:  []string{"currency"},
+		Func:  m.getExchangeRates,
+		Args:  ExchangeRatesArgs{},
+		Reply: []models.ExchangeRate{},
+	})
+	h.Internal(http.MethodPost, "exchange_rates", &server.Handler{
+		Name:  "Add exchange rate",
+		Tags:  []string{"currency"},
+		Func:  m.addExchangeRate,
+		Args:  ExchangeRateArgs{},
+		Reply: models.ExchangeRate{},
+	})
+	h.Internal(http.MethodGet, "pricing", &server.Handler{
+		Name:  "Live image and video price sheets",
+		Tags:  []string{"pricing"},
+		Func:  m.getPricing,
+		Reply: map[string]PriceSheetInfo{},
+	})
+	h.Internal(http.MethodPost, "pricing/reload", &server.Handler{
+		Name:  "Reload image and video price sheets",
+		Tags:  []string{"pricing"},
+		Func:  m.reloadPricing,
+		Reply: map[string]PriceSheetInfo{},
+	})
+	h.Internal(http.MethodPost, "wallets", &server.Handler{
+		Name:  "Add user wallet",
+		Tags:  []string{"account"},
+		Func:  m.createWallet,
+		Args:  WalletArgs{},
+		Reply: models.UserWallet{},
+	})
+	h.Internal(http.MethodGet, "api_keys", &server.Handler{
+		Name:  "User API keys",
+		Tags:  []string{"account"},
+		Func:  m.getApiKeys,
+		Args:  ApiKeysArgs{},
+		Reply: []models.ApiKey{},
+	})
+	h.Internal(http.MethodPost, "api_keys", &server.Handler{
+		Name:  "Create or update API key",
+		Tags:  []string{"account"},
+		Func:  m.saveApiKey,
+		Args:  ApiKeyArgs{},
+		Reply: models.ApiKey{},
+	})
+	h.Internal(http.MethodGet, "api_keys/quota", &server.Handler{
+		Name:  "API key remaining quota",
+		Tags:  []string{"account"},
+		Func:  m.getKeyQuota,
+		Args:  KeyQuotaArgs{},
+		Reply: KeyQuota{},
+	})
+	h.Internal(http.MethodGet, "budgets", &server.Handler{
+		Name:  "User budgets",
+		Tags:  []string{"budget"},
+		Func:  m.getBudgets,
+		Args:  BudgetsArgs{},
+		Reply: []models.Budget{},
+	})
+	h.Internal(http.MethodPost, "budgets", &server.Handler{
+		Name:  "Create or update budget",
+		Tags:  []string{"budget"},
+		Func:  m.saveBudget,
+		Args:  BudgetArgs{},
+		Reply: models.Budget{},
+	})
+	h.Internal(http.MethodGet, "budgets/check", &server.Handler{
+		Name:  "Exhausted budgets for a call",
+		Tags:  []string{"budget"},
+		Func:  m.checkBudgets,
+		Args:  BudgetCheckArgs{},
+		Reply: BudgetCheck{},
+	})
+	h.Internal(http.MethodPost, "orgs", &server.Handler{
+		Name:  "Create organisation and its wallet",
+		Tags:  []string{"account"},
+		Func:  m.createOrg,
+		Args:  OrgArgs{},
+		Reply: models.Organization{},
+	})
+	h.Internal(http.MethodGet, "orgs/members", &server.Handler{
+		Name:  "Organisation members",
+		Tags:  []string{"account"},
+		Func:  m.getOrgMembers,
+		Args:  OrgMembersArgs{},
+		Reply: []models.OrgMember{},
+	})
+	h.Internal(http.MethodPost, "orgs/members", &server.Handler{
+		Name:  "Add or update organisation member",
+		Tags:  []string{"account"},
+		Func:  m.saveOrgMember,
+		Args:  OrgMemberArgs{},
+		Reply: models.OrgMember{},
+	})
+	h.Internal(http.MethodGet, "orgs/spend", &server.Handler{
+		Name:  "Organisation wallet spend by member",
+		Tags:  []string{"account"},
+		Func:  m.getOrgSpend,
+		Args:  OrgSpendArgs{},
+		Reply: []MemberSpend{},
+	})
+	h.Internal(http.MethodGet, "margins", &server.Handler{
+		Name:  "Gross margin by model, provider or node",
+		Tags:  []string{"margin"},
+		Func:  m.getMargins,
+		Args:  MarginArgs{},
+		Reply: []MarginSummary{},
+	})
+	h.Internal(http.MethodGet, "margins/below_cost", &server.Handler{
+		Name:  "Consume records billed below provider cost",
+		Tags:  []string{"margin"},
+		Func:  m.getBelowCost,
+		Args:  BelowCostArgs{},
+		Reply: []models.UserConsumeRecord{},
+	})
+}
+
+func (m *FeeService) getPricing(ctx *server.Context) error {
+	ctx.WriteData(m.pricing.Info())
+	return nil
+}
+
+func (m *FeeService) reloadPricing(ctx *server.Context) error {
+	if err := m.pricing.Reload(); err != nil {
+		ctx.WriteFail(500, err.Error())
+		return nil
+	}
+	ctx.WriteData(m.pricing.Info())
+	return nil
+}
+
+func (m *FeeService) getStatement(ctx *server.Context) error {
+	var args StatementArgs
+	if err := ctx.ShouldBindQuery(&args); err != nil {
+		return err
+	}
+	statement, has, err := m.statement.Find(args.UserId, args.Month)
+	if err != nil {
+		return err
+	}
+	if !has {
+		ctx.WriteFail(404, fmt.Sprintf("statement not found: %d, %s", args.UserId, args.Month))
+		return nil
+	}
+
+	if args.Currency != "" {
+		if err := m.currency.LocalizeStatement(statement, args.Currency); err != nil {
+			ctx.WriteFail(400, err.Error())
+			return nil
+		}
+	}
+
+	switch args.Format {
+	case "csv":
+		ctx.Context.Header("Content-Type", "text/csv; charset=utf-8")
+		ctx.Context.Header("Content-Disposition", fmt.Sprintf("attachment; filename=statement_%d_%s.csv", args.UserId, args.Month))
+		return statement.WriteCSV(ctx.Writer)
+	case "html":
+		ctx.Context.Header("Content-Type", "text/html; charset=utf-8")
+		return statement.WriteHTML(ctx.Writer)
+	default:
+		ctx.WriteData(statement)
+	}
+	return nil
+}
+
+func (m *FeeService) getBalance(ctx *server.Context) error {
+	var args BalanceArgs
+	if err := ctx.ShouldBindQuery(&args); err != nil {
+		return err
+	}
+	view, err := m.currency.Balance(args.UserId, args.Currency)
+	if err != nil {
+		ctx.WriteFail(400, err.Error())
+		return nil
+	}
+	ctx.WriteData(view)
+	return nil
+}
+
+func (m *FeeService) getExchangeRates(ctx *server.Context) error {
+	var args ExchangeRatesArgs
+	if err := ctx.ShouldBindQuery(&args); err != nil {
+		return err
+	}
+	rates, err := m.currency.Rates(args.Currency)
+	if err != nil {
+		ctx.WriteFail(400, err.Error())
+		return nil
+	}
+	ctx.WriteData(rates)
+	return nil
+}
+
+func (m *FeeService) addExchangeRate(ctx *server.Context) error {
+	var args ExchangeRateArgs
+	if err := ctx.ShouldBindJSON(&args); err != nil {
+		return err
+	}
+	validFrom := time.Now()
+	if args.ValidFrom > 0 {
+		validFrom = time.Unix(args.ValidFrom, 0)
+	}
+	rate, err := m.currency.SetRate(args.Currency, args.MicroCoins, validFrom)
+	if err != nil {
+		ctx.WriteFail(400, err.Error())
+		return nil
+	}
+	ctx.WriteData(rate)
+	return nil
+}
+
+func (m *FeeService) createWallet(ctx *server.Context) error {
+	var args WalletArgs
+	if err := ctx.ShouldBindJSON(&args); err != nil {
+		return err
+	}
+	wallet, err := m.accounts.CreateWallet(&args)
+	if err != nil {
+		ctx.WriteFail(400, err.Error())
+		return nil
+	}
+	ctx.WriteData(wallet)
+	return nil
+}
+
+func (m *FeeService) getApiKeys(ctx *server.Context) error {
+	var args ApiKeysArgs
+	if err := ctx.ShouldBindQuery(&args); err != nil {
+		return err
+	}
+	keys, err := m.accounts.Keys(args.UserId)
+	if err != nil {
+		return err
+	}
+	ctx.WriteData(keys)
+	return nil
+}
+
+func (m *FeeService) saveApiKey(ctx *server.Context) error {
+	var args ApiKeyArgs
+	if err := ctx.ShouldBindJSON(&args); err != nil {
+		return err
+	}
+	key, err := m.accounts.SaveKey(&args)
+	if err != nil {
+		ctx.WriteFail(400, err.Error())
+		return nil
+	}
+	ctx.WriteData(key)
+	return nil
+}
+
+func (m *FeeService) getKeyQuota(ctx *server.Context) error {
+	var args KeyQuotaArgs
+	if err := ctx.ShouldBindQuery(&args); err != nil {
+		return err
+	}
+	quota, err := m.accounts.Quota(args.KeyId)
+	if err != nil {
+		ctx.WriteFail(404, err.Error())
+		return nil
+	}
+	ctx.WriteData(quota)
+	return nil
+}
+
+func (m *FeeService) getBudgets(ctx *server.Context) error {
+	var args BudgetsArgs
+	if err := ctx.ShouldBindQuery(&args); err != nil {
+		return err
+	}
+	budgets, err := m.budgets.List(args.UserId)
+	if err != nil {
+		return err
+	}
+	ctx.WriteData(budgets)
+	return nil
+}
+
+func (m *FeeService) saveBudget(ctx *server.Context) error {
+	var args BudgetArgs
+	if err := ctx.ShouldBindJSON(&args); err != nil {
+		return err
+	}
+	budget, err := m.budgets.Save(&args)
+	if err != nil {
+		ctx.WriteFail(400, err.Error())
+		return nil
+	}
+	ctx.WriteData(budget)
+	return nil
+}
+
+func (m *FeeService) checkBudgets(ctx *server.Context) error {
+	var args BudgetCheckArgs
+	if err := ctx.ShouldBindQuery(&args); err != nil {
+		return err
+	}
+	check, err := m.budgets.Check(args.UserId, args.KeyId, args.ModelId)
+	if err != nil {
+		return err
+	}
+	ctx.WriteData(check)
+	return nil
+}
+
+func (m *FeeService) createOrg(ctx *server.Context) error {
+	var args OrgArgs
+	if err := ctx.ShouldBindJSON(&args); err != nil {
+		return err
+	}
+	org, err := m.accounts.CreateOrg(&args)
+	if err != nil {
+		return err
+	}
+	ctx.WriteData(org)
+	return nil
+}
+
+func (m *FeeService) getOrgMembers(ctx *server.Context) error {
+	var args OrgMembersArgs
+	if err := ctx.ShouldBindQuery(&args); err != nil {
+		return err
+	}
+	members, err := m.accounts.Members(args.OrgId)
+	if err != nil {
+		return err
+	}
+	ctx.WriteData(members)
+	return nil
+}
+
+func (m *FeeService) saveOrgMember(ctx *server.Context) error {
+	var args OrgMemberArgs
+	if err := ctx.ShouldBindJSON(&args); err != nil {
+		return err
+	}
+	member, err := m.accounts.SaveMember(&args)
+	if err != nil {
+		ctx.WriteFail(400, err.Error())
+		return nil
+	}
+	ctx.WriteData(member)
+	return nil
+}
+
+func (m *FeeService) getOrgSpend(ctx *server.Context) error {
+	var args OrgSpendArgs
+	if err := ctx.ShouldBindQuery(&args); err != nil {
+		return err
+	}
+	start, end, err := MonthPeriod(args.Month)
+	if err != nil {
+		ctx.WriteFail(400, err.Error())
+		return nil
+	}
+	spends, err := m.accounts.MemberSpends(args.OrgId, start, end)
+	if err != nil {
+		return err
+	}
+	ctx.WriteData(spends)
+	return nil
+}
+
+func (m *FeeService) getMargins(ctx *server.Context) error {
+	var args MarginArgs
+	if err := ctx.ShouldBindQuery(&args); err != nil {
+		return err
+	}
+	start, end, err := MonthPeriod(args.Month)
+	if err != nil {
+		ctx.WriteFail(400, err.Error())
+		return nil
+	}
+	dim := MarginByModel
+	if args.By != "" {
+		dim = MarginDimension(args.By)
+	}
+	if !dim.Valid() {
+		ctx.WriteFail(400, fmt.Sprintf("unsupported margin dimension: %s", dim))
+		return nil
+	}
+	summary, err := m.margin.Summary(dim, start, end)
+	if err != nil {
+		return err
+	}
+	ctx.WriteData(summary)
+	return nil
+}
+
+func (m *FeeService) getBelowCost(ctx *server.Context) error {
+	var args BelowCostArgs
+	if err := ctx.ShouldBindQuery(&args); err != nil {
+		return err
+	}
+	start, end, err := MonthPeriod(args.Month)
+	if err != nil {
+		ctx.WriteFail(400, err.Error())
+		return nil
+	}
+	if args.Limit <= 0 {
+		args.Limit = defaultBelowCostLimit
+	}
+	if args.Limit > maxBelowCostLimit {
+		ctx.WriteFail(400, fmt.Sprintf("limit must not exceed %d", maxBelowCostLimit))
+		return nil
+	}
+	records, err := m.margin.BelowCost(start, end, args.Limit)
+	if err != nil {
+		return err
+	}
+	ctx.WriteData(records)
+	return nil
+}
+
+func (m *FeeService) getMetrics(ctx *server.Context) error {
+	promhttp.Handler().ServeHTTP(ctx.Writer, ctx.Request)
+	return nil
+}
+
+func (m *FeeService) getHealthz(ctx *server.Context) error {
+	writeHealth(ctx, m.health.Live())
+	return nil
+}
+
+func (m *FeeService) getReadyz(ctx *server.Context) error {
+	writeHealth(ctx, m.health.Ready(ctx.Request.Context()))
+	return nil
+}
+
+// writeHealth 探针依赖 HTTP 状态码，不可用时返回 503
+func writeHealth(ctx *server.Context, report HealthReport) {
+	code := http.StatusOK
+	if report.Status != HealthUp {
+		code = http.StatusServiceUnavailable
+	}
+	ctx.Context.AbortWithStatusJSON(code, report)
+}
@@ -0,0 +1,187 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/deepissue/fee_server/models"
+	"github.com/sirupsen/logrus"
+	"xorm.io/xorm"
+)
+
+// BudgetService 用户按日、按月的消费预算，可以限定 API key 或模型
+// 预算在扣费事务中累计；窗口内首次用尽时通过 outbox 发布 budget_exceeded 事件，供网关实时拦截。
+// 用量是事后上报的，超出预算时照常扣费；action 为 reject 时由网关根据事件或 Check 拒绝后续调用，flag 只做提醒
+type BudgetService struct {
+	xorm   xorm.EngineInterface
+	outbox *OutboxRelay
+}
+
+func NewBudgetService(xorm xorm.EngineInterface, outbox *OutboxRelay) *BudgetService {
+	return &BudgetService{xorm: xorm, outbox: outbox}
+}
+
+// budgetModel 预算按模型匹配时使用的标识：文本调用为 model_id，图片/视频为 model
+func budgetModel(call *LLMCallData) string {
+	if call.ModelId != "" {
+		return call.ModelId
+	}
+	return call.Model
+}
+
+// budgetWindow 返回 at 所在预算窗口的开始和结束时间
+func budgetWindow(window string, at time.Time) (time.Time, time.Time) {
+	if window == models.BudgetMonthly {
+		start := time.Date(at.Year(), at.Month(), 1, 0, 0, 0, 0, at.Location())
+		return start, start.AddDate(0, 1, 0)
+	}
+	start := time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, at.Location())
+	return start, start.AddDate(0, 0, 1)
+}
+
+// matching 返回对调用生效的预算
+func matching(session *xorm.Session, userId int64, keyId, modelId string) *xorm.Session {
+	return session.Where("user_id = ? AND status = ? AND (key_id = '' OR key_id = ?) AND (model_id = '' OR model_id = ?)",
+		userId, models.BudgetEnabled, keyId, modelId).Asc("id")
+}
+
+// Apply 在扣费事务中将 record 的扣费计入匹配的预算，不会拒绝扣费；用尽的预算记入 metrics，提交后计数
+func (m *BudgetService) Apply(session *xorm.Session, account Account, call *LLMCallData, record *models.UserConsumeRecord, at time.Time, metrics *txMetrics) error {
+	var budgets []models.Budget
+	if err := matching(session.ForUpdate(), account.UserId, account.KeyId, budgetModel(call)).Find(&budgets); err != nil {
+		return err
+	}
+	for i := range budgets {
+		budget := &budgets[i]
+		start, _ := budgetWindow(budget.Window, at)
+		if budget.WindowStart != start.Unix() {
+			budget.WindowStart, budget.Spent = start.Unix(), 0
+		}
+		budget.Spent += record.TotalConsumed
+		budget.UpdatedAt = at.Unix()
+		exceeded := budget.Spent >= budget.LimitAmount && budget.ExceededWindow != budget.WindowStart
+		if exceeded {
+			budget.ExceededWindow = budget.WindowStart
+		}
+		if _, err := session.ID(budget.ID).Cols("spent", "window_start", "exceeded_window", "updated_at").Update(budget); err != nil {
+			logrus.Errorf("update budget %d: %v", budget.ID, err)
+			return err
+		}
+		if !exceeded {
+			continue
+		}
+		metrics.budget = append(metrics.budget, budget.Action)
+		logrus.Warnf("%s budget %d of user %d exceeded: %d/%d, action: %s",
+			budget.Window, budget.ID, budget.UserId, budget.Spent, budget.LimitAmount, budget.Action)
+		if err := m.outbox.Enqueue(session, NewBudgetExceededEvent(budget, record, at)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Save 创建（id 为 0）或修改预算，修改窗口时重新计数
+func (m *BudgetService) Save(args *BudgetArgs) (*models.Budget, error) {
+	if args.Window != models.BudgetDaily && args.Window != models.BudgetMonthly {
+		return nil, fmt.Errorf("invalid window: %s", args.Window)
+	}
+	if args.LimitAmount <= 0 {
+		return nil, fmt.Errorf("limit_amount must be positive")
+	}
+	if args.Action == "" {
+		args.Action = models.BudgetActionFlag
+	}
+	if args.Action != models.BudgetActionFlag && args.Action != models.BudgetActionReject {
+		return nil, fmt.Errorf("invalid action: %s", args.Action)
+	}
+	if args.Status == "" {
+		args.Status = models.BudgetEnabled
+	}
+	if args.Status != models.BudgetEnabled && args.Status != models.BudgetDisabled {
+		return nil, fmt.Errorf("invalid status: %s", args.Status)
+	}
+	if args.KeyId != "" {
+		var key models.ApiKey
+		if has, err := m.xorm.Where("key_id = ?", args.KeyId).Get(&key); err != nil {
+			return nil, err
+		} else if !has || key.UserId != args.UserId {
+			return nil, fmt.Errorf("key %s does not belong to user %d", args.KeyId, args.UserId)
+		}
+	}
+
+	now := time.Now().Unix()
+	var budget models.Budget
+	if args.Id != 0 {
+		has, err := m.xorm.ID(args.Id).Get(&budget)
+		if err != nil {
+			return nil, err
+		}
+		if !has || budget.UserId != args.UserId {
+			return nil, fmt.Errorf("budget %d not found for user %d", args.Id, args.UserId)
+		}
+	}
+	if budget.Window != args.Window {
+		budget.Spent, budget.WindowStart, budget.ExceededWindow = 0, 0, 0
+	}
+	budget.UserId = args.UserId
+	budget.KeyId = args.KeyId
+	budget.ModelId = args.ModelId
+	budget.Window = args.Window
+	budget.LimitAmount = args.LimitAmount
+	budget.Action = args.Action
+	budget.Status = args.Status
+	budget.UpdatedAt = now
+
+	var err error
+	if budget.ID != 0 {
+		_, err = m.xorm.ID(budget.ID).
+			Cols("key_id", "model_id", "window", "limit_amount", "action", "status", "spent", "window_start", "exceeded_window", "updated_at").
+			Update(&budget)
+	} else {
+		budget.CreatedAt = now
+		_, err = m.xorm.InsertOne(&budget)
+	}
+	if err != nil {
+		logrus.Errorf("save budget of user %d: %v", args.UserId, err)
+		return nil, err
+	}
+	return &budget, nil
+}
+
+// List 返回用户的全部预算
+func (m *BudgetService) List(userId int64) ([]models.Budget, error) {
+	var budgets []models.Budget
+	if err := m.xorm.Where("user_id = ?", userId).Asc("id").Find(&budgets); err != nil {
+		return nil, err
+	}
+	return budgets, nil
+}
+
+// BudgetCheck 调用前的预算检查结果
+type BudgetCheck struct {
+	Allowed  bool            `json:"allowed"`  // 没有已用尽的 reject 预算，为 false 时网关应拒绝调用
+	Exceeded []models.Budget `json:"exceeded"` // 本窗口已用尽的预算
+}
+
+// Check 返回用户使用 keyId 调用 modelId 时已用尽的预算，供网关在调用前检查
+func (m *BudgetService) Check(userId int64, keyId, modelId string) (*BudgetCheck, error) {
+	session := m.xorm.NewSession()
+	defer session.Close()
+	var budgets []models.Budget
+	if err := matching(session, userId, keyId, modelId).Find(&budgets); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	check := &BudgetCheck{Allowed: true, Exceeded: []models.Budget{}}
+	for _, budget := range budgets {
+		start, _ := budgetWindow(budget.Window, now)
+		if budget.WindowStart != start.Unix() || budget.Spent < budget.LimitAmount {
+			continue
+		}
+		check.Exceeded = append(check.Exceeded, budget)
+		if budget.Action == models.BudgetActionReject {
+			check.Allowed = false
+		}
+	}
+	return check, nil
+}
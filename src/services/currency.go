@@ -0,0 +1,216 @@
+package services
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/deepissue/fee_server/models"
+	"github.com/sirupsen/logrus"
+	"xorm.io/xorm"
+)
+
+const (
+	CurrencyCoin = "COIN"
+	CurrencyUSD  = "USD"
+	CurrencyCNY  = "CNY"
+
+	// currencyDecimals 换算后展示的小数位数，与微代币精度一致
+	currencyDecimals = 6
+)
+
+// CurrencyService 管理代币与法币的汇率，负责美元价格到微代币的精确换算以及金额的法币展示
+// 换算全程使用有理数，取整规则见 Money
+type CurrencyService struct {
+	xorm xorm.EngineInterface
+}
+
+func NewCurrencyService(xorm xorm.EngineInterface) *CurrencyService {
+	return &CurrencyService{xorm: xorm}
+}
+
+// NormalizeCurrency 校验并规范化币种代码，空值表示代币
+func NormalizeCurrency(currency string) (string, error) {
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	switch currency {
+	case "":
+		return CurrencyCoin, nil
+	case CurrencyCoin, CurrencyUSD, CurrencyCNY:
+		return currency, nil
+	}
+	return "", fmt.Errorf("unsupported currency: %s", currency)
+}
+
+// RateAt 返回 at 时刻生效的汇率，代币本身的汇率固定为 MICRO
+func (m *CurrencyService) RateAt(currency string, at time.Time) (models.ExchangeRate, error) {
+	currency, err := NormalizeCurrency(currency)
+	if err != nil {
+		return models.ExchangeRate{}, err
+	}
+	if currency == CurrencyCoin {
+		return models.ExchangeRate{Currency: CurrencyCoin, MicroCoins: MICRO}, nil
+	}
+	var rate models.ExchangeRate
+	has, err := m.xorm.Where("currency = ? AND valid_from <= ?", currency, at.Unix()).Desc("valid_from", "id").Get(&rate)
+	if err != nil {
+		logrus.Errorf("fetch exchange rate of %s: %v", currency, err)
+		return rate, err
+	}
+	if !has {
+		return rate, fmt.Errorf("no exchange rate of %s at %s", currency, at.Format(time.DateTime))
+	}
+	return rate, nil
+}
+
+// Rates 返回某个法币的汇率历史，按生效时间倒序
+func (m *CurrencyService) Rates(currency string) ([]models.ExchangeRate, error) {
+	currency, err := NormalizeCurrency(currency)
+	if err != nil {
+		return nil, err
+	}
+	var rates []models.ExchangeRate
+	if err := m.xorm.Where("currency = ?", currency).Desc("valid_from", "id").Find(&rates); err != nil {
+		return nil, err
+	}
+	return rates, nil
+}
+
+// SetRate 新增一条自 validFrom 起生效的汇率，历史汇率保留不变
+func (m *CurrencyService) SetRate(currency string, microCoins int64, validFrom time.Time) (*models.ExchangeRate, error) {
+	currency, err := NormalizeCurrency(currency)
+	if err != nil {
+		return nil, err
+	}
+	if currency == CurrencyCoin {
+		return nil, fmt.Errorf("the rate of %s is fixed", CurrencyCoin)
+	}
+	if microCoins <= 0 {
+		return nil, fmt.Errorf("invalid exchange rate: %d", microCoins)
+	}
+	rate := &models.ExchangeRate{Currency: currency, MicroCoins: microCoins, ValidFrom: validFrom.Unix()}
+	if _, err := m.xorm.InsertOne(rate); err != nil {
+		logrus.Errorf("insert exchange rate: %v", err)
+		return nil, err
+	}
+	logrus.Infof("exchange rate of %s set to %d micro-coins from %s", currency, microCoins, validFrom.Format(time.DateTime))
+	return rate, nil
+}
+
+// USDToMoney 将精确的美元金额按 at 时刻的汇率换算为微代币，只在最后取整一次
+func (m *CurrencyService) USDToMoney(usd *big.Rat, at time.Time) (Money, error) {
+	rate, err := m.RateAt(CurrencyUSD, at)
+	if err != nil {
+		return 0, err
+	}
+	return usdToMoney(usd, rate.MicroCoins)
+}
+
+// usdToMoney 按 1 美元 = microCoins 微代币换算，只在最后取整一次
+func usdToMoney(usd *big.Rat, microCoins int64) (Money, error) {
+	return MoneyFromRat(new(big.Rat).Mul(usd, new(big.Rat).SetInt64(microCoins)))
+}
+
+// ImageCost 计算 at 时刻生成 count 张图片的费用
+func (m *CurrencyService) ImageCost(model ImageModel, quality ImageQuality, size ImageSize, count int, at time.Time) (Money, error) {
+	usd, ok := ImagePricing.CalculateImageCost(model, quality, size, count, at)
+	if !ok {
+		return 0, fmt.Errorf("image price not found: %s, %s, %s", model, quality, size)
+	}
+	return m.USDToMoney(usd, at)
+}
+
+// VideoCost 计算 at 时刻生成 seconds 秒视频的费用
+func (m *CurrencyService) VideoCost(model VideoModel, resolution VideoResolution, seconds float64, at time.Time) (Money, error) {
+	usd, ok := VideoPricing.CalculateVideoCost(model, resolution, seconds, at)
+	if !ok {
+		return 0, fmt.Errorf("video price not found: %s, %s", model, resolution)
+	}
+	return m.USDToMoney(usd, at)
+}
+
+// FormatAmount 将微代币金额按汇率换算为法币并保留 6 位小数
+func FormatAmount(micro int64, rate models.ExchangeRate) string {
+	amount := new(big.Rat).SetFrac(big.NewInt(micro), big.NewInt(rate.MicroCoins))
+	return amount.FloatString(currencyDecimals)
+}
+
+// BalanceView 用户余额，Amount 为按请求币种换算后的金额
+type BalanceView struct {
+	UserId   int64               `json:"user_id"`
+	Balance  int64               `json:"balance"` // 微代币
+	Currency string              `json:"currency"`
+	Rate     int64               `json:"rate"` // 1 单位法币对应的微代币
+	Amount   string              `json:"amount"`
+	Wallets  []models.UserWallet `json:"wallets"`
+}
+
+// Balance 查询用户当前余额并按 currency 当前汇率换算
+func (m *CurrencyService) Balance(userId int64, currency string) (*BalanceView, error) {
+	rate, err := m.RateAt(currency, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	view := &BalanceView{UserId: userId, Currency: rate.Currency, Rate: rate.MicroCoins}
+	if err := m.xorm.Where("user_id = ?", userId).Asc("id").Find(&view.Wallets); err != nil {
+		return nil, err
+	}
+	for _, wallet := range view.Wallets {
+		view.Balance += wallet.Balance
+	}
+	view.Amount = FormatAmount(view.Balance, rate)
+	return view, nil
+}
+
+// StatementDisplay 按法币展示的账单金额，使用账单周期结束时的汇率
+type StatementDisplay struct {
+	Currency       string                 `json:"currency"`
+	Rate           int64                  `json:"rate"`
+	RateValidFrom  int64                  `json:"rate_valid_from"`
+	OpeningBalance string                 `json:"opening_balance"`
+	TopUps         string                 `json:"top_ups"`
+	Consumed       string                 `json:"consumed"`
+	Discounts      string                 `json:"discounts"`
+	ClosingBalance string                 `json:"closing_balance"`
+	Lines          []StatementDisplayLine `json:"lines"`
+}
+
+type StatementDisplayLine struct {
+	ModelId    string `json:"model_id"`
+	ReportType string `json:"report_type"`
+	Amount     string `json:"amount"`
+	Discount   string `json:"discount"`
+}
+
+// LocalizeStatement 为账单附加按 currency 换算的展示金额，账单本身的微代币金额不变
+func (m *CurrencyService) LocalizeStatement(statement *Statement, currency string) error {
+	rate, err := m.RateAt(currency, time.Unix(statement.PeriodEnd-1, 0))
+	if err != nil {
+		return err
+	}
+	statement.Display = statementDisplay(statement, rate)
+	return nil
+}
+
+// statementDisplay 按 rate 换算账单的各项金额，明细与 statement.Lines 一一对应
+func statementDisplay(statement *Statement, rate models.ExchangeRate) *StatementDisplay {
+	display := &StatementDisplay{
+		Currency:       rate.Currency,
+		Rate:           rate.MicroCoins,
+		RateValidFrom:  rate.ValidFrom,
+		OpeningBalance: FormatAmount(statement.OpeningBalance, rate),
+		TopUps:         FormatAmount(statement.TopUps, rate),
+		Consumed:       FormatAmount(statement.Consumed, rate),
+		Discounts:      FormatAmount(statement.Discounts, rate),
+		ClosingBalance: FormatAmount(statement.ClosingBalance, rate),
+	}
+	for _, line := range statement.Lines {
+		display.Lines = append(display.Lines, StatementDisplayLine{
+			ModelId:    line.ModelId,
+			ReportType: line.ReportType,
+			Amount:     FormatAmount(line.Amount, rate),
+			Discount:   FormatAmount(line.Discount, rate),
+		})
+	}
+	return display
+}
@@ -0,0 +1,153 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/deepissue/fee_server/pb"
+	"github.com/ugorji/go/codec"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeMsgpack  = "application/msgpack"
+)
+
+// ReportDecoder 将消息体解码为调用上报
+type ReportDecoder func(data []byte) (LLMReportMessage, error)
+
+// reportDecoders 按 Content-Type 选择解码器，未设置 Content-Type 时按 JSON 解码
+var reportDecoders = map[string]ReportDecoder{
+	"":                      DecodeJSONReport,
+	ContentTypeJSON:         DecodeJSONReport,
+	ContentTypeProtobuf:     DecodeProtobufReport,
+	"application/protobuf":  DecodeProtobufReport,
+	ContentTypeMsgpack:      DecodeMsgpackReport,
+	"application/x-msgpack": DecodeMsgpackReport,
+}
+
+// DecoderFor 返回 Content-Type 对应的解码器，忽略 charset 等参数
+func DecoderFor(contentType string) (ReportDecoder, error) {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	decoder, ok := reportDecoders[mediaType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported content type: %s", contentType)
+	}
+	return decoder, nil
+}
+
+// DecodeJSONReport 解码 JSON 数组格式的上报
+func DecodeJSONReport(data []byte) (LLMReportMessage, error) {
+	var report LLMReportMessage
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// DecodeProtobufReport 解码 pb.LLMReport，用量按 usage 的类型转换为 TokenUsage/ImageUsage/VideoUsage
+// usage 的类型与 report_type 不一致时返回 RejectUsageMismatch
+func DecodeProtobufReport(data []byte) (LLMReportMessage, error) {
+	var message pb.LLMReport
+	if err := proto.Unmarshal(data, &message); err != nil {
+		return nil, err
+	}
+	report := make(LLMReportMessage, 0, len(message.GetCalls()))
+	for _, c := range message.GetCalls() {
+		call := callFromProto(c)
+		if err := checkUsageType(call); err != nil {
+			return nil, err
+		}
+		report = append(report, call)
+	}
+	return report, nil
+}
+
+// checkUsageType 校验 protobuf 上报中 usage 的类型与 report_type 一致，未携带 usage 或 report_type 未知时交给 Validate
+func checkUsageType(call *LLMCallData) error {
+	var want ReportType
+	switch call.TokenUsage.(type) {
+	case nil:
+		return nil
+	case TokenUsage:
+		want = TextReportType
+	case ImageUsage:
+		want = ImageReportType
+	case VideoUsage:
+		want = VideoReportType
+	}
+	switch call.ReportType {
+	case "", TextReportType, ImageReportType, VideoReportType:
+	default:
+		return nil
+	}
+	if got := call.ReportType; got != want && !(got == "" && want == TextReportType) {
+		return rejectf(RejectUsageMismatch, call.Id, "report_type %q carries %s usage", got, want)
+	}
+	return nil
+}
+
+func callFromProto(c *pb.LLMCallData) *LLMCallData {
+	call := &LLMCallData{
+		Id:               c.GetId(),
+		NodeId:           c.GetNodeId(),
+		Model:            c.GetModel(),
+		ModelId:          c.GetModelId(),
+		ActualModel:      c.GetActualModel(),
+		Provider:         c.GetProvider(),
+		ActualProvider:   c.GetActualProvider(),
+		ActualProviderId: c.GetActualProviderId(),
+		Caller:           c.GetCaller(),
+		CallerKey:        c.GetCallerKey(),
+		ClientVersion:    c.GetClientVersion(),
+		AgentVersion:     c.GetAgentVersion(),
+		Stream:           c.GetStream(),
+		ReportType:       ReportType(c.GetReportType()),
+		Timestamp:        c.GetTimestamp(),
+	}
+	switch usage := c.GetUsage().(type) {
+	case *pb.LLMCallData_Text:
+		call.TokenUsage = TokenUsage{
+			InputTokens:     usage.Text.GetInputTokens(),
+			OutputTokens:    usage.Text.GetOutputTokens(),
+			CacheTokens:     usage.Text.GetCacheTokens(),
+			ReasoningTokens: int(usage.Text.GetReasoningTokens()),
+			TokensPerSec:    int(usage.Text.GetTokensPerSec()),
+			Latency:         usage.Text.GetLatency(),
+		}
+	case *pb.LLMCallData_Image:
+		call.TokenUsage = ImageUsage{
+			Quality: usage.Image.GetQuality(),
+			Size:    usage.Image.GetSize(),
+			Count:   int(usage.Image.GetCount()),
+		}
+	case *pb.LLMCallData_Video:
+		call.TokenUsage = VideoUsage{
+			Seconds: usage.Video.GetSeconds(),
+			Size:    usage.Video.GetSize(),
+		}
+	}
+	return call
+}
+
+// msgpackHandle 字段名与 JSON 一致（使用 json tag），token_usage 解码为 map[string]any 以便按类型重新解析
+var msgpackHandle = func() *codec.MsgpackHandle {
+	h := &codec.MsgpackHandle{}
+	h.MapType = reflect.TypeOf(map[string]any(nil))
+	h.RawToString = true
+	return h
+}()
+
+// DecodeMsgpackReport 解码 MessagePack 数组格式的上报，结构与 JSON 相同
+func DecodeMsgpackReport(data []byte) (LLMReportMessage, error) {
+	var report LLMReportMessage
+	if err := codec.NewDecoderBytes(data, msgpackHandle).Decode(&report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
@@ -0,0 +1,244 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/deepissue/fee_server/pb"
+	"github.com/ugorji/go/codec"
+	"google.golang.org/protobuf/proto"
+)
+
+const sampleCalls = 10
+
+// sampleReport 生成样例上报，文本、图片、视频按 8:1:1 混合
+func sampleReport(calls int) LLMReportMessage {
+	now := time.Now().Unix()
+	report := make(LLMReportMessage, 0, calls)
+	for i := 0; i < calls; i++ {
+		call := &LLMCallData{
+			Id:               fmt.Sprintf("call-%d", i),
+			NodeId:           "node-1",
+			Model:            "gpt-4o",
+			ModelId:          "m-gpt-4o",
+			ActualModel:      "gpt-4o-2024-08-06",
+			Provider:         "openai",
+			ActualProvider:   "openai",
+			ActualProviderId: "p-openai",
+			Caller:           "42",
+			CallerKey:        "sk-0123456789abcdef",
+			ClientVersion:    "1.4.0",
+			AgentVersion:     "2.1.3",
+			Stream:           true,
+			ReportType:       TextReportType,
+			TokenUsage:       TokenUsage{InputTokens: 1200, OutputTokens: 350, CacheTokens: 800, ReasoningTokens: 64, TokensPerSec: 45, Latency: 1.25},
+			Timestamp:        now,
+		}
+		switch i % 10 {
+		case 8:
+			call.ReportType = ImageReportType
+			call.TokenUsage = ImageUsage{Quality: "high", Size: "1024x1024", Count: 2}
+		case 9:
+			call.ReportType = VideoReportType
+			call.TokenUsage = VideoUsage{Seconds: 8, Size: "1280x720"}
+		}
+		report = append(report, call)
+	}
+	return report
+}
+
+func callToProto(c *LLMCallData) *pb.LLMCallData {
+	call := &pb.LLMCallData{
+		Id:               c.Id,
+		NodeId:           c.NodeId,
+		Model:            c.Model,
+		ModelId:          c.ModelId,
+		ActualModel:      c.ActualModel,
+		Provider:         c.Provider,
+		ActualProvider:   c.ActualProvider,
+		ActualProviderId: c.ActualProviderId,
+		Caller:           c.Caller,
+		CallerKey:        c.CallerKey,
+		ClientVersion:    c.ClientVersion,
+		AgentVersion:     c.AgentVersion,
+		Stream:           c.Stream,
+		ReportType:       string(c.ReportType),
+		Timestamp:        c.Timestamp,
+	}
+	switch usage := c.TokenUsage.(type) {
+	case TokenUsage:
+		call.Usage = &pb.LLMCallData_Text{Text: &pb.TextUsage{
+			InputTokens:     usage.InputTokens,
+			OutputTokens:    usage.OutputTokens,
+			CacheTokens:     usage.CacheTokens,
+			ReasoningTokens: int32(usage.ReasoningTokens),
+			TokensPerSec:    int32(usage.TokensPerSec),
+			Latency:         usage.Latency,
+		}}
+	case ImageUsage:
+		call.Usage = &pb.LLMCallData_Image{Image: &pb.ImageUsage{Quality: usage.Quality, Size: usage.Size, Count: int32(usage.Count)}}
+	case VideoUsage:
+		call.Usage = &pb.LLMCallData_Video{Video: &pb.VideoUsage{Seconds: usage.Seconds, Size: usage.Size}}
+	}
+	return call
+}
+
+// samplePayloads 将样例上报分别编码为 JSON、protobuf 和 MessagePack
+func samplePayloads(tb testing.TB, report LLMReportMessage) map[string][]byte {
+	tb.Helper()
+	payloads := make(map[string][]byte)
+	var err error
+	if payloads[ContentTypeJSON], err = json.Marshal(report); err != nil {
+		tb.Fatal(err)
+	}
+	message := &pb.LLMReport{}
+	for _, call := range report {
+		message.Calls = append(message.Calls, callToProto(call))
+	}
+	if payloads[ContentTypeProtobuf], err = proto.Marshal(message); err != nil {
+		tb.Fatal(err)
+	}
+	var msgpack []byte
+	if err = codec.NewEncoderBytes(&msgpack, msgpackHandle).Encode(report); err != nil {
+		tb.Fatal(err)
+	}
+	payloads[ContentTypeMsgpack] = msgpack
+	return payloads
+}
+
+// typedUsage 将调用的 token_usage 按上报类型解析为具体类型后返回副本
+// JSON 和 MessagePack 解码出的是 map，protobuf 解码出的是具体类型，计费前都经过同样的解析
+func typedUsage(t *testing.T, call *LLMCallData) LLMCallData {
+	t.Helper()
+	typed := *call
+	var err error
+	switch call.ReportType {
+	case ImageReportType:
+		typed.TokenUsage, err = call.ImageUsage()
+	case VideoReportType:
+		typed.TokenUsage, err = call.VideoUsage()
+	default:
+		typed.TokenUsage, err = call.TextUsage()
+	}
+	if err != nil {
+		t.Fatalf("call %s: %v", call.Id, err)
+	}
+	return typed
+}
+
+// protobuf 和 MessagePack 必须还原出与 JSON 相同的调用
+func TestDecodeRoundTrip(t *testing.T) {
+	report := sampleReport(sampleCalls)
+	payloads := samplePayloads(t, report)
+
+	expected, err := DecodeJSONReport(payloads[ContentTypeJSON])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expected) != len(report) {
+		t.Fatalf("decode json: %d calls, want %d", len(expected), len(report))
+	}
+	for i := range report {
+		if got := typedUsage(t, expected[i]); !reflect.DeepEqual(got, *report[i]) {
+			t.Errorf("decode json call %d:\n got %+v\nwant %+v", i, got, *report[i])
+		}
+	}
+	for _, c := range []struct {
+		contentType string
+		decode      ReportDecoder
+	}{
+		{ContentTypeProtobuf, DecodeProtobufReport},
+		{ContentTypeMsgpack, DecodeMsgpackReport},
+	} {
+		decoded, err := c.decode(payloads[c.contentType])
+		if err != nil {
+			t.Fatalf("decode %s: %v", c.contentType, err)
+		}
+		if len(decoded) != len(expected) {
+			t.Fatalf("decode %s: %d calls, want %d", c.contentType, len(decoded), len(expected))
+		}
+		for i := range expected {
+			if got, want := typedUsage(t, decoded[i]), typedUsage(t, expected[i]); !reflect.DeepEqual(got, want) {
+				t.Errorf("decode %s call %d:\n got %+v\nwant %+v", c.contentType, i, got, want)
+			}
+		}
+	}
+}
+
+// protobuf 上报的 usage 类型必须与 report_type 一致
+func TestDecodeProtobufUsageMismatch(t *testing.T) {
+	report := sampleReport(sampleCalls)
+	cases := []struct {
+		name       string
+		reportType ReportType
+		usage      any
+		want       RejectReason // 为空表示通过
+	}{
+		{"text", TextReportType, TokenUsage{InputTokens: 1}, ""},
+		{"empty report type with text", "", TokenUsage{InputTokens: 1}, ""},
+		{"image", ImageReportType, ImageUsage{Quality: "high", Size: "1024x1024", Count: 1}, ""},
+		{"no usage", ImageReportType, nil, ""},
+		{"unknown report type", "audio", TokenUsage{InputTokens: 1}, ""},
+		{"image with text usage", ImageReportType, TokenUsage{InputTokens: 1}, RejectUsageMismatch},
+		{"text with video usage", TextReportType, VideoUsage{Seconds: 4, Size: "1280x720"}, RejectUsageMismatch},
+		{"empty report type with image usage", "", ImageUsage{Count: 1}, RejectUsageMismatch},
+		{"video with image usage", VideoReportType, ImageUsage{Count: 1}, RejectUsageMismatch},
+	}
+	for _, c := range cases {
+		call := *report[0]
+		call.ReportType = c.reportType
+		call.TokenUsage = c.usage
+		data, err := proto.Marshal(&pb.LLMReport{Calls: []*pb.LLMCallData{callToProto(&call)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = DecodeProtobufReport(data)
+		if c.want == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", c.name, err)
+			}
+			continue
+		}
+		if reason := RejectReasonOf(err); reason != c.want {
+			t.Errorf("%s: reason = %s, want %s (%v)", c.name, reason, c.want, err)
+		}
+	}
+}
+
+func TestDecoderFor(t *testing.T) {
+	for _, contentType := range []string{"", ContentTypeJSON, "Application/JSON; charset=utf-8", ContentTypeProtobuf, ContentTypeMsgpack} {
+		if _, err := DecoderFor(contentType); err != nil {
+			t.Errorf("DecoderFor(%q): %v", contentType, err)
+		}
+	}
+	if _, err := DecoderFor("text/plain"); err == nil {
+		t.Errorf("DecoderFor(text/plain) should fail")
+	}
+}
+
+func benchmarkDecode(b *testing.B, contentType string, decode ReportDecoder) {
+	data := samplePayloads(b, sampleReport(sampleCalls))[contentType]
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := decode(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeJSON(b *testing.B) {
+	benchmarkDecode(b, ContentTypeJSON, DecodeJSONReport)
+}
+
+func BenchmarkDecodeProtobuf(b *testing.B) {
+	benchmarkDecode(b, ContentTypeProtobuf, DecodeProtobufReport)
+}
+
+func BenchmarkDecodeMsgpack(b *testing.B) {
+	benchmarkDecode(b, ContentTypeMsgpack, DecodeMsgpackReport)
+}
@@ -0,0 +1,127 @@
+package services
+
+import (
+	"time"
+
+	"github.com/deepissue/fee_server/models"
+	"github.com/google/uuid"
+)
+
+// EventSchemaVersion 事件信封的版本，字段被删除、改名或改变含义时递增；只新增字段时不变
+const EventSchemaVersion = 1
+
+type EventType string
+
+const (
+	EventUserConsume    EventType = "user_consume"
+	EventBudgetExceeded EventType = "budget_exceeded"
+)
+
+// defaultEventSubjects 各事件类型的默认主题，可通过 natsmq.subjects 按事件类型覆盖
+var defaultEventSubjects = map[EventType]string{
+	EventUserConsume:    "billing.userConsume",
+	EventBudgetExceeded: "billing.budgetExceeded",
+}
+
+// Event 发布到 NATS 的事件信封，格式见 docs/events/event.v1.schema.json
+// EventId 同时作为 Nats-Msg-Id，用于 JetStream 去重和下游幂等处理
+type Event struct {
+	SchemaVersion int       `json:"schema_version"`
+	EventId       string    `json:"event_id"`
+	EventType     EventType `json:"event_type"`
+	OccurredAt    int64     `json:"occurred_at"` // 事件发生时间，Unix 秒
+	Payload       any       `json:"payload"`
+}
+
+func NewEvent(eventType EventType, occurredAt time.Time, payload any) *Event {
+	return &Event{
+		SchemaVersion: EventSchemaVersion,
+		EventId:       uuid.NewString(),
+		EventType:     eventType,
+		OccurredAt:    occurredAt.Unix(),
+		Payload:       payload,
+	}
+}
+
+// UserConsumeEvent user_consume 事件内容，与 models.UserConsumeRecord 解耦，表结构变化不影响消息格式
+// 金额单位均为微代币；consume_id 只在 consume_month 对应的月份分表内唯一
+type UserConsumeEvent struct {
+	ConsumeId        int64  `json:"consume_id"`
+	ConsumeMonth     string `json:"consume_month"` // 消费记录所在分表的月份 YYYYMM
+	UserId           int64  `json:"user_id"`
+	NodeId           string `json:"node_id"`
+	Caller           string `json:"caller"`
+	WalletId         int64  `json:"wallet_id"`
+	OrgId            int64  `json:"org_id"`
+	Model            string `json:"model"`
+	ModelId          string `json:"model_id"`
+	ActualProvider   string `json:"actual_provider"`
+	ActualProviderId string `json:"actual_provider_id"`
+	ActualModel      string `json:"actual_model"`
+	ConsumeType      string `json:"consume_type"`
+	TotalConsumed    int64  `json:"total_consumed"`
+	DiscountAmount   int64  `json:"discount_amount"`
+	ProviderCost     int64  `json:"provider_cost"`
+	Margin           int64  `json:"margin"`
+	HasCost          bool   `json:"has_cost"`
+	CreatedAt        int64  `json:"created_at"`
+}
+
+func NewUserConsumeEvent(record *models.UserConsumeRecord) *Event {
+	return NewEvent(EventUserConsume, time.Unix(record.CreatedAt, 0), &UserConsumeEvent{
+		ConsumeId:        record.ID,
+		ConsumeMonth:     record.Slice(),
+		UserId:           record.UserId,
+		NodeId:           record.NodeId,
+		Caller:           record.Caller,
+		WalletId:         record.WalletId,
+		OrgId:            record.OrgId,
+		Model:            record.Model,
+		ModelId:          record.ModelId,
+		ActualProvider:   record.ActualProvider,
+		ActualProviderId: record.ActualProviderId,
+		ActualModel:      record.ActualModel,
+		ConsumeType:      record.ConsumeType,
+		TotalConsumed:    record.TotalConsumed,
+		DiscountAmount:   record.DiscountAmount,
+		ProviderCost:     record.ProviderCost,
+		Margin:           record.Margin,
+		HasCost:          record.HasCost,
+		CreatedAt:        record.CreatedAt,
+	})
+}
+
+// BudgetExceededEvent budget_exceeded 事件内容，预算在一个窗口内首次用尽时发布，金额单位为微代币
+// 网关收到后应在 window_end 之前按 action 拦截匹配 user_id、key_id、model_id 的调用
+type BudgetExceededEvent struct {
+	BudgetId     int64  `json:"budget_id"`
+	UserId       int64  `json:"user_id"`
+	KeyId        string `json:"key_id"`
+	ModelId      string `json:"model_id"`
+	Window       string `json:"window"`
+	WindowStart  int64  `json:"window_start"`
+	WindowEnd    int64  `json:"window_end"`
+	LimitAmount  int64  `json:"limit_amount"`
+	Spent        int64  `json:"spent"`
+	Action       string `json:"action"`
+	ConsumeId    int64  `json:"consume_id"`    // 使预算用尽的消费记录
+	ConsumeMonth string `json:"consume_month"` // 该消费记录所在分表的月份 YYYYMM
+}
+
+func NewBudgetExceededEvent(budget *models.Budget, record *models.UserConsumeRecord, at time.Time) *Event {
+	start, end := budgetWindow(budget.Window, at)
+	return NewEvent(EventBudgetExceeded, at, &BudgetExceededEvent{
+		BudgetId:     budget.ID,
+		UserId:       budget.UserId,
+		KeyId:        budget.KeyId,
+		ModelId:      budget.ModelId,
+		Window:       budget.Window,
+		WindowStart:  start.Unix(),
+		WindowEnd:    end.Unix(),
+		LimitAmount:  budget.LimitAmount,
+		Spent:        budget.Spent,
+		Action:       budget.Action,
+		ConsumeId:    record.ID,
+		ConsumeMonth: record.Slice(),
+	})
+}
@@ -0,0 +1,173 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/deepissue/fee_server/models"
+	"github.com/google/uuid"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+const eventsDir = "../../docs/events"
+
+// eventSchema 编译 event.v1.schema.json，并校验 uuid 等 format
+func eventSchema(t *testing.T) *jsonschema.Schema {
+	t.Helper()
+	compiler := jsonschema.NewCompiler()
+	compiler.AssertFormat()
+	schema, err := compiler.Compile(filepath.Join(eventsDir, "event.v1.schema.json"))
+	if err != nil {
+		t.Fatalf("compile schema: %v", err)
+	}
+	return schema
+}
+
+// decodeEvent 将事件 JSON 解码为通用结构，用于逐字段比较和 schema 校验
+func decodeEvent(t *testing.T, data []byte) map[string]any {
+	t.Helper()
+	value, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decode event: %v", err)
+	}
+	event, ok := value.(map[string]any)
+	if !ok {
+		t.Fatalf("event is not an object: %s", data)
+	}
+	return event
+}
+
+func readExample(t *testing.T, name string) map[string]any {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(eventsDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decodeEvent(t, data)
+}
+
+// compareFields 逐字段比较 got 和 want，嵌套对象递归比较，path 用于定位不一致的字段
+func compareFields(t *testing.T, path string, got, want map[string]any) {
+	t.Helper()
+	for key, wantValue := range want {
+		gotValue, ok := got[key]
+		if !ok {
+			t.Errorf("%s%s: missing, want %v", path, key, wantValue)
+			continue
+		}
+		gotObject, gotIsObject := gotValue.(map[string]any)
+		wantObject, wantIsObject := wantValue.(map[string]any)
+		if gotIsObject && wantIsObject {
+			compareFields(t, path+key+".", gotObject, wantObject)
+			continue
+		}
+		if !reflect.DeepEqual(gotValue, wantValue) {
+			t.Errorf("%s%s: got %v, want %v", path, key, gotValue, wantValue)
+		}
+	}
+	for key, gotValue := range got {
+		if _, ok := want[key]; !ok {
+			t.Errorf("%s%s: unexpected field with value %v", path, key, gotValue)
+		}
+	}
+}
+
+// checkEvent 事件编码后必须与示例逐字段一致，并且事件和示例都通过 schema 校验
+// event_id 每次随机生成，只校验格式后用示例的值比较
+func checkEvent(t *testing.T, event *Event, example string) {
+	t.Helper()
+	if _, err := uuid.Parse(event.EventId); err != nil {
+		t.Errorf("event_id %q is not a uuid: %v", event.EventId, err)
+	}
+	want := readExample(t, example)
+	event.EventId = want["event_id"].(string)
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := decodeEvent(t, data)
+	compareFields(t, "", got, want)
+
+	schema := eventSchema(t)
+	if err := schema.Validate(want); err != nil {
+		t.Errorf("%s does not match the schema: %v", example, err)
+	}
+	if err := schema.Validate(got); err != nil {
+		t.Errorf("%s event does not match the schema: %v", event.EventType, err)
+	}
+}
+
+func TestUserConsumeEvent(t *testing.T) {
+	record := &models.UserConsumeRecord{
+		ID:               1024,
+		UserId:           42,
+		NodeId:           "node-1",
+		Caller:           "sk-team-7",
+		WalletId:         310,
+		OrgId:            12,
+		Model:            "gpt-4o",
+		ModelId:          "m-gpt-4o",
+		ActualProvider:   "openai",
+		ActualProviderId: "p-openai",
+		ActualModel:      "gpt-4o-2024-08-06",
+		ConsumeType:      "text",
+		TotalConsumed:    1250,
+		DiscountAmount:   0,
+		ProviderCost:     1000,
+		Margin:           250,
+		HasCost:          true,
+		CreatedAt:        1762171200,
+	}
+	checkEvent(t, NewUserConsumeEvent(record), "user_consume.v1.example.json")
+}
+
+func TestBudgetExceededEvent(t *testing.T) {
+	budget := &models.Budget{
+		ID:          8,
+		UserId:      42,
+		ModelId:     "m-gpt-4o",
+		Window:      models.BudgetDaily,
+		LimitAmount: 5000000,
+		Spent:       5001250,
+		Action:      models.BudgetActionReject,
+	}
+	record := &models.UserConsumeRecord{ID: 1187, CreatedAt: 1762174800}
+	// 示例的预算窗口按 UTC 计算
+	at := time.Unix(record.CreatedAt, 0).UTC()
+	checkEvent(t, NewBudgetExceededEvent(budget, record, at), "budget_exceeded.v1.example.json")
+}
+
+// 缺少必填字段或取值不在枚举内的事件不能通过 schema 校验
+func TestEventSchemaRejects(t *testing.T) {
+	schema := eventSchema(t)
+	cases := map[string]func(event map[string]any){
+		"missing consume_id": func(event map[string]any) {
+			delete(event["payload"].(map[string]any), "consume_id")
+		},
+		"unknown event_type": func(event map[string]any) { event["event_type"] = "user_refund" },
+		"invalid event_id":   func(event map[string]any) { event["event_id"] = "1024" },
+		"schema_version 2":   func(event map[string]any) { event["schema_version"] = json.Number("2") },
+		"invalid consume_month": func(event map[string]any) {
+			event["payload"].(map[string]any)["consume_month"] = "2025-11"
+		},
+	}
+	for name, mutate := range cases {
+		event := readExample(t, "user_consume.v1.example.json")
+		mutate(event)
+		if err := schema.Validate(event); err == nil {
+			t.Errorf("%s: expected a schema error", name)
+		}
+	}
+
+	event := readExample(t, "budget_exceeded.v1.example.json")
+	event["payload"].(map[string]any)["action"] = "block"
+	if err := schema.Validate(event); err == nil {
+		t.Errorf("unknown budget action: expected a schema error")
+	}
+}
@@ -1,31 +1,61 @@
 package services
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"time"
 
 	"github.com/deepissue/core/server"
 	"github.com/deepissue/core/utils"
 	"github.com/deepissue/fee_server/config"
 	"github.com/deepissue/fee_server/models"
+	"github.com/go-sql-driver/mysql"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"xorm.io/xorm"
 )
 
+const defaultDrainTimeout = 30 * time.Second
+
+// deductRetries 扣费事务遇到死锁或锁等待超时时的重试次数
+const deductRetries = 3
+
 type FeeInstance struct {
-	userId    int64
+	account   Account
 	data      LLMCallData
 	priceInfo PriceInfo
+	costInfo  PriceInfo // 上游服务商成本价
+	hasCost   bool
 }
 type FeeService struct {
-	xorm  xorm.EngineInterface
-	mq    *NatsMQ
-	price *PriceService
+	ctx       context.Context
+	xorm      xorm.EngineInterface
+	mq        *NatsMQ
+	price     *PriceService
+	margin    *MarginService
+	statement *StatementService
+	rollup    *RollupService
+	partition *ConsumePartition
+	pricing   *PricingReloader
+	currency  *CurrencyService
+	health    *HealthService
+	outbox    *OutboxRelay
+	accounts  *AccountService
+	budgets   *BudgetService
+
+	walletPolicy *WalletPolicy
+	reportWindow ReportWindow
+	drainTimeout time.Duration
 }
 
 func NewFeeService(srv *server.Server, xorm xorm.EngineInterface, c *config.Config) (*FeeService, error) {
 	f := &FeeService{
-		xorm: xorm,
+		ctx:          srv.Ctx,
+		xorm:         xorm,
+		drainTimeout: defaultDrainTimeout,
+	}
+	if c.Nats.DrainTimeout > 0 {
+		f.drainTimeout = time.Duration(c.Nats.DrainTimeout) * time.Second
 	}
 	mq, err := NewNatsMQ(srv.Ctx, &c.Nats)
 	if nil != err {
@@ -33,111 +63,327 @@ func NewFeeService(srv *server.Server, xorm xorm.EngineInterface, c *config.Conf
 	}
 	f.mq = mq
 	f.price = NewPriceService(srv.Ctx, xorm)
+	if f.pricing, err = NewPricingReloader(f.price, c.Pricing); err != nil {
+		return nil, err
+	}
+	f.currency = NewCurrencyService(xorm)
+	f.health = NewHealthService(xorm, mq, c.Health)
+	f.outbox = NewOutboxRelay(xorm, mq, c.Outbox)
+	mq.RequireDuplicateWindow(f.outbox.DuplicateWindow())
+	f.budgets = NewBudgetService(xorm, f.outbox)
+	f.partition = NewConsumePartition(xorm)
+	f.accounts = NewAccountService(xorm, f.partition, c.Report)
+	if f.walletPolicy, err = NewWalletPolicy(c.Wallet); err != nil {
+		return nil, err
+	}
+	f.reportWindow = NewReportWindow(c.Report)
+	f.margin = NewMarginService(xorm, f.partition)
+	f.statement = NewStatementService(xorm, f.partition)
+	f.rollup = NewRollupService(xorm, f.partition)
 	return f, nil
 }
 
 func (m *FeeService) Start() error {
 
+	if err := prometheus.Register(&serviceCollector{mq: m.mq, outbox: m.outbox}); err != nil {
+		return err
+	}
 	m.mq.AddConsumer("fee", m)
 	if err := m.mq.Subscribe(); err != nil {
 		return err
 	}
 	m.mq.Start()
+	go m.statement.Run(m.ctx)
+	go m.pricing.Run(m.ctx)
+	go m.outbox.Run(m.ctx)
 
 	return nil
 }
 
+// Stop 停止消费并等待处理中的扣费完成，数据库连接由调用方在之后关闭
 func (m *FeeService) Stop() {
-	m.mq.Close()
+	logrus.Info("fee service stopping")
+	if err := m.mq.Close(m.drainTimeout); err != nil {
+		logrus.Errorf("close nats: %v", err)
+	}
+	logrus.Info("fee service stopped")
 }
 
 func (m *FeeService) Do(report LLMReportMessage) (bool, error) {
 
 	logrus.Tracef("Received message: %v", report)
+	// 任何一条调用不合法时整条消息转入死信主题，不部分扣费
+	now := time.Now()
+	for _, usage := range report {
+		if err := usage.Validate(m.reportWindow, now); err != nil {
+			logrus.Warnf("invalid call data: %v", err)
+			return false, err
+		}
+	}
+
 	var instances []FeeInstance
 	for _, usage := range report {
+		account, err := m.accounts.Resolve(usage)
+		if err != nil {
+			var reject *RejectError
+			if errors.As(err, &reject) {
+				logrus.Warnf("invalid call data: %v", err)
+				return false, err
+			}
+			return true, err
+		}
+		if usage.ReportType == ImageReportType || usage.ReportType == VideoReportType {
+			// 图片/视频按美元价格表计费，扣费时按调用时间的汇率换算为微代币
+			logrus.Infof("consume info: user: %s, provider: %s, model: %s, type: %s, usage: %v", usage.Caller, usage.Provider, usage.Model, usage.ReportType, usage.TokenUsage)
+			instances = append(instances, FeeInstance{account: account, data: *usage})
+			continue
+		}
 
-		priceInfo, has := m.price.FetchProviderPrice(usage.ModelId)
+		priceInfo, has := m.price.FetchProviderPrice(usage.ModelId, usage.CalledAt())
 		if !has {
-			return false, fmt.Errorf("model price not found: %s, %s", usage.ModelId, usage.Model)
+			metricPriceNotFound.WithLabelValues(usage.ModelId).Inc()
+			return false, rejectf(RejectPriceNotFound, usage.Id, "model price not found: %s, %s", usage.ModelId, usage.Model)
 		}
 
-		logrus.Infof("consume info: user: %s, provider: %s, model: %s, price: %v, usage: %s", usage.Caller, usage.Provider, usage.Model, priceInfo, usage.TokenUsage)
-		instances = append(instances, FeeInstance{userId: usage.UserId(), data: *usage, priceInfo: priceInfo})
+		costInfo, hasCost := m.price.FetchProviderCost(usage.ActualProviderId, usage.ActualModel, usage.CalledAt())
+
+		logrus.Infof("consume info: user: %s, provider: %s, model: %s, price: %v, cost: %v, usage: %s", usage.Caller, usage.Provider, usage.Model, priceInfo, costInfo, usage.TokenUsage)
+		instances = append(instances, FeeInstance{account: account, data: *usage, priceInfo: priceInfo, costInfo: costInfo, hasCost: hasCost})
 	}
 
 	if len(instances) == 0 {
 		return false, nil
 	}
 
-	consumes, err := m.deductFees(instances)
+	var metrics *txMetrics
+	var err error
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		metrics, err = m.deductFees(instances)
+		metricDeductSeconds.Observe(time.Since(start).Seconds())
+		if err == nil || attempt >= deductRetries || !isRetryableTxError(err) {
+			break
+		}
+		metricTxRetries.Inc()
+		logrus.Warnf("deduct fees conflicted, retrying (%d/%d): %v", attempt+1, deductRetries, err)
+	}
 	if err != nil {
 		logrus.Errorf("Failed to deduct fees: %v, error: %v", utils.EncodeToString(report), err)
-		return true, err
+		var reject *RejectError
+		return !errors.As(err, &reject), err
 	}
 
-	m.mq.Publish(consumes)
+	metrics.record()
+	m.outbox.Notify()
 
 	return false, nil
 }
 
-func (m *FeeService) deductFees(instances []FeeInstance) ([]*models.UserConsumeRecord, error) {
+// deductFees 在一个事务中完成全部调用的扣费，返回提交后才计入的指标
+func (m *FeeService) deductFees(instances []FeeInstance) (*txMetrics, error) {
+	now := time.Now()
+	tables, err := m.partition.Ensure(now)
+	if err != nil {
+		return nil, err
+	}
+
 	session := m.xorm.NewSession()
 	defer session.Close()
 	if err := session.Begin(); err != nil {
 		return nil, err
 	}
-	var consumes []*models.UserConsumeRecord
+	metrics := &txMetrics{}
 	for _, inst := range instances {
-		var details []models.UserConsumeRecord
-		balance := models.UserWallet{UserId: inst.userId}
-		if has, err := session.Get(&balance); err != nil {
+		wallets, err := m.wallets(session, inst.account)
+		if err != nil {
+			return nil, err
+		}
+		charge, err := m.charge(&inst)
+		if err != nil {
 			return nil, err
-		} else if !has {
-			return nil, fmt.Errorf("user wallet not found: %d", inst.userId)
 		}
-		usage := inst.data.TokenUsage.(TokenUsage)
-		inputCost := CalculateTokenCostMicro(usage.InputTokens, float64(inst.priceInfo.InputPrice))
-		outputCost := CalculateTokenCostMicro(usage.InputTokens, float64(inst.priceInfo.InputPrice))
+		remainingCost := charge.amount.Micro()
 
-		remainingCost := inputCost + outputCost
-		balance.Balance -= remainingCost
+		margin := charge.margin()
+		if charge.hasCost && margin < 0 {
+			logrus.Warnf("billed below cost: user: %d, model: %s, provider: %s, actual model: %s, charge: %s, cost: %s",
+				inst.account.UserId, inst.data.ModelId, inst.data.ActualProviderId, inst.data.ActualModel, charge.amount, charge.cost)
+		}
 
-		rows, err := session.ID(balance.Id).Update(&balance)
+		shares, err := m.deductWallets(session, wallets, remainingCost, now)
 		if err != nil {
-			logrus.Errorf("update user balance failed: %d, cost: %d", inst.userId, remainingCost)
 			return nil, err
 		}
-		if rows == 0 {
-			return nil, fmt.Errorf("failed to update user balance: %d, cost: %d", inst.userId, remainingCost)
-		}
 
 		//保存扣费记录
 		record := models.UserConsumeRecord{
-			UserId:           inst.userId,
+			UserId:           inst.account.UserId,
+			Caller:           inst.data.CallerKey,
+			WalletId:         shares[0].Wallet.Id,
+			OrgId:            shares[0].Wallet.OrgId,
 			Model:            inst.data.Model,
-			ModelId:          inst.data.NodeId,
+			ModelId:          inst.data.ModelId,
 			NodeId:           inst.data.NodeId,
 			TotalConsumed:    remainingCost,
 			ActualProvider:   inst.data.ActualProvider,
 			ActualProviderId: inst.data.ActualProviderId,
-			CreatedAt:        time.Now().Unix(),
+			ActualModel:      inst.data.ActualModel,
+			ProviderCost:     charge.cost.Micro(),
+			Margin:           margin.Micro(),
+			HasCost:          charge.hasCost,
+			ConsumeType:      string(inst.data.ReportType),
+			CreatedAt:        now.Unix(),
 		}
-		if _, err := session.InsertOne(&record); err != nil {
+		if _, err := session.Table(tables.Record).InsertOne(&record); err != nil {
 			logrus.Errorf("insert record: %v", err)
 			return nil, err
 		}
-		if len(details) > 0 {
-			if _, err := session.InsertMulti(&details); err != nil {
-				logrus.Errorf("insert detail records: %v", err)
-				return nil, err
-			}
+		if err := m.insertDetail(session, tables, &inst, &charge, &record); err != nil {
+			return nil, err
+		}
+		if err := insertWalletDetails(session, tables, &record, shares); err != nil {
+			return nil, err
+		}
+		if err := m.rollup.Add(session, &record, charge.usage); err != nil {
+			return nil, err
+		}
+		if err := m.accounts.AddSpend(session, inst.account, charge.amount, now, metrics); err != nil {
+			return nil, err
+		}
+		if err := m.budgets.Apply(session, inst.account, &inst.data, &record, now, metrics); err != nil {
+			return nil, err
+		}
+		metrics.billed = append(metrics.billed, &record)
+	}
+	// 消费事件与扣费一起提交，由 outbox relay 发布
+	for _, record := range metrics.billed {
+		if err := m.outbox.Enqueue(session, NewUserConsumeEvent(record)); err != nil {
+			return nil, err
 		}
-		consumes = append(consumes, &record)
 	}
 	if err := session.Commit(); err != nil {
 		return nil, err
 	}
 
-	return consumes, nil
+	return metrics, nil
+}
+
+// feeCharge 一次调用的计费结果
+type feeCharge struct {
+	amount  Money
+	cost    Money // 上游成本，仅文本调用配置了成本价时有值
+	hasCost bool
+	usage   RollupUsage
+	text    TokenUsage
+	image   ImageUsage
+	video   VideoUsage
+}
+
+// margin 毛利，没有上游成本时为 0，避免把整笔扣费计为毛利
+func (c *feeCharge) margin() Money {
+	if !c.hasCost {
+		return 0
+	}
+	return c.amount - c.cost
+}
+
+// charge 按调用类型计算费用，取整规则见 Money
+func (m *FeeService) charge(inst *FeeInstance) (feeCharge, error) {
+	var c feeCharge
+	at := inst.data.CalledAt()
+	switch inst.data.ReportType {
+	case ImageReportType:
+		usage, err := inst.data.ImageUsage()
+		if err != nil {
+			return c, err
+		}
+		if c.amount, err = m.currency.ImageCost(ImageModel(inst.data.Model), ImageQuality(usage.Quality), ImageSize(usage.Size), usage.Count, at); err != nil {
+			return c, err
+		}
+		c.image = usage
+		c.usage = RollupUsage{Images: int64(usage.Count)}
+	case VideoReportType:
+		usage, err := inst.data.VideoUsage()
+		if err != nil {
+			return c, err
+		}
+		if c.amount, err = m.currency.VideoCost(VideoModel(inst.data.Model), VideoResolution(usage.Size), usage.Seconds, at); err != nil {
+			return c, err
+		}
+		c.video = usage
+		c.usage = RollupUsage{VideoSeconds: usage.Seconds}
+	default:
+		usage, err := inst.data.TextUsage()
+		if err != nil {
+			return c, err
+		}
+		// 溢出是确定性的，重试也不会成功，直接拒绝
+		if c.amount, err = CalculateTextCost(usage, inst.priceInfo); err != nil {
+			return c, rejectf(RejectInvalidUsage, inst.data.Id, "charge: %v", err)
+		}
+		if inst.hasCost {
+			if c.cost, err = CalculateTextCost(usage, inst.costInfo); err != nil {
+				return c, rejectf(RejectInvalidUsage, inst.data.Id, "provider cost: %v", err)
+			}
+			c.hasCost = true
+		}
+		c.text = usage
+		c.usage = RollupUsage{
+			InputTokens:  usage.InputTokens,
+			OutputTokens: usage.OutputTokens,
+			CacheTokens:  usage.CacheTokens,
+		}
+	}
+	return c, nil
+}
+
+// insertDetail 按调用类型写入消费明细
+func (m *FeeService) insertDetail(session *xorm.Session, tables models.ConsumeTables, inst *FeeInstance, c *feeCharge, record *models.UserConsumeRecord) error {
+	var table string
+	var detail any
+	switch inst.data.ReportType {
+	case ImageReportType:
+		table = tables.Image
+		detail = &models.UserConsumeDetailImage{
+			ConsumdId: record.ID,
+			Quality:   c.image.Quality,
+			Size:      c.image.Size,
+			Count:     int64(c.image.Count),
+			CreatedAt: record.CreatedAt,
+		}
+	case VideoReportType:
+		table = tables.Video
+		detail = &models.UserConsumeDetailVideo{
+			ConsumdId: record.ID,
+			Seconds:   c.video.Seconds,
+			Size:      c.video.Size,
+			CreatedAt: record.CreatedAt,
+		}
+	default:
+		table = tables.Text
+		detail = &models.UserConsumeDetailText{
+			ConsumdId:    record.ID,
+			InputTokens:  c.text.InputTokens,
+			OutputTokens: c.text.OutputTokens,
+			CacheTokens:  c.text.CacheTokens,
+			InputPrice:   int(inst.priceInfo.InputPrice),
+			OutputPrice:  int(inst.priceInfo.OutputPrice),
+			CachePrice:   int(inst.priceInfo.CachePrice),
+			CreatedAt:    record.CreatedAt,
+		}
+	}
+	if _, err := session.Table(table).InsertOne(detail); err != nil {
+		logrus.Errorf("insert detail record: %v", err)
+		return err
+	}
+	return nil
+}
+
+// isRetryableTxError MySQL 死锁(1213)和锁等待超时(1205)可以重试整个扣费事务
+func isRetryableTxError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1213 || mysqlErr.Number == 1205
+	}
+	return false
 }
@@ -0,0 +1,34 @@
+package services
+
+import "testing"
+
+// 没有上游成本的调用毛利为 0，不能把整笔扣费计为毛利
+func TestChargeMargin(t *testing.T) {
+	call := textCall(0)
+	price := PriceInfo{InputPrice: 10, OutputPrice: 30}
+	cases := []struct {
+		name    string
+		inst    FeeInstance
+		hasCost bool
+		cost    Money
+		margin  Money
+	}{
+		{"no cost", FeeInstance{data: *call, priceInfo: price}, false, 0, 0},
+		{"with cost", FeeInstance{data: *call, priceInfo: price, costInfo: PriceInfo{InputPrice: 8, OutputPrice: 20}, hasCost: true}, true, 1200, 400},
+		{"below cost", FeeInstance{data: *call, priceInfo: price, costInfo: PriceInfo{InputPrice: 12, OutputPrice: 40}, hasCost: true}, true, 2000, -400},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			charge, err := (&FeeService{}).charge(&c.inst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if charge.amount != 1600 {
+				t.Errorf("amount = %s, want 1600", charge.amount)
+			}
+			if charge.hasCost != c.hasCost || charge.cost != c.cost || charge.margin() != c.margin {
+				t.Errorf("hasCost %v, cost %s, margin %s; want %v, %s, %s", charge.hasCost, charge.cost, charge.margin(), c.hasCost, c.cost, c.margin)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/deepissue/fee_server/config"
+	"github.com/nats-io/nats.go"
+	"xorm.io/xorm"
+)
+
+const (
+	HealthUp   = "up"
+	HealthDown = "down"
+
+	healthCheckTimeout = 3 * time.Second
+)
+
+// HealthCheck 单个依赖的检查结果
+type HealthCheck struct {
+	Status  string         `json:"status"`
+	Error   string         `json:"error,omitempty"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// HealthReport 各依赖的检查结果，任一依赖 down 时整体为 down
+type HealthReport struct {
+	Status    string                 `json:"status"`
+	Checks    map[string]HealthCheck `json:"checks"`
+	CheckedAt int64                  `json:"checked_at"`
+}
+
+// HealthService 检查 NATS 连接、JetStream 消费者及积压、数据库连接
+type HealthService struct {
+	xorm   xorm.EngineInterface
+	mq     *NatsMQ
+	config *config.HealthConfig
+}
+
+func NewHealthService(xorm xorm.EngineInterface, mq *NatsMQ, c *config.HealthConfig) *HealthService {
+	if c == nil {
+		c = &config.HealthConfig{}
+	}
+	return &HealthService{xorm: xorm, mq: mq, config: c}
+}
+
+// Live 存活检查：只要进程在运行且 NATS 连接未被永久关闭即视为存活
+func (m *HealthService) Live() HealthReport {
+	return newHealthReport(map[string]HealthCheck{
+		"nats": m.checkConnection(true),
+	})
+}
+
+// Ready 就绪检查：NATS 已连接、消费者存在且积压未超限、数据库可用时才能正常计费
+func (m *HealthService) Ready(ctx context.Context) HealthReport {
+	return newHealthReport(map[string]HealthCheck{
+		"nats":     m.checkConnection(false),
+		"consumer": m.checkConsumer(),
+		"database": m.checkDatabase(ctx),
+	})
+}
+
+func newHealthReport(checks map[string]HealthCheck) HealthReport {
+	report := HealthReport{Status: HealthUp, Checks: checks, CheckedAt: time.Now().Unix()}
+	for _, check := range checks {
+		if check.Status != HealthUp {
+			report.Status = HealthDown
+		}
+	}
+	return report
+}
+
+// checkConnection 重连中的连接在 live 检查中视为正常，在 ready 检查中视为未就绪
+func (m *HealthService) checkConnection(live bool) HealthCheck {
+	status := m.mq.Status()
+	check := HealthCheck{Status: HealthUp, Details: m.mq.ConnectionStats()}
+	check.Details["state"] = status.String()
+	switch {
+	case !live && m.mq.Stopping():
+		check.Status = HealthDown
+		check.Error = "shutting down"
+	case status == nats.CONNECTED:
+	case live && status != nats.CLOSED:
+	default:
+		check.Status = HealthDown
+		check.Error = fmt.Sprintf("nats connection is %s", status)
+	}
+	return check
+}
+
+func (m *HealthService) checkConsumer() HealthCheck {
+	info, err := m.mq.ConsumerInfo()
+	if err != nil {
+		return HealthCheck{Status: HealthDown, Error: err.Error()}
+	}
+	lag := int64(info.NumPending) + int64(info.NumAckPending)
+	check := HealthCheck{Status: HealthUp, Details: map[string]any{
+		"stream":          info.Stream,
+		"consumer":        info.Name,
+		"num_pending":     info.NumPending,
+		"num_ack_pending": info.NumAckPending,
+		"num_redelivered": info.NumRedelivered,
+		"lag":             lag,
+	}}
+	if m.config.MaxConsumerLag > 0 && lag > m.config.MaxConsumerLag {
+		check.Status = HealthDown
+		check.Error = fmt.Sprintf("consumer lag %d exceeds %d", lag, m.config.MaxConsumerLag)
+	}
+	return check
+}
+
+func (m *HealthService) checkDatabase(ctx context.Context) HealthCheck {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	start := time.Now()
+	session := m.xorm.Context(ctx)
+	defer session.Close()
+	if err := session.PingContext(ctx); err != nil {
+		return HealthCheck{Status: HealthDown, Error: err.Error()}
+	}
+	return HealthCheck{Status: HealthUp, Details: map[string]any{"latency_ms": time.Since(start).Milliseconds()}}
+}
@@ -1,18 +1,39 @@
 package services
 
 import (
+	"errors"
 	"fmt"
 	"maps"
+	"math"
+	"math/big"
 	"os"
+	"sync/atomic"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 // imagePricing manages image generation pricing
+// The active price sheet is swapped atomically on reload, so readers never observe a partially loaded sheet
 type imagePricing struct {
+	sheet atomic.Pointer[imagePriceSheet]
+}
+
+// imagePriceSheet is an immutable snapshot of the image pricing matrix
+type imagePriceSheet struct {
+	info       PriceSheetInfo
+	schedule   map[imagePriceKey][]priceWindow // 从数据库加载时的全部价格版本，按调用时间查价
 	pricingMap map[ImageModel]map[ImageQuality]map[ImageSize]float64
 }
 
+// PriceSheetInfo describes the price sheet currently in use
+type PriceSheetInfo struct {
+	Version     string    `json:"version"`
+	LastUpdated string    `json:"last_updated"`
+	Source      string    `json:"source"` // config file path, or "default"
+	LoadedAt    time.Time `json:"loaded_at"`
+}
+
 // ImageQuality represents the quality level of image generation
 type ImageQuality string
 
@@ -137,9 +158,12 @@ func getDefaultPricing() map[ImageModel]map[ImageQuality]map[ImageSize]float64 {
 
 // NewImagePricing creates a new Pricing instance with default pricing
 func NewImagePricing() *imagePricing {
-	return &imagePricing{
+	p := &imagePricing{}
+	p.sheet.Store(&imagePriceSheet{
+		info:       PriceSheetInfo{Source: "default", LoadedAt: time.Now()},
 		pricingMap: getDefaultPricing(),
-	}
+	})
+	return p
 }
 
 // NewPricingWithConfig creates a new Pricing instance and loads configuration from file
@@ -161,25 +185,79 @@ func NewPricingWithConfig(configPath string) (*imagePricing, error) {
 }
 
 // LoadFromFile loads pricing configuration from a YAML file and merges with default pricing
+// The file is validated first; on any error the current price sheet stays in use
 func (p *imagePricing) LoadFromFile(configPath string) error {
-	data, err := os.ReadFile(configPath)
+	config, err := ReadPricingConfig(configPath)
 	if err != nil {
 		return err
 	}
 
+	// Merge config into a fresh copy of the default pricing and swap it in
+	sheet := &imagePriceSheet{
+		info: PriceSheetInfo{
+			Version:     config.Version,
+			LastUpdated: config.LastUpdated,
+			Source:      configPath,
+			LoadedAt:    time.Now(),
+		},
+		pricingMap: getDefaultPricing(),
+	}
+	sheet.mergeConfig(config)
+	p.sheet.Store(sheet)
+
+	return nil
+}
+
+// ReadPricingConfig reads and validates a pricing YAML file
+func ReadPricingConfig(configPath string) (PricingConfig, error) {
 	var config PricingConfig
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return config, err
+	}
 	if err := yaml.Unmarshal(data, &config); err != nil {
-		return fmt.Errorf("failed to parse pricing config: %w", err)
+		return config, fmt.Errorf("failed to parse pricing config: %w", err)
 	}
+	if err := config.Validate(); err != nil {
+		return config, fmt.Errorf("invalid pricing config %s: %w", configPath, err)
+	}
+	return config, nil
+}
 
-	// Merge config into pricing map
-	p.mergeConfig(config)
-
+// Validate checks the configuration before it replaces the live price sheet
+func (c PricingConfig) Validate() error {
+	if c.Version == "" {
+		return errors.New("version is required")
+	}
+	for _, modelConfig := range c.Models {
+		if modelConfig.Model == "" {
+			return errors.New("model name is required")
+		}
+		for _, qualityConfig := range modelConfig.Qualities {
+			if qualityConfig.Quality == "" {
+				return fmt.Errorf("model %s: quality is required", modelConfig.Model)
+			}
+			for _, sizeConfig := range qualityConfig.Sizes {
+				if sizeConfig.Size == "" {
+					return fmt.Errorf("model %s, quality %s: size is required", modelConfig.Model, qualityConfig.Quality)
+				}
+				if !(sizeConfig.Price > 0) || math.IsInf(sizeConfig.Price, 0) {
+					return fmt.Errorf("model %s, quality %s, size %s: invalid price %v",
+						modelConfig.Model, qualityConfig.Quality, sizeConfig.Size, sizeConfig.Price)
+				}
+			}
+		}
+	}
 	return nil
 }
 
+// Info returns the version information of the live price sheet
+func (p *imagePricing) Info() PriceSheetInfo {
+	return p.sheet.Load().info
+}
+
 // mergeConfig merges the configuration into the pricing map, overriding default values
-func (p *imagePricing) mergeConfig(config PricingConfig) {
+func (p *imagePriceSheet) mergeConfig(config PricingConfig) {
 	for _, modelConfig := range config.Models {
 		// Skip disabled models
 		if !modelConfig.Enabled {
@@ -210,9 +288,19 @@ func (p *imagePricing) mergeConfig(config PricingConfig) {
 	}
 }
 
-// GetImagePrice returns the price for generating an image with the specified parameters
+// GetImagePrice returns the price currently in effect for generating an image with the specified parameters
 func (p *imagePricing) GetImagePrice(model ImageModel, quality ImageQuality, size ImageSize) (float64, bool) {
-	if modelPricing, ok := p.pricingMap[model]; ok {
+	return p.GetImagePriceAt(model, quality, size, time.Now())
+}
+
+// GetImagePriceAt returns the price in effect at the given time
+// Sheets loaded from file have no schedule and always return the loaded price
+func (p *imagePricing) GetImagePriceAt(model ImageModel, quality ImageQuality, size ImageSize, at time.Time) (float64, bool) {
+	sheet := p.sheet.Load()
+	if sheet.schedule != nil {
+		return priceAt(sheet.schedule[imagePriceKey{model, quality, size}], at.Unix())
+	}
+	if modelPricing, ok := sheet.pricingMap[model]; ok {
 		if qualityPricing, ok := modelPricing[quality]; ok {
 			if price, ok := qualityPricing[size]; ok {
 				return price, true
@@ -222,13 +310,13 @@ func (p *imagePricing) GetImagePrice(model ImageModel, quality ImageQuality, siz
 	return 0, false
 }
 
-// CalculateImageCost calculates the total cost for generating multiple images
-func (p *imagePricing) CalculateImageCost(model ImageModel, quality ImageQuality, size ImageSize, count int) (float64, bool) {
-	price, ok := p.GetImagePrice(model, quality, size)
+// CalculateImageCost calculates the exact cost in USD for generating multiple images at the given time
+func (p *imagePricing) CalculateImageCost(model ImageModel, quality ImageQuality, size ImageSize, count int, at time.Time) (*big.Rat, bool) {
+	price, ok := p.GetImagePriceAt(model, quality, size, at)
 	if !ok {
-		return 0, false
+		return nil, false
 	}
-	return price * float64(count), true
+	return new(big.Rat).Mul(DecimalRat(price), new(big.Rat).SetInt64(int64(count))), true
 }
 
 // GetAllPricing returns a copy of the entire pricing map
@@ -236,7 +324,7 @@ func (p *imagePricing) GetAllPricing() map[ImageModel]map[ImageQuality]map[Image
 	// Create a deep copy to prevent external modification
 	result := make(map[ImageModel]map[ImageQuality]map[ImageSize]float64)
 
-	for model, qualities := range p.pricingMap {
+	for model, qualities := range p.sheet.Load().pricingMap {
 		result[model] = make(map[ImageQuality]map[ImageSize]float64)
 		for quality, sizes := range qualities {
 			result[model][quality] = make(map[ImageSize]float64)
@@ -249,8 +337,9 @@ func (p *imagePricing) GetAllPricing() map[ImageModel]map[ImageQuality]map[Image
 
 // GetSupportedModels returns a list of all supported models
 func (p *imagePricing) GetSupportedModels() []ImageModel {
-	models := make([]ImageModel, 0, len(p.pricingMap))
-	for model := range p.pricingMap {
+	pricingMap := p.sheet.Load().pricingMap
+	models := make([]ImageModel, 0, len(pricingMap))
+	for model := range pricingMap {
 		models = append(models, model)
 	}
 	return models
@@ -258,7 +347,7 @@ func (p *imagePricing) GetSupportedModels() []ImageModel {
 
 // GetSupportedQualities returns a list of supported qualities for a given model
 func (p *imagePricing) GetSupportedQualities(model ImageModel) []ImageQuality {
-	if modelPricing, ok := p.pricingMap[model]; ok {
+	if modelPricing, ok := p.sheet.Load().pricingMap[model]; ok {
 		qualities := make([]ImageQuality, 0, len(modelPricing))
 		for quality := range modelPricing {
 			qualities = append(qualities, quality)
@@ -270,7 +359,7 @@ func (p *imagePricing) GetSupportedQualities(model ImageModel) []ImageQuality {
 
 // GetSupportedSizes returns a list of supported sizes for a given model and quality
 func (p *imagePricing) GetSupportedSizes(model ImageModel, quality ImageQuality) []ImageSize {
-	if modelPricing, ok := p.pricingMap[model]; ok {
+	if modelPricing, ok := p.sheet.Load().pricingMap[model]; ok {
 		if qualityPricing, ok := modelPricing[quality]; ok {
 			sizes := make([]ImageSize, 0, len(qualityPricing))
 			for size := range qualityPricing {
@@ -288,7 +377,8 @@ func InitImageDefault() {
 	ImagePricing = NewImagePricing()
 }
 
-func InitImagePricing(file string) {
+// InitImagePricing initializes the global ImagePricing with pricing from file
+func InitImagePricing(file string) error {
 	ImagePricing = NewImagePricing()
-	ImagePricing.LoadFromFile(file)
+	return ImagePricing.LoadFromFile(file)
 }
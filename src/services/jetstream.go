@@ -0,0 +1,296 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultStreamName        = "billing"
+	defaultDeadLetterSubject = "billing.deadLetter"
+	defaultMaxDeliver        = 5
+	defaultDuplicateWindow   = 2 * time.Minute // 与服务端默认值一致
+)
+
+var retentionPolicies = map[string]nats.RetentionPolicy{
+	"":          nats.LimitsPolicy,
+	"limits":    nats.LimitsPolicy,
+	"interest":  nats.InterestPolicy,
+	"workqueue": nats.WorkQueuePolicy,
+}
+
+// streamName 返回配置的流名称
+func (m *NatsMQ) streamName() string {
+	if m.config.Stream != nil && m.config.Stream.Name != "" {
+		return m.config.Stream.Name
+	}
+	return defaultStreamName
+}
+
+// deadLetterSubject 返回死信主题
+func (m *NatsMQ) deadLetterSubject() string {
+	if m.config.DeadLetter != "" {
+		return m.config.DeadLetter
+	}
+	return defaultDeadLetterSubject
+}
+
+// maxDeliver 返回最大投递次数
+func (m *NatsMQ) maxDeliver() int {
+	if m.config.MaxDeliver > 0 {
+		return m.config.MaxDeliver
+	}
+	return defaultMaxDeliver
+}
+
+// RequireDuplicateWindow 要求流的重复消息检测窗口至少为 d，在 Subscribe 声明流之前调用
+func (m *NatsMQ) RequireDuplicateWindow(d time.Duration) {
+	m.duplicates = max(m.duplicates, d)
+}
+
+// duplicateWindow 返回流的重复消息检测窗口，不能超过流的 max_age
+func (m *NatsMQ) duplicateWindow() time.Duration {
+	window := max(m.duplicates, defaultDuplicateWindow)
+	if stream := m.config.Stream; stream != nil && stream.MaxAge > 0 {
+		window = min(window, time.Duration(stream.MaxAge)*time.Hour)
+	}
+	return window
+}
+
+// Subject 返回事件类型对应的发布主题
+func (m *NatsMQ) Subject(eventType EventType) string {
+	if subject := m.config.Subjects[string(eventType)]; subject != "" {
+		return subject
+	}
+	return defaultEventSubjects[eventType]
+}
+
+// streamConfig 根据配置生成期望的流配置，流需要覆盖输入、各事件和死信主题
+func (m *NatsMQ) streamConfig() (*nats.StreamConfig, error) {
+	required := []string{m.config.Topic, m.deadLetterSubject()}
+	for _, eventType := range sortedKeys(defaultEventSubjects) {
+		required = append(required, m.Subject(eventType))
+	}
+	cfg := &nats.StreamConfig{
+		Name:       m.streamName(),
+		Subjects:   required,
+		Retention:  nats.LimitsPolicy,
+		Storage:    nats.FileStorage,
+		Replicas:   1,
+		Duplicates: m.duplicateWindow(),
+	}
+	stream := m.config.Stream
+	if stream == nil {
+		return cfg, nil
+	}
+	if len(stream.Subjects) > 0 {
+		for _, subject := range required {
+			if !subjectCovered(stream.Subjects, subject) {
+				return nil, fmt.Errorf("natsmq.stream.subjects %v do not cover %s", stream.Subjects, subject)
+			}
+		}
+		cfg.Subjects = stream.Subjects
+	}
+	cfg.Retention = retentionPolicies[stream.Retention]
+	cfg.MaxAge = time.Duration(stream.MaxAge) * time.Hour
+	if stream.Replicas > 0 {
+		cfg.Replicas = stream.Replicas
+	}
+	return cfg, nil
+}
+
+// consumerConfig 根据配置生成期望的持久化消费者配置
+// 拉取模式的消费者没有投递主题和投递组
+func (m *NatsMQ) consumerConfig() *nats.ConsumerConfig {
+	cfg := &nats.ConsumerConfig{
+		Durable:       m.config.Consumer,
+		DeliverPolicy: nats.DeliverAllPolicy,
+		AckPolicy:     nats.AckExplicitPolicy,
+		AckWait:       m.ackWait(),
+		MaxDeliver:    m.maxDeliver(),
+		MaxAckPending: m.config.BufferSize,
+		FilterSubject: m.config.Topic,
+	}
+	if !m.pullMode() {
+		cfg.DeliverSubject = "_fee.deliver." + m.config.Consumer
+		cfg.DeliverGroup = m.config.WorkerGroup
+	}
+	return cfg
+}
+
+// ackWait 返回确认期限
+func (m *NatsMQ) ackWait() time.Duration {
+	return time.Minute * time.Duration(m.config.AckWaitMintues)
+}
+
+// provision 幂等地声明所需的流和持久化消费者：
+// 不存在则创建；已存在时补充缺少的主题并更新可修改的设置，
+// 保留策略、确认方式、过滤主题等不可修改的设置与配置不一致时返回错误，拒绝启动
+func (m *NatsMQ) provision() error {
+	if err := m.provisionStream(); err != nil {
+		return err
+	}
+	return m.provisionConsumer()
+}
+
+func (m *NatsMQ) provisionStream() error {
+	desired, err := m.streamConfig()
+	if err != nil {
+		return err
+	}
+	info, err := m.js.StreamInfo(desired.Name)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		if _, err := m.js.AddStream(desired); err != nil {
+			return fmt.Errorf("create stream %s: %w", desired.Name, err)
+		}
+		logrus.Infof("stream %s created, subjects: %v", desired.Name, desired.Subjects)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("fetch stream %s: %w", desired.Name, err)
+	}
+
+	current := info.Config
+	if current.Retention != desired.Retention {
+		return fmt.Errorf("stream %s has retention %s, configured %s", desired.Name, current.Retention, desired.Retention)
+	}
+	// 保留其他服务添加的主题，只补充缺少的
+	updated := current
+	updated.Subjects = slices.Clone(current.Subjects)
+	for _, subject := range desired.Subjects {
+		if !subjectCovered(updated.Subjects, subject) {
+			updated.Subjects = append(updated.Subjects, subject)
+		}
+	}
+	updated.MaxAge = desired.MaxAge
+	updated.Replicas = desired.Replicas
+	// 只放大去重窗口，其他服务需要的更长窗口保持不变
+	updated.Duplicates = max(current.Duplicates, desired.Duplicates)
+	if updated.MaxAge > 0 {
+		updated.Duplicates = min(updated.Duplicates, updated.MaxAge)
+	}
+	if slices.Equal(updated.Subjects, current.Subjects) && updated.MaxAge == current.MaxAge && updated.Replicas == current.Replicas &&
+		updated.Duplicates == current.Duplicates {
+		logrus.Infof("stream %s is up to date", desired.Name)
+		return nil
+	}
+	if _, err := m.js.UpdateStream(&updated); err != nil {
+		return fmt.Errorf("update stream %s: %w", desired.Name, err)
+	}
+	logrus.Infof("stream %s updated, subjects: %v, max age: %s, replicas: %d, duplicates: %s",
+		desired.Name, updated.Subjects, updated.MaxAge, updated.Replicas, updated.Duplicates)
+	return nil
+}
+
+func (m *NatsMQ) provisionConsumer() error {
+	stream := m.streamName()
+	desired := m.consumerConfig()
+	info, err := m.js.ConsumerInfo(stream, desired.Durable)
+	if errors.Is(err, nats.ErrConsumerNotFound) {
+		if _, err := m.js.AddConsumer(stream, desired); err != nil {
+			return fmt.Errorf("create consumer %s: %w", desired.Durable, err)
+		}
+		logrus.Infof("consumer %s created on stream %s, filter: %s", desired.Durable, stream, desired.FilterSubject)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("fetch consumer %s: %w", desired.Durable, err)
+	}
+
+	current := info.Config
+	if conflicts := consumerConflicts(&current, desired); len(conflicts) > 0 {
+		return fmt.Errorf("consumer %s is incompatible with the configuration: %s", desired.Durable, strings.Join(conflicts, "; "))
+	}
+	if current.AckWait == desired.AckWait && current.MaxDeliver == desired.MaxDeliver && current.MaxAckPending == desired.MaxAckPending {
+		logrus.Infof("consumer %s is up to date", desired.Durable)
+		return nil
+	}
+	updated := current
+	updated.AckWait = desired.AckWait
+	updated.MaxDeliver = desired.MaxDeliver
+	updated.MaxAckPending = desired.MaxAckPending
+	if _, err := m.js.UpdateConsumer(stream, &updated); err != nil {
+		return fmt.Errorf("update consumer %s: %w", desired.Durable, err)
+	}
+	logrus.Infof("consumer %s updated, ack wait: %s, max deliver: %d, max ack pending: %d",
+		desired.Durable, updated.AckWait, updated.MaxDeliver, updated.MaxAckPending)
+	return nil
+}
+
+// consumerConflicts 返回已存在的消费者与期望配置之间不可修改的差异
+// 投递主题由创建者决定，只比较推送/拉取模式
+func consumerConflicts(current, desired *nats.ConsumerConfig) []string {
+	var conflicts []string
+	if (current.DeliverSubject == "") != (desired.DeliverSubject == "") {
+		conflicts = append(conflicts, "push/pull mode differs")
+	}
+	if current.DeliverGroup != desired.DeliverGroup {
+		conflicts = append(conflicts, fmt.Sprintf("deliver group is %q, configured %q", current.DeliverGroup, desired.DeliverGroup))
+	}
+	if current.AckPolicy != desired.AckPolicy {
+		conflicts = append(conflicts, fmt.Sprintf("ack policy is %s, configured %s", current.AckPolicy, desired.AckPolicy))
+	}
+	if current.DeliverPolicy != desired.DeliverPolicy {
+		conflicts = append(conflicts, "deliver policy differs")
+	}
+	if current.FilterSubject != desired.FilterSubject {
+		conflicts = append(conflicts, fmt.Sprintf("filter subject is %q, configured %q", current.FilterSubject, desired.FilterSubject))
+	}
+	return conflicts
+}
+
+// subjectCovered 判断 subject 是否被 patterns 中的某个主题（支持 * 和 > 通配符）覆盖
+func subjectCovered(patterns []string, subject string) bool {
+	tokens := strings.Split(subject, ".")
+	for _, pattern := range patterns {
+		if subjectMatches(strings.Split(pattern, "."), tokens) {
+			return true
+		}
+	}
+	return false
+}
+
+func subjectMatches(pattern, tokens []string) bool {
+	for i, p := range pattern {
+		if p == ">" {
+			return len(tokens) > i
+		}
+		if i >= len(tokens) || (p != "*" && p != tokens[i]) {
+			return false
+		}
+	}
+	return len(pattern) == len(tokens)
+}
+
+// headerValue 头部值不能包含换行
+var headerValue = strings.NewReplacer("\r", " ", "\n", " ")
+
+// deadLetter 将无法处理的消息连同原因转发到死信主题，消息体保持原样以便修正后重放
+func (m *NatsMQ) deadLetter(msg *nats.Msg, reason RejectReason, cause error) error {
+	dead := nats.NewMsg(m.deadLetterSubject())
+	dead.Data = msg.Data
+	dead.Header.Set("Fee-Reason", string(reason))
+	dead.Header.Set("Fee-Error", headerValue.Replace(cause.Error()))
+	if contentType := msg.Header.Get("Content-Type"); contentType != "" {
+		dead.Header.Set("Content-Type", contentType)
+	}
+	dead.Header.Set("Fee-Subject", msg.Subject)
+	if meta, err := msg.Metadata(); err == nil {
+		dead.Header.Set("Fee-Stream", meta.Stream)
+		dead.Header.Set("Fee-Stream-Sequence", strconv.FormatUint(meta.Sequence.Stream, 10))
+		dead.Header.Set("Fee-Deliveries", strconv.FormatUint(meta.NumDelivered, 10))
+	}
+	if _, err := m.js.PublishMsg(dead); err != nil {
+		logrus.Errorf("Failed to publish message to dead letter %s: %v", dead.Subject, err)
+		return err
+	}
+	logrus.Warnf("message moved to dead letter %s, reason: %s, error: %v", dead.Subject, reason, cause)
+	return nil
+}
@@ -0,0 +1,120 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/deepissue/fee_server/models"
+	"xorm.io/xorm"
+)
+
+// MarginDimension 毛利统计维度
+type MarginDimension string
+
+const (
+	MarginByModel    MarginDimension = "model_id"
+	MarginByProvider MarginDimension = "actual_provider_id"
+	MarginByNode     MarginDimension = "node_id"
+)
+
+func (d MarginDimension) Valid() bool {
+	switch d {
+	case MarginByModel, MarginByProvider, MarginByNode:
+		return true
+	}
+	return false
+}
+
+const (
+	defaultBelowCostLimit = 100
+	maxBelowCostLimit     = 1000
+)
+
+// MarginSummary 某个维度下的毛利汇总（金额单位：微代币）
+// 成本、毛利和低于成本的次数只统计有上游成本的调用，Margin = CostedRevenue - Cost
+type MarginSummary struct {
+	Key           string `json:"key" xorm:"'dim_key'"`
+	Calls         int64  `json:"calls" xorm:"'calls'"`
+	Revenue       int64  `json:"revenue" xorm:"'revenue'"`
+	Uncosted      int64  `json:"uncosted" xorm:"'uncosted'"`             // 没有上游成本的调用次数
+	CostedRevenue int64  `json:"costed_revenue" xorm:"'costed_revenue'"` // 有上游成本的调用的扣费
+	Cost          int64  `json:"cost" xorm:"'cost'"`
+	Margin        int64  `json:"margin" xorm:"'margin'"`
+	BelowCost     int64  `json:"below_cost" xorm:"'below_cost'"` // 低于成本计费的调用次数
+}
+
+// MarginService 基于 user_consume 的成本与毛利统计
+type MarginService struct {
+	xorm      xorm.EngineInterface
+	partition *ConsumePartition
+}
+
+func NewMarginService(xorm xorm.EngineInterface, partition *ConsumePartition) *MarginService {
+	return &MarginService{xorm: xorm, partition: partition}
+}
+
+// Summary 统计 [start, end) 时间段内按维度分组的毛利，跨月分表汇总
+func (m *MarginService) Summary(dim MarginDimension, start, end time.Time) ([]MarginSummary, error) {
+	if !dim.Valid() {
+		return nil, fmt.Errorf("unsupported margin dimension: %s", dim)
+	}
+
+	merged := map[string]*MarginSummary{}
+	var keys []string
+	err := m.partition.Each(start, end, func(tables models.ConsumeTables) error {
+		sql := fmt.Sprintf(`SELECT %[1]s AS dim_key, COUNT(*) AS calls, SUM(total_consumed) AS revenue,
+			SUM(CASE WHEN has_cost = 1 THEN 0 ELSE 1 END) AS uncosted,
+			SUM(CASE WHEN has_cost = 1 THEN total_consumed ELSE 0 END) AS costed_revenue,
+			SUM(CASE WHEN has_cost = 1 THEN provider_cost ELSE 0 END) AS cost,
+			SUM(CASE WHEN has_cost = 1 THEN margin ELSE 0 END) AS margin,
+			SUM(CASE WHEN has_cost = 1 AND margin < 0 THEN 1 ELSE 0 END) AS below_cost
+			FROM %[2]s WHERE created_at >= ? AND created_at < ? GROUP BY %[1]s`, dim, tables.Record)
+
+		var part []MarginSummary
+		if err := m.xorm.SQL(sql, start.Unix(), end.Unix()).Find(&part); err != nil {
+			return err
+		}
+		for _, row := range part {
+			summary, ok := merged[row.Key]
+			if !ok {
+				summary = &MarginSummary{Key: row.Key}
+				merged[row.Key] = summary
+				keys = append(keys, row.Key)
+			}
+			summary.Calls += row.Calls
+			summary.Revenue += row.Revenue
+			summary.Uncosted += row.Uncosted
+			summary.CostedRevenue += row.CostedRevenue
+			summary.Cost += row.Cost
+			summary.Margin += row.Margin
+			summary.BelowCost += row.BelowCost
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(keys)
+	result := make([]MarginSummary, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, *merged[key])
+	}
+	return result, nil
+}
+
+// BelowCost 列出 [start, end) 时间段内低于成本计费的记录，按时间倒序
+func (m *MarginService) BelowCost(start, end time.Time, limit int) ([]models.UserConsumeRecord, error) {
+	records, err := m.partition.FindRecords(start, end, "has_cost = 1 AND margin < 0")
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreatedAt > records[j].CreatedAt
+	})
+	if len(records) > limit {
+		records = records[:limit]
+	}
+	return records, nil
+}
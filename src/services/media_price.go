@@ -0,0 +1,330 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	PriceStatusEnabled  = "enabled"
+	PriceStatusDisabled = "disabled"
+
+	priceSourceDatabase = "database"
+)
+
+// RefreshMediaPricing 从 image_price / video_price 加载全部价格版本并替换当前价格表，at 决定价格表展示的当前价格
+// 按调用时间查询时，同一规格存在多个覆盖该时刻的版本以 valid_from 最新的为准；表为空时保留当前价格表
+func (m *PriceService) RefreshMediaPricing(at time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var images []ImagePrice
+	if err := m.xorm.Asc("valid_from", "id").Find(&images); err != nil {
+		logrus.Errorf("load image prices: %v", err)
+		return err
+	}
+	var videos []VideoPrice
+	if err := m.xorm.Asc("valid_from", "id").Find(&videos); err != nil {
+		logrus.Errorf("load video prices: %v", err)
+		return err
+	}
+
+	var errs []error
+	if len(images) == 0 {
+		logrus.Warn("no image prices in database, keeping current image pricing")
+	} else if err := ImagePricing.LoadPrices(images, at); err != nil {
+		errs = append(errs, fmt.Errorf("image prices: %w", err))
+	}
+	if len(videos) == 0 {
+		logrus.Warn("no video prices in database, keeping current video pricing")
+	} else if err := VideoPricing.LoadPrices(videos, at); err != nil {
+		errs = append(errs, fmt.Errorf("video prices: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// FetchImagePrice 获取 at 时刻生效的图片单价（美元/张）
+func (m *PriceService) FetchImagePrice(model ImageModel, quality ImageQuality, size ImageSize, at time.Time) (float64, bool) {
+	return ImagePricing.GetImagePriceAt(model, quality, size, at)
+}
+
+// FetchVideoPrice 获取 at 时刻生效的视频单价（美元/秒）
+func (m *PriceService) FetchVideoPrice(model VideoModel, resolution VideoResolution, at time.Time) (float64, bool) {
+	return VideoPricing.GetVideoPriceAt(model, resolution, at)
+}
+
+// ImportMediaPricing 将 YAML 价格表写入数据库，在 [validFrom, validTo) 内生效，validTo 为零值表示长期有效
+func (m *PriceService) ImportMediaPricing(image *PricingConfig, video *VideoPricingConfig, validFrom, validTo time.Time) error {
+	if !validTo.IsZero() && !validTo.After(validFrom) {
+		return fmt.Errorf("valid_to %s must be after valid_from %s", validTo.Format(time.DateTime), validFrom.Format(time.DateTime))
+	}
+	session := m.xorm.NewSession()
+	defer session.Close()
+	if err := session.Begin(); err != nil {
+		return err
+	}
+	if image != nil {
+		if err := image.Validate(); err != nil {
+			return fmt.Errorf("invalid image pricing: %w", err)
+		}
+		if rows := image.Rows(validFrom, validTo); len(rows) > 0 {
+			if _, err := session.Insert(&rows); err != nil {
+				logrus.Errorf("insert image prices: %v", err)
+				return err
+			}
+		}
+	}
+	if video != nil {
+		if err := video.Validate(); err != nil {
+			return fmt.Errorf("invalid video pricing: %w", err)
+		}
+		if rows := video.Rows(validFrom, validTo); len(rows) > 0 {
+			if _, err := session.Insert(&rows); err != nil {
+				logrus.Errorf("insert video prices: %v", err)
+				return err
+			}
+		}
+	}
+	return session.Commit()
+}
+
+// priceWindow 一个价格版本及其生效区间 [validFrom, validTo)，validTo 为 0 表示长期有效
+type priceWindow struct {
+	validFrom int64
+	validTo   int64
+	price     float64
+	disabled  bool
+}
+
+func (w priceWindow) contains(at int64) bool {
+	return w.validFrom <= at && (w.validTo == 0 || at < w.validTo)
+}
+
+// priceAt 返回 at 时刻生效的价格，windows 按 valid_from 升序排列，多个版本覆盖同一时刻时以后生效的为准
+func priceAt(windows []priceWindow, at int64) (float64, bool) {
+	for i := len(windows) - 1; i >= 0; i-- {
+		if windows[i].contains(at) {
+			return windows[i].price, !windows[i].disabled
+		}
+	}
+	return 0, false
+}
+
+func newPriceWindow(id, validFrom, validTo int64, price float64, status string) (priceWindow, error) {
+	if !(price > 0) {
+		return priceWindow{}, fmt.Errorf("price %d: invalid price %v", id, price)
+	}
+	if validTo != 0 && validTo <= validFrom {
+		return priceWindow{}, fmt.Errorf("price %d: valid_to %d must be after valid_from %d", id, validTo, validFrom)
+	}
+	return priceWindow{validFrom: validFrom, validTo: validTo, price: price, disabled: status == PriceStatusDisabled}, nil
+}
+
+// priceVersion 以 at 时刻已生效的最新版本时间作为数据库价格表的版本号
+func priceVersion(validFrom, lastUpdate int64) PriceSheetInfo {
+	return PriceSheetInfo{
+		Version:     strconv.FormatInt(validFrom, 10),
+		LastUpdated: time.Unix(lastUpdate, 0).Format(time.RFC3339),
+		Source:      priceSourceDatabase,
+		LoadedAt:    time.Now(),
+	}
+}
+
+type imagePriceKey struct {
+	model   ImageModel
+	quality ImageQuality
+	size    ImageSize
+}
+
+type videoPriceKey struct {
+	model      VideoModel
+	resolution VideoResolution
+}
+
+// LoadPrices 用数据库价格版本替换当前价格表，rows 需按 valid_from 升序排列，at 时刻生效的价格作为当前价格
+func (p *imagePricing) LoadPrices(rows []ImagePrice, at time.Time) error {
+	sheet := &imagePriceSheet{
+		pricingMap: map[ImageModel]map[ImageQuality]map[ImageSize]float64{},
+		schedule:   map[imagePriceKey][]priceWindow{},
+	}
+	var validFrom, lastUpdate int64
+	for _, row := range rows {
+		if row.Model == "" || row.Quality == "" || row.Size == "" {
+			return fmt.Errorf("image price %d: model, quality and size are required", row.Id)
+		}
+		window, err := newPriceWindow(row.Id, row.ValidFrom, row.ValidTo, row.Price, row.Status)
+		if err != nil {
+			return fmt.Errorf("image %w", err)
+		}
+		key := imagePriceKey{ImageModel(row.Model), ImageQuality(row.Quality), ImageSize(row.Size)}
+		sheet.schedule[key] = append(sheet.schedule[key], window)
+		if window.contains(at.Unix()) {
+			validFrom = max(validFrom, row.ValidFrom)
+			lastUpdate = max(lastUpdate, row.LastUpdate)
+		}
+	}
+	for key, windows := range sheet.schedule {
+		price, ok := priceAt(windows, at.Unix())
+		if !ok {
+			continue
+		}
+		if sheet.pricingMap[key.model] == nil {
+			sheet.pricingMap[key.model] = make(map[ImageQuality]map[ImageSize]float64)
+		}
+		if sheet.pricingMap[key.model][key.quality] == nil {
+			sheet.pricingMap[key.model][key.quality] = make(map[ImageSize]float64)
+		}
+		sheet.pricingMap[key.model][key.quality][key.size] = price
+	}
+	sheet.info = priceVersion(validFrom, lastUpdate)
+	p.sheet.Store(sheet)
+	return nil
+}
+
+// LoadPrices 用数据库价格版本替换当前价格表，rows 需按 valid_from 升序排列，at 时刻生效的价格作为当前价格
+func (p *videoPricing) LoadPrices(rows []VideoPrice, at time.Time) error {
+	sheet := &videoPriceSheet{
+		pricingMap: map[VideoModel]map[VideoResolution]float64{},
+		schedule:   map[videoPriceKey][]priceWindow{},
+	}
+	var validFrom, lastUpdate int64
+	for _, row := range rows {
+		if row.Model == "" || row.Resolution == "" {
+			return fmt.Errorf("video price %d: model and resolution are required", row.Id)
+		}
+		window, err := newPriceWindow(row.Id, row.ValidFrom, row.ValidTo, row.Price, row.Status)
+		if err != nil {
+			return fmt.Errorf("video %w", err)
+		}
+		key := videoPriceKey{VideoModel(row.Model), VideoResolution(row.Resolution)}
+		sheet.schedule[key] = append(sheet.schedule[key], window)
+		if window.contains(at.Unix()) {
+			validFrom = max(validFrom, row.ValidFrom)
+			lastUpdate = max(lastUpdate, row.LastUpdate)
+		}
+	}
+	for key, windows := range sheet.schedule {
+		price, ok := priceAt(windows, at.Unix())
+		if !ok {
+			continue
+		}
+		if sheet.pricingMap[key.model] == nil {
+			sheet.pricingMap[key.model] = make(map[VideoResolution]float64)
+		}
+		sheet.pricingMap[key.model][key.resolution] = price
+	}
+	sheet.info = priceVersion(validFrom, lastUpdate)
+	p.sheet.Store(sheet)
+	return nil
+}
+
+// unixOrZero 零值时间表示不限，记为 0
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// Rows 将 YAML 价格表转换为数据库记录，未启用的模型记为 disabled
+func (c PricingConfig) Rows(validFrom, validTo time.Time) []ImagePrice {
+	now := time.Now().Unix()
+	var rows []ImagePrice
+	for _, modelConfig := range c.Models {
+		status := PriceStatusEnabled
+		if !modelConfig.Enabled {
+			status = PriceStatusDisabled
+		}
+		for _, qualityConfig := range modelConfig.Qualities {
+			for _, sizeConfig := range qualityConfig.Sizes {
+				rows = append(rows, ImagePrice{
+					Model:      modelConfig.Model,
+					Quality:    qualityConfig.Quality,
+					Size:       sizeConfig.Size,
+					Price:      sizeConfig.Price,
+					ValidFrom:  validFrom.Unix(),
+					ValidTo:    unixOrZero(validTo),
+					Status:     status,
+					LastUpdate: now,
+				})
+			}
+		}
+	}
+	return rows
+}
+
+// Rows 将 YAML 价格表转换为数据库记录，未启用的模型记为 disabled
+func (c VideoPricingConfig) Rows(validFrom, validTo time.Time) []VideoPrice {
+	now := time.Now().Unix()
+	var rows []VideoPrice
+	for _, modelConfig := range c.Models {
+		status := PriceStatusEnabled
+		if !modelConfig.Enabled {
+			status = PriceStatusDisabled
+		}
+		for _, resolutionConfig := range modelConfig.Resolutions {
+			rows = append(rows, VideoPrice{
+				Model:      modelConfig.Model,
+				Resolution: resolutionConfig.Resolution,
+				Price:      resolutionConfig.Price,
+				ValidFrom:  validFrom.Unix(),
+				ValidTo:    unixOrZero(validTo),
+				Status:     status,
+				LastUpdate: now,
+			})
+		}
+	}
+	return rows
+}
+
+// Export 将当前价格表导出为 YAML 配置结构
+func (p *imagePricing) Export() PricingConfig {
+	sheet := p.sheet.Load()
+	config := PricingConfig{Version: sheet.info.Version, LastUpdated: sheet.info.LastUpdated}
+	if config.Version == "" {
+		config.Version = sheet.info.Source
+	}
+	for _, model := range sortedKeys(sheet.pricingMap) {
+		modelConfig := ModelConfig{Model: string(model), Enabled: true}
+		for _, quality := range sortedKeys(sheet.pricingMap[model]) {
+			qualityConfig := QualityConfig{Quality: string(quality)}
+			for _, size := range sortedKeys(sheet.pricingMap[model][quality]) {
+				qualityConfig.Sizes = append(qualityConfig.Sizes, SizeConfig{Size: string(size), Price: sheet.pricingMap[model][quality][size]})
+			}
+			modelConfig.Qualities = append(modelConfig.Qualities, qualityConfig)
+		}
+		config.Models = append(config.Models, modelConfig)
+	}
+	return config
+}
+
+// Export 将当前价格表导出为 YAML 配置结构
+func (p *videoPricing) Export() VideoPricingConfig {
+	sheet := p.sheet.Load()
+	config := VideoPricingConfig{Version: sheet.info.Version, LastUpdated: sheet.info.LastUpdated}
+	if config.Version == "" {
+		config.Version = sheet.info.Source
+	}
+	for _, model := range sortedKeys(sheet.pricingMap) {
+		modelConfig := VideoModelConfig{Model: string(model), Enabled: true}
+		for _, resolution := range sortedKeys(sheet.pricingMap[model]) {
+			modelConfig.Resolutions = append(modelConfig.Resolutions, VideoResolutionConfig{Resolution: string(resolution), Price: sheet.pricingMap[model][resolution]})
+		}
+		config.Models = append(config.Models, modelConfig)
+	}
+	return config
+}
+
+func sortedKeys[K ~string, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
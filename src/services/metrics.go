@@ -0,0 +1,126 @@
+package services
+
+import (
+	"github.com/deepissue/fee_server/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+// 计费流水线的 Prometheus 指标，注册在默认 registry 中，与 Go 运行时、进程指标一起通过 /metrics 输出
+var (
+	metricMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fee_messages_total",
+		Help: "Billing messages handled, by result (received, acked, nakd, dead_lettered).",
+	}, []string{"result"})
+	metricDecodeFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fee_decode_failures_total",
+		Help: "Billing messages that could not be decoded.",
+	})
+	metricRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fee_rejected_total",
+		Help: "Messages moved to the dead-letter subject, by reason.",
+	}, []string{"reason"})
+	metricPriceNotFound = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fee_price_not_found_total",
+		Help: "Usage reports rejected because the model has no price.",
+	}, []string{"model_id"})
+	metricWalletNotFound = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fee_wallet_not_found_total",
+		Help: "Deductions that failed because the user has no wallet.",
+	})
+	metricUnknownCallerKey = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fee_unknown_caller_key_total",
+		Help: "Calls billed to caller because their caller_key is not in api_key.",
+	})
+	metricTxRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fee_db_tx_retries_total",
+		Help: "Deduction transactions retried after a deadlock or lock wait timeout.",
+	})
+	metricBilled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fee_billed_micro_coins_total",
+		Help: "Micro-coins billed, by model and actual provider.",
+	}, []string{"model_id", "actual_provider_id"})
+	metricNatsEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fee_nats_connection_events_total",
+		Help: "NATS connection events (disconnected, reconnected, closed).",
+	}, []string{"event"})
+	metricOutbox = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fee_outbox_publishes_total",
+		Help: "Outbox messages published to NATS, by result (sent, failed).",
+	}, []string{"result"})
+	metricKeyLimitExceeded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fee_key_limit_exceeded_total",
+		Help: "Deductions that left an API key over its spending limit, by period (daily, monthly).",
+	}, []string{"period"})
+	metricMemberLimitExceeded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fee_member_limit_exceeded_total",
+		Help: "Deductions that left an organisation member over its spending limit, by period (daily, monthly).",
+	}, []string{"period"})
+	metricBudgetExceeded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fee_budget_exceeded_total",
+		Help: "Budgets used up in their window, by action (flag, reject).",
+	}, []string{"action"})
+	metricDeductSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "fee_deduction_duration_seconds",
+		Help:    "Time spent deducting fees for one message.",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+	})
+)
+
+// txMetrics 扣费事务中产生的计数，事务提交后由 record 计入指标；
+// 死锁重试或回滚的事务丢弃其计数，同一调用不会重复计数
+type txMetrics struct {
+	billed      []*models.UserConsumeRecord
+	keyLimit    []string // 超过限额的周期
+	memberLimit []string
+	budget      []string // 用尽的预算的 action
+}
+
+func (t *txMetrics) record() {
+	for _, record := range t.billed {
+		metricBilled.WithLabelValues(record.ModelId, record.ActualProviderId).Add(float64(record.TotalConsumed))
+	}
+	for _, period := range t.keyLimit {
+		metricKeyLimitExceeded.WithLabelValues(period).Inc()
+	}
+	for _, period := range t.memberLimit {
+		metricMemberLimitExceeded.WithLabelValues(period).Inc()
+	}
+	for _, action := range t.budget {
+		metricBudgetExceeded.WithLabelValues(action).Inc()
+	}
+}
+
+var (
+	descQueueDepth = prometheus.NewDesc("fee_queue_depth",
+		"Messages buffered in cacheChan waiting for a handler.", nil, nil)
+	descQueueCapacity = prometheus.NewDesc("fee_queue_capacity",
+		"Capacity of cacheChan.", nil, nil)
+	descOutboxPending = prometheus.NewDesc("fee_outbox_pending",
+		"Outbox messages waiting to be published.", nil, nil)
+)
+
+// serviceCollector 抓取时计算的瞬时指标：消息缓冲区深度和待发布的 outbox 消息数
+// 查询 outbox 失败时本次抓取不输出 fee_outbox_pending
+type serviceCollector struct {
+	mq     *NatsMQ
+	outbox *OutboxRelay
+}
+
+func (c *serviceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descQueueDepth
+	ch <- descQueueCapacity
+	ch <- descOutboxPending
+}
+
+func (c *serviceCollector) Collect(ch chan<- prometheus.Metric) {
+	depth, capacity := c.mq.QueueDepth()
+	ch <- prometheus.MustNewConstMetric(descQueueDepth, prometheus.GaugeValue, float64(depth))
+	ch <- prometheus.MustNewConstMetric(descQueueCapacity, prometheus.GaugeValue, float64(capacity))
+	if pending, err := c.outbox.Pending(); err != nil {
+		logrus.Errorf("count pending outbox: %v", err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(descOutboxPending, prometheus.GaugeValue, float64(pending))
+	}
+}
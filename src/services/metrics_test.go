@@ -0,0 +1,18 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTxMetricsRecord(t *testing.T) {
+	before := testutil.ToFloat64(metricBudgetExceeded.WithLabelValues("notify"))
+	// 事务回滚时计数随 txMetrics 丢弃，只有提交后的 record 计入
+	_ = &txMetrics{budget: []string{"notify"}}
+	committed := &txMetrics{budget: []string{"notify"}}
+	committed.record()
+	if got := testutil.ToFloat64(metricBudgetExceeded.WithLabelValues("notify")) - before; got != 1 {
+		t.Fatalf("budget exceeded counted %v times, want 1", got)
+	}
+}
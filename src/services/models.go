@@ -1,8 +1,10 @@
 package services
 
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
+	"time"
 )
 
 type ReportType string
@@ -13,13 +15,14 @@ const (
 	VideoReportType ReportType = "video"
 )
 
-// TokenUsage 记录 token 使用情况
+// ImageUsage 记录图片生成情况
 type ImageUsage struct {
 	Quality string `json:"quality"`
 	Size    string `json:"size"`
+	Count   int    `json:"count,omitempty"` // 图片数，未上报时按 1 张计
 }
 
-// VideoUsage 记录 token 使用情况
+// VideoUsage 记录视频生成情况
 type VideoUsage struct {
 	Seconds float64 `json:"seconds"`
 	Size    string  `json:"size"`
@@ -58,13 +61,77 @@ type LLMCallData struct {
 	Stream           bool       `json:"stream"`
 	ReportType       ReportType `json:"report_type"`
 	TokenUsage       any        `json:"token_usage"`
+	Timestamp        int64      `json:"timestamp,omitempty"` // 调用发生时间（秒），按该时刻生效的价格计费
 }
 
+// CalledAt 返回调用发生时间，上报未携带时间时按当前时间计
+func (l *LLMCallData) CalledAt() time.Time {
+	if l.Timestamp <= 0 {
+		return time.Now()
+	}
+	return time.Unix(l.Timestamp, 0)
+}
+
+// UserId 返回 Caller 中的用户id，上报需先通过 Validate
 func (l *LLMCallData) UserId() int64 {
-	user, _ := strconv.ParseInt(l.Caller, 10, 64)
+	user, _ := l.ParseUserId()
 	return user
 }
 
+// ParseUserId 解析 Caller 中的用户id，必须是正整数
+func (l *LLMCallData) ParseUserId() (int64, error) {
+	user, err := strconv.ParseInt(l.Caller, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if user <= 0 {
+		return 0, fmt.Errorf("user id must be positive, got %d", user)
+	}
+	return user, nil
+}
+
+// TextUsage 将 TokenUsage 解析为文本用量
+func (l *LLMCallData) TextUsage() (TokenUsage, error) {
+	var usage TokenUsage
+	if err := l.decodeUsage(&usage); err != nil {
+		return usage, err
+	}
+	return usage, nil
+}
+
+// ImageUsage 将 TokenUsage 解析为图片用量
+func (l *LLMCallData) ImageUsage() (ImageUsage, error) {
+	var usage ImageUsage
+	if err := l.decodeUsage(&usage); err != nil {
+		return usage, err
+	}
+	if usage.Count <= 0 {
+		usage.Count = 1
+	}
+	return usage, nil
+}
+
+// VideoUsage 将 TokenUsage 解析为视频用量
+func (l *LLMCallData) VideoUsage() (VideoUsage, error) {
+	var usage VideoUsage
+	if err := l.decodeUsage(&usage); err != nil {
+		return usage, err
+	}
+	return usage, nil
+}
+
+// decodeUsage TokenUsage 反序列化后是 map，需要重新编码成具体类型
+func (l *LLMCallData) decodeUsage(out any) error {
+	if l.TokenUsage == nil {
+		return fmt.Errorf("token usage is empty: %s", l.Id)
+	}
+	data, err := json.Marshal(l.TokenUsage)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
 func (m LLMCallData) String() string {
 	return fmt.Sprintf("<LLMCallData: id:%s, model:%s, caller:%s, node:%s>", m.Id, m.Model, m.Caller, m.NodeId)
 }
@@ -86,3 +153,70 @@ type ModelsInfo struct {
 func (o *ModelsInfo) TableName() string {
 	return "models_info"
 }
+
+// ModelPrice 模型售价的生效版本，[valid_from, valid_to) 内覆盖 models_info 中的价格，valid_to 为 0 表示长期有效
+type ModelPrice struct {
+	Id          int64  `json:"id" xorm:"'id' pk autoincr BIGINT(20)"`
+	ModelId     string `json:"model_id" xorm:"'model_id' not null index(idx_model_price) comment('模型ID') VARCHAR(128)"`
+	InputPrice  int    `json:"input_price" xorm:"'input_price' INT(10)"`
+	OutputPrice int    `json:"output_price" xorm:"'output_price' INT(10)"`
+	CachePrice  int    `json:"cache_price" xorm:"'cache_price' INT(10)"`
+	ValidFrom   int64  `json:"valid_from" xorm:"'valid_from' not null index(idx_model_price) comment('生效时间') BIGINT(20)"`
+	ValidTo     int64  `json:"valid_to" xorm:"'valid_to' default 0 comment('失效时间') BIGINT(20)"`
+	LastUpdate  int64  `json:"last_update" xorm:"'last_update' comment('最后更新时间') BIGINT(20)"`
+}
+
+func (o *ModelPrice) TableName() string {
+	return "model_price"
+}
+
+// ProviderPrice 上游服务商成本价，按实际服务商id和实际模型区分，[valid_from, valid_to) 内生效
+type ProviderPrice struct {
+	Id               int64  `json:"id" xorm:"'id' pk autoincr BIGINT(20)"`
+	ActualProviderId string `json:"actual_provider_id" xorm:"'actual_provider_id' not null unique(uk_provider_model) comment('实际服务商id') VARCHAR(64)"`
+	ActualModel      string `json:"actual_model" xorm:"'actual_model' not null unique(uk_provider_model) comment('实际模型') VARCHAR(128)"`
+	InputPrice       int    `json:"input_price" xorm:"'input_price' INT(10)"`
+	OutputPrice      int    `json:"output_price" xorm:"'output_price' INT(10)"`
+	CachePrice       int    `json:"cache_price" xorm:"'cache_price' INT(10)"`
+	ValidFrom        int64  `json:"valid_from" xorm:"'valid_from' not null default 0 unique(uk_provider_model) comment('生效时间') BIGINT(20)"`
+	ValidTo          int64  `json:"valid_to" xorm:"'valid_to' default 0 comment('失效时间') BIGINT(20)"`
+	Status           string `json:"status" xorm:"'status' comment('状态') VARCHAR(12)"`
+	LastUpdate       int64  `json:"last_update" xorm:"'last_update' comment('最后更新时间') BIGINT(20)"`
+}
+
+func (o *ProviderPrice) TableName() string {
+	return "provider_price"
+}
+
+// ImagePrice 图片生成价格（美元/张），按 模型 × 质量 × 尺寸，[valid_from, valid_to) 内生效
+type ImagePrice struct {
+	Id         int64   `json:"id" xorm:"'id' pk autoincr BIGINT(20)"`
+	Model      string  `json:"model" xorm:"'model' not null index(idx_image_price) comment('模型') VARCHAR(64)"`
+	Quality    string  `json:"quality" xorm:"'quality' not null index(idx_image_price) comment('质量') VARCHAR(32)"`
+	Size       string  `json:"size" xorm:"'size' not null index(idx_image_price) comment('尺寸') VARCHAR(32)"`
+	Price      float64 `json:"price" xorm:"'price' comment('单价(美元)') DOUBLE"`
+	ValidFrom  int64   `json:"valid_from" xorm:"'valid_from' not null comment('生效时间') BIGINT(20)"`
+	ValidTo    int64   `json:"valid_to" xorm:"'valid_to' default 0 comment('失效时间') BIGINT(20)"`
+	Status     string  `json:"status" xorm:"'status' comment('状态') VARCHAR(12)"`
+	LastUpdate int64   `json:"last_update" xorm:"'last_update' comment('最后更新时间') BIGINT(20)"`
+}
+
+func (o *ImagePrice) TableName() string {
+	return "image_price"
+}
+
+// VideoPrice 视频生成价格（美元/秒），按 模型 × 分辨率，[valid_from, valid_to) 内生效
+type VideoPrice struct {
+	Id         int64   `json:"id" xorm:"'id' pk autoincr BIGINT(20)"`
+	Model      string  `json:"model" xorm:"'model' not null index(idx_video_price) comment('模型') VARCHAR(64)"`
+	Resolution string  `json:"resolution" xorm:"'resolution' not null index(idx_video_price) comment('分辨率') VARCHAR(32)"`
+	Price      float64 `json:"price" xorm:"'price' comment('每秒单价(美元)') DOUBLE"`
+	ValidFrom  int64   `json:"valid_from" xorm:"'valid_from' not null comment('生效时间') BIGINT(20)"`
+	ValidTo    int64   `json:"valid_to" xorm:"'valid_to' default 0 comment('失效时间') BIGINT(20)"`
+	Status     string  `json:"status" xorm:"'status' comment('状态') VARCHAR(12)"`
+	LastUpdate int64   `json:"last_update" xorm:"'last_update' comment('最后更新时间') BIGINT(20)"`
+}
+
+func (o *VideoPrice) TableName() string {
+	return "video_price"
+}
@@ -0,0 +1,41 @@
+package services
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+)
+
+// Money 金额，单位为微代币。计费全程使用整数或有理数运算，不经过 float64
+//
+// 取整规则：
+//   - 文本调用按 token 数 × 每 token 微代币单价计费，结果本身是整数，不需要取整；
+//   - 以美元计价的图片/视频调用先用有理数精确计算 单价 × 数量(秒数) × 汇率，每次调用只取整一次（按调用取整，而不是按行取整）；
+//   - 取整方式为四舍五入（0.5 远离零），因此一次调用的费用等于其各部分精确值之和取整，与拆分顺序无关。
+type Money int64
+
+// Micro 返回微代币数
+func (m Money) Micro() int64 {
+	return int64(m)
+}
+
+// String 以代币为单位输出，保留 6 位小数
+func (m Money) String() string {
+	return new(big.Rat).SetFrac64(int64(m), MICRO).FloatString(6)
+}
+
+// MoneyFromRat 将精确的微代币金额按四舍五入（远离零）取整，超出 int64 范围时返回错误
+func MoneyFromRat(r *big.Rat) (Money, error) {
+	n, err := strconv.ParseInt(r.FloatString(0), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("amount %s micro-coins out of range: %w", r.FloatString(6), err)
+	}
+	return Money(n), nil
+}
+
+// DecimalRat 按 float64 的最短十进制表示构造有理数，价格表中的 0.011 即为精确的 11/1000
+// 价格和秒数以十进制录入，按录入值而不是其二进制近似值计算
+func DecimalRat(f float64) *big.Rat {
+	r, _ := new(big.Rat).SetString(strconv.FormatFloat(f, 'f', -1, 64))
+	return r
+}
@@ -0,0 +1,226 @@
+package services
+
+import (
+	"math"
+	"math/big"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+const testMicroCoinsPerUSD = 1_000_000
+
+func TestCalculateTextCost(t *testing.T) {
+	cases := []struct {
+		name  string
+		usage TokenUsage
+		price PriceInfo
+		want  Money
+	}{
+		{"zero usage", TokenUsage{}, PriceInfo{InputPrice: 3, OutputPrice: 15}, 0},
+		{"input only", TokenUsage{InputTokens: 1000}, PriceInfo{InputPrice: 3, OutputPrice: 15}, 3000},
+		{"output only", TokenUsage{OutputTokens: 200}, PriceInfo{InputPrice: 3, OutputPrice: 15}, 3000},
+		{"input and output", TokenUsage{InputTokens: 1234, OutputTokens: 567}, PriceInfo{InputPrice: 2, OutputPrice: 8}, 1234*2 + 567*8},
+		{"cache tokens are not billed", TokenUsage{InputTokens: 10, CacheTokens: 1000}, PriceInfo{InputPrice: 1, CachePrice: 1}, 10},
+		{"free model", TokenUsage{InputTokens: 1000, OutputTokens: 1000}, PriceInfo{}, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := CalculateTextCost(c.usage, c.price)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("CalculateTextCost(%+v, %s) = %d, want %d", c.usage, c.price, got, c.want)
+			}
+		})
+	}
+}
+
+// 文本费用等于输入、输出两部分分别计费之和
+func TestCalculateTextCostSumOfParts(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		usage := TokenUsage{InputTokens: r.Int63n(1_000_000), OutputTokens: r.Int63n(1_000_000)}
+		price := PriceInfo{InputPrice: Money(r.Int63n(100)), OutputPrice: Money(r.Int63n(100))}
+
+		total, err := CalculateTextCost(usage, price)
+		if err != nil {
+			t.Fatal(err)
+		}
+		input, _ := CalculateTextCost(TokenUsage{InputTokens: usage.InputTokens}, price)
+		output, _ := CalculateTextCost(TokenUsage{OutputTokens: usage.OutputTokens}, price)
+		if total != input+output {
+			t.Fatalf("usage %+v price %s: total %d != input %d + output %d", usage, price, total, input, output)
+		}
+	}
+}
+
+// token 数 × 单价或两部分之和超出 int64 时返回错误，不能回绕成负数
+func TestCalculateTextCostOverflow(t *testing.T) {
+	if _, err := CalculateTokenCost(math.MaxInt64/2, 2); err != nil {
+		t.Fatalf("%d should fit: %v", math.MaxInt64/2*2, err)
+	}
+	if cost, err := CalculateTokenCost(math.MaxInt64/2+1, 2); err == nil {
+		t.Fatalf("expected overflow error, got %d", cost)
+	}
+	usage := TokenUsage{InputTokens: math.MaxInt64 / 4, OutputTokens: math.MaxInt64 / 4}
+	if cost, err := CalculateTextCost(usage, PriceInfo{InputPrice: 3, OutputPrice: 3}); err == nil {
+		t.Fatalf("expected overflow error for the sum, got %d", cost)
+	}
+	if cost, err := CalculateTextCost(TokenUsage{InputTokens: 1 << 40}, PriceInfo{InputPrice: 1 << 30}); err == nil {
+		t.Fatalf("expected overflow error, got %d", cost)
+	}
+}
+
+func TestImageCost(t *testing.T) {
+	pricing := NewImagePricing()
+	at := time.Now()
+	cases := []struct {
+		model   ImageModel
+		quality ImageQuality
+		size    ImageSize
+		count   int
+		want    Money
+	}{
+		{ModelGPTImage1Mini, QualityMedium, Size1024x1024, 1, 11_000},
+		{ModelGPTImage1Mini, QualityMedium, Size1024x1024, 3, 33_000},
+		{ModelGPTImage1Mini, QualityHigh, Size1024x1536, 2, 104_000},
+		{ModelDALLE3, QualityStandard, Size1024x1024, 1, 40_000},
+		{ModelDALLE3, QualityHD, Size1024x1792, 10, 1_200_000},
+		{ModelDALLE2, QualityStandard, Size256x256, 7, 112_000},
+	}
+	for _, c := range cases {
+		usd, ok := pricing.CalculateImageCost(c.model, c.quality, c.size, c.count, at)
+		if !ok {
+			t.Fatalf("no price for %s %s %s", c.model, c.quality, c.size)
+		}
+		got, err := usdToMoney(usd, testMicroCoinsPerUSD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("%s %s %s x%d = %d, want %d", c.model, c.quality, c.size, c.count, got, c.want)
+		}
+	}
+
+	if _, ok := pricing.CalculateImageCost(ModelDALLE2, QualityHD, Size256x256, 1, at); ok {
+		t.Errorf("expected no price for unknown option")
+	}
+}
+
+func TestVideoCost(t *testing.T) {
+	pricing := NewVideoPricing()
+	at := time.Now()
+	cases := []struct {
+		model      VideoModel
+		resolution VideoResolution
+		seconds    float64
+		want       Money
+	}{
+		{ModelSora2, ResolutionPortrait720x1280, 4, 400_000},
+		{ModelSora2, ResolutionLandscape1280x720, 12, 1_200_000},
+		{ModelSora2Pro, ResolutionPortrait720x1280, 8, 2_400_000},
+		{ModelSora2Pro, ResolutionLandscape1792x1024, 4, 2_000_000},
+		// 0.1 × 0.3 在 float64 下是 0.030000000000000002，精确计算不应产生误差
+		{ModelSora2, ResolutionPortrait720x1280, 0.3, 30_000},
+		{ModelSora2Pro, ResolutionPortrait1024x1792, 1.1, 550_000},
+	}
+	for _, c := range cases {
+		usd, ok := pricing.CalculateVideoCost(c.model, c.resolution, c.seconds, at)
+		if !ok {
+			t.Fatalf("no price for %s %s", c.model, c.resolution)
+		}
+		got, err := usdToMoney(usd, testMicroCoinsPerUSD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("%s %s %vs = %d, want %d", c.model, c.resolution, c.seconds, got, c.want)
+		}
+	}
+
+	if _, ok := pricing.CalculateVideoCost(ModelSora2, ResolutionPortrait1024x1792, 4, at); ok {
+		t.Errorf("expected no price for unsupported resolution")
+	}
+}
+
+func TestUSDToMoneyRounding(t *testing.T) {
+	cases := []struct {
+		usd        string
+		microCoins int64
+		want       Money
+	}{
+		{"0.0000004", testMicroCoinsPerUSD, 0},
+		{"0.0000005", testMicroCoinsPerUSD, 1},
+		{"0.0000015", testMicroCoinsPerUSD, 2},
+		{"0.0000025", testMicroCoinsPerUSD, 3},
+		{"0.0000024999", testMicroCoinsPerUSD, 2},
+		{"1/3", testMicroCoinsPerUSD, 333_333},
+		{"2/3", testMicroCoinsPerUSD, 666_667},
+		{"0.011", 7_300_000, 80_300},
+		{"-0.0000005", testMicroCoinsPerUSD, -1},
+		{"-0.0000004", testMicroCoinsPerUSD, 0},
+	}
+	for _, c := range cases {
+		usd, ok := new(big.Rat).SetString(c.usd)
+		if !ok {
+			t.Fatalf("invalid usd %s", c.usd)
+		}
+		got, err := usdToMoney(usd, c.microCoins)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("usdToMoney(%s, %d) = %d, want %d", c.usd, c.microCoins, got, c.want)
+		}
+	}
+}
+
+// 多张图片或多秒视频按精确金额合计后只取整一次：n 份的费用等于单份精确金额之和取整，
+// 与逐份取整再相加的差不超过份数的一半
+func TestUSDToMoneySumOfParts(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		part := big.NewRat(r.Int63n(1_000_000), 1_000_000_000) // 最多 0.001 美元，精度低于 1 微代币
+		n := r.Int63n(50) + 1
+
+		sum := new(big.Rat)
+		var rounded Money
+		for j := int64(0); j < n; j++ {
+			sum.Add(sum, part)
+			m, err := usdToMoney(part, testMicroCoinsPerUSD)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rounded += m
+		}
+		total, err := usdToMoney(new(big.Rat).Mul(part, big.NewRat(n, 1)), testMicroCoinsPerUSD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := usdToMoney(sum, testMicroCoinsPerUSD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != want {
+			t.Fatalf("part %s x%d: total %d != sum of parts %d", part.FloatString(9), n, total, want)
+		}
+		if diff := math.Abs(float64(total - rounded)); diff > float64(n)/2 {
+			t.Fatalf("part %s x%d: total %d drifts %v from per-part rounding %d", part.FloatString(9), n, total, diff, rounded)
+		}
+	}
+}
+
+func TestMoneyFromRatOverflow(t *testing.T) {
+	if _, err := MoneyFromRat(new(big.Rat).SetInt64(math.MaxInt64)); err != nil {
+		t.Fatalf("max int64 should fit: %v", err)
+	}
+	over := new(big.Rat).Add(new(big.Rat).SetInt64(math.MaxInt64), big.NewRat(1, 1))
+	if _, err := MoneyFromRat(over); err == nil {
+		t.Fatalf("expected overflow error for %s", over.FloatString(0))
+	}
+	if _, err := usdToMoney(big.NewRat(math.MaxInt64/1000, 1), testMicroCoinsPerUSD); err == nil {
+		t.Fatalf("expected overflow error when converting a huge usd amount")
+	}
+}
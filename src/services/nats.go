@@ -2,8 +2,9 @@ package services
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,23 +19,37 @@ type Consumer interface {
 
 type Handler struct {
 	ctx      context.Context
+	mq       *NatsMQ
 	consumer Consumer
 	stopChan chan struct{}
 }
 
-func (m *Handler) decode(data []byte) []*LLMCallData {
-	var raw []*LLMCallData
-
-	err := json.Unmarshal(data, &raw)
+// decode 按消息的 Content-Type 头选择解码器，未设置时按 JSON 解码
+func (m *Handler) decode(msg *nats.Msg) ([]*LLMCallData, error) {
+	contentType := msg.Header.Get("Content-Type")
+	decoder, err := DecoderFor(contentType)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := decoder(msg.Data)
 	if nil != err {
-		logrus.Errorf("Failed to unmarshal data: %s", string(data))
-		return nil
+		logrus.Errorf("Failed to unmarshal %s data: %q", contentType, msg.Data)
+		return nil, err
 	}
-	return raw
+	return raw, nil
 }
 
 func (m *Handler) do(ch <-chan *nats.Msg) {
 	for {
+		// 停止信号优先于缓冲中的消息，当前消息处理完后立即退出
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-m.stopChan:
+			return
+		default:
+		}
+
 		select {
 		case <-m.ctx.Done():
 			return
@@ -44,64 +59,240 @@ func (m *Handler) do(ch <-chan *nats.Msg) {
 			if !ok {
 				continue
 			}
-			report := m.decode(msg.Data)
-			skipped := report == nil || len(report) == 0
-			// logrus.Debug("received a message: ", string(msg.Data), "skipped: ", skipped)
-			if skipped {
-				msg.Ack()
-				continue
-			}
-			redeliver, err := m.consumer.Do(report)
-			if nil == err {
-				logrus.Infof("ack message: %v", report)
-				msg.Ack()
-			} else {
-				if redeliver {
-					msg.NakWithDelay(time.Minute * 5)
-				} else {
-					msg.Term()
-				}
-			}
+			m.handle(msg)
+			m.mq.release(msg)
+		}
+	}
+}
+
+// handle 处理一条消息，并按结果 ack、nak 或转入死信主题
+func (m *Handler) handle(msg *nats.Msg) {
+	metricMessages.WithLabelValues("received").Inc()
+	report, err := m.decode(msg)
+	if err != nil {
+		metricDecodeFailures.Inc()
+		// 解码器发现的内容错误带有具体原因，其余为格式错误
+		reason := RejectDecode
+		var reject *RejectError
+		if errors.As(err, &reject) {
+			reason = reject.Reason
+		}
+		m.reject(msg, reason, err)
+		return
+	}
+	skipped := report == nil || len(report) == 0
+	// logrus.Debug("received a message: ", string(msg.Data), "skipped: ", skipped)
+	if skipped {
+		msg.Ack()
+		metricMessages.WithLabelValues("acked").Inc()
+		return
+	}
+	redeliver, err := m.consumer.Do(report)
+	if nil == err {
+		logrus.Infof("ack message: %v", report)
+		msg.Ack()
+		metricMessages.WithLabelValues("acked").Inc()
+	} else {
+		switch {
+		case !redeliver:
+			m.reject(msg, RejectReasonOf(err), err)
+		case m.lastDelivery(msg):
+			m.reject(msg, RejectMaxDeliver, err)
+		default:
+			msg.NakWithDelay(time.Minute * 5)
+			metricMessages.WithLabelValues("nakd").Inc()
 		}
 	}
 }
 
+// lastDelivery 是否已达到最大投递次数，之后服务端不会再投递
+func (m *Handler) lastDelivery(msg *nats.Msg) bool {
+	meta, err := msg.Metadata()
+	return err == nil && int(meta.NumDelivered) >= m.mq.maxDeliver()
+}
+
+// reject 将无法处理的消息转入死信主题并终止投递，转入失败时稍后重新投递
+func (m *Handler) reject(msg *nats.Msg, reason RejectReason, cause error) {
+	metricRejected.WithLabelValues(string(reason)).Inc()
+	if err := m.mq.deadLetter(msg, reason, cause); err != nil {
+		msg.NakWithDelay(time.Minute * 5)
+		metricMessages.WithLabelValues("nakd").Inc()
+		return
+	}
+	msg.Term()
+	metricMessages.WithLabelValues("dead_lettered").Inc()
+}
+
 type NatsMQ struct {
 	ctx          context.Context
 	cancel       context.CancelFunc
 	config       *config.NatsMQConfig
 	client       *nats.Conn
+	js           nats.JetStreamContext
 	handlers     map[string]*Handler
 	subscription *nats.Subscription
 	cacheChan    chan *nats.Msg
 	mu           sync.RWMutex
+	wg           sync.WaitGroup // 运行中的 handler
+	stopping     chan struct{}  // 关闭后不再接收新消息
+	stopOnce     sync.Once
+	state        connectionState
+	inflight     map[*nats.Msg]time.Time // 拉取模式下已拉取未确认的消息及上次延长确认期限的时间
+	inflightMu   sync.Mutex
+	released     chan struct{} // 拉取模式下有消息处理完成，可以继续拉取
+	duplicates   time.Duration // 流的重复消息检测窗口，见 RequireDuplicateWindow
+}
+
+// connectionState 连接断开/重连情况，供健康检查使用
+type connectionState struct {
+	mutex          sync.Mutex
+	disconnects    int
+	reconnects     int
+	disconnectedAt time.Time
+	lastError      string
 }
 
 func NewNatsMQ(ctx context.Context, config *config.NatsMQConfig) (*NatsMQ, error) {
-	nc, err := nats.Connect(config.Url, nats.UserInfo(config.User, config.Pass))
-	if nil != err {
-		return nil, err
+	for eventType := range config.Subjects {
+		if _, ok := defaultEventSubjects[EventType(eventType)]; !ok {
+			return nil, fmt.Errorf("natsmq.subjects: unknown event type %s", eventType)
+		}
 	}
 	mq := &NatsMQ{
 		ctx:       ctx,
 		config:    config,
-		client:    nc,
 		handlers:  make(map[string]*Handler),
 		cacheChan: make(chan *nats.Msg, config.BufferSize),
+		stopping:  make(chan struct{}),
+		inflight:  make(map[*nats.Msg]time.Time),
+		released:  make(chan struct{}, 1),
+	}
+	options, err := mq.options()
+	if err != nil {
+		return nil, err
+	}
+	nc, err := nats.Connect(strings.Join(config.Servers(), ","), options...)
+	if nil != err {
+		return nil, err
+	}
+	logrus.Infof("nats connected to %s", nc.ConnectedUrlRedacted())
+	mq.client = nc
+	if mq.js, err = nc.JetStream(); err != nil {
+		nc.Close()
+		return nil, err
 	}
 	return mq, nil
 }
 
+// options 根据配置生成认证、TLS 和重连选项
+func (m *NatsMQ) options() ([]nats.Option, error) {
+	c := m.config
+	options := []nats.Option{
+		nats.DisconnectErrHandler(m.onDisconnect),
+		nats.ReconnectHandler(m.onReconnect),
+		nats.ClosedHandler(m.onClosed),
+		nats.ErrorHandler(func(_ *nats.Conn, sub *nats.Subscription, err error) {
+			logrus.Errorf("nats async error: %v", err)
+		}),
+	}
+	switch {
+	case c.CredsFile != "":
+		options = append(options, nats.UserCredentials(c.CredsFile))
+	case c.NkeySeedFile != "":
+		option, err := nats.NkeyOptionFromSeed(c.NkeySeedFile)
+		if err != nil {
+			return nil, fmt.Errorf("load nkey seed %s: %w", c.NkeySeedFile, err)
+		}
+		options = append(options, option)
+	case c.User != "":
+		options = append(options, nats.UserInfo(c.User, c.Pass))
+	}
+	if tls := c.TLS; tls != nil {
+		if tls.CaFile != "" {
+			options = append(options, nats.RootCAs(tls.CaFile))
+		}
+		if tls.CertFile != "" {
+			options = append(options, nats.ClientCert(tls.CertFile, tls.KeyFile))
+		}
+		if tls.CaFile == "" && tls.CertFile == "" {
+			options = append(options, nats.Secure())
+		}
+	}
+	if c.ReconnectWait > 0 {
+		options = append(options, nats.ReconnectWait(time.Duration(c.ReconnectWait)*time.Second))
+	}
+	if c.MaxReconnects != nil {
+		options = append(options, nats.MaxReconnects(*c.MaxReconnects))
+	}
+	return options, nil
+}
+
+func (m *NatsMQ) onDisconnect(nc *nats.Conn, err error) {
+	m.state.mutex.Lock()
+	m.state.disconnects++
+	m.state.disconnectedAt = time.Now()
+	if err != nil {
+		m.state.lastError = err.Error()
+	}
+	m.state.mutex.Unlock()
+	metricNatsEvents.WithLabelValues("disconnected").Inc()
+	logrus.Warnf("nats disconnected: %v", err)
+}
+
+func (m *NatsMQ) onReconnect(nc *nats.Conn) {
+	m.state.mutex.Lock()
+	m.state.reconnects++
+	downtime := time.Since(m.state.disconnectedAt)
+	m.state.disconnectedAt = time.Time{}
+	m.state.mutex.Unlock()
+	metricNatsEvents.WithLabelValues("reconnected").Inc()
+	logrus.Infof("nats reconnected to %s after %s", nc.ConnectedUrlRedacted(), downtime.Round(time.Millisecond))
+}
+
+func (m *NatsMQ) onClosed(nc *nats.Conn) {
+	metricNatsEvents.WithLabelValues("closed").Inc()
+	if err := nc.LastError(); err != nil {
+		logrus.Errorf("nats connection closed: %v", err)
+		return
+	}
+	logrus.Info("nats connection closed")
+}
+
+// ConnectionStats 返回连接断开/重连统计
+func (m *NatsMQ) ConnectionStats() map[string]any {
+	m.state.mutex.Lock()
+	defer m.state.mutex.Unlock()
+	stats := map[string]any{
+		"disconnects": m.state.disconnects,
+		"reconnects":  m.state.reconnects,
+	}
+	if m.client != nil {
+		stats["server"] = m.client.ConnectedUrlRedacted()
+	}
+	if !m.state.disconnectedAt.IsZero() {
+		stats["disconnected_at"] = m.state.disconnectedAt.Unix()
+	}
+	if m.state.lastError != "" {
+		stats["last_error"] = m.state.lastError
+	}
+	return stats
+}
+
 func (m *NatsMQ) AddConsumer(name string, c Consumer) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.handlers[name] = &Handler{ctx: m.ctx, consumer: c}
+	m.handlers[name] = &Handler{ctx: m.ctx, mq: m, consumer: c, stopChan: make(chan struct{})}
 }
 
+// RemoveConsumer 停止 handler，正在处理的消息处理完后退出
 func (m *NatsMQ) RemoveConsumer(name string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.handlers[name].stopChan <- struct{}{}
+	handler, ok := m.handlers[name]
+	if !ok {
+		return
+	}
+	close(handler.stopChan)
 	delete(m.handlers, name)
 }
 
@@ -110,19 +301,21 @@ func (m *NatsMQ) Subscribe() error {
 		return errors.New("No consumers registered")
 	}
 
-	js, err := m.client.JetStream()
-	if err != nil {
+	if err := m.provision(); err != nil {
+		logrus.Errorf("Failed to provision stream %s: %v", m.streamName(), err)
 		return err
 	}
+	if m.pullMode() {
+		return m.pullSubscribe()
+	}
 
-	sub, err := js.QueueSubscribe(m.config.Topic, m.config.WorkerGroup, func(msg *nats.Msg) {
+	// 绑定到已声明的消费者，不由订阅创建，因此关闭连接也不会删除它
+	sub, err := m.js.QueueSubscribe(m.config.Topic, m.config.WorkerGroup, func(msg *nats.Msg) {
 		logrus.Debugf("DsstributeMessage: %s ", msg.Data)
 		// 将消息分发给所有consumer
 		m.distributeMessage(msg)
 	},
-		nats.Durable(m.config.Consumer), nats.MaxDeliver(5),
-		nats.ManualAck(), nats.MaxAckPending(m.config.BufferSize),
-		nats.AckWait(time.Minute*time.Duration(m.config.AckWaitMintues)),
+		nats.Bind(m.streamName(), m.config.Consumer), nats.ManualAck(),
 	)
 
 	if err != nil {
@@ -135,49 +328,125 @@ func (m *NatsMQ) Subscribe() error {
 }
 
 // distributeMessage 将消息分发给所有注册的consumer (FOUT模式)
+// 停止后收到的消息不放入缓冲也不 nak，确认期限到期后由服务端重新投递，见 Close
 func (m *NatsMQ) distributeMessage(msg *nats.Msg) {
+	select {
+	case <-m.stopping:
+		return
+	default:
+	}
+
+	select {
+	case m.cacheChan <- msg:
+	case <-m.stopping:
+	}
+}
 
-	m.cacheChan <- msg
+// Stopping 是否已开始停止
+func (m *NatsMQ) Stopping() bool {
+	select {
+	case <-m.stopping:
+		return true
+	default:
+		return false
+	}
 }
 
-func (m *NatsMQ) Close() error {
+// Close 有序停止：先 Drain 订阅，服务端不再向本实例投递新消息，再等待 handler 处理完当前消息（最长 timeout），最后关闭连接。
+// 订阅通过 nats.Bind 绑定到 provision 声明的消费者，Drain/Unsubscribe 不会删除它。
+// 缓冲中未处理的消息不 nak：nak 计入 MaxDeliver，每次滚动重启都会把消息推向死信主题，确认期限到期后由服务端重新投递
+func (m *NatsMQ) Close(timeout time.Duration) error {
+	m.stopOnce.Do(func() { close(m.stopping) })
+
 	if m.subscription != nil {
-		// m.subscription.Unsubscribe()
+		if err := m.subscription.Drain(); err != nil {
+			logrus.Warnf("drain subscription: %v", err)
+		}
+	}
+
+	m.mu.Lock()
+	for name, handler := range m.handlers {
+		close(handler.stopChan)
+		delete(m.handlers, name)
 	}
+	m.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		logrus.Info("all consumers stopped")
+	case <-time.After(timeout):
+		logrus.Warnf("consumers did not stop within %s, closing anyway", timeout)
+	}
+
+	if left := len(m.cacheChan); left > 0 {
+		logrus.Infof("%d buffered messages left for redelivery after the ack wait of %s", left, m.ackWait())
+	}
+
 	if m.client != nil {
+		if err := m.client.FlushTimeout(timeout); err != nil {
+			logrus.Warnf("flush nats connection: %v", err)
+		}
 		m.client.Close()
 	}
 	return nil
 }
 
 func (m *NatsMQ) Start() {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.pullMode() {
+		m.wg.Add(2)
+		go func() {
+			defer m.wg.Done()
+			m.pull()
+		}()
+		go func() {
+			defer m.wg.Done()
+			m.keepAlive()
+		}()
+	}
 	for name, handler := range m.handlers {
-		go handler.do(m.cacheChan)
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			handler.do(m.cacheChan)
+			logrus.Infof("Consumer: %s stopped", name)
+		}()
 		logrus.Infof("Consumer: %s started", name)
 	}
 }
 
-func (m *NatsMQ) Publish(data interface{}) error {
-	js, err := m.client.JetStream()
-	if err != nil {
-		logrus.Errorf("Failed to connect to JetStream: %v", err)
-		return err
-	}
+// Status 返回 NATS 连接状态
+func (m *NatsMQ) Status() nats.Status {
+	return m.client.Status()
+}
 
-	payload, err := json.Marshal(data)
-	if err != nil {
-		return err
-	}
-	// 设置发布选项
-	opts := []nats.PubOpt{
-		nats.AckWait(30 * time.Second),
+// ConsumerInfo 返回当前订阅对应的 JetStream 消费者信息
+func (m *NatsMQ) ConsumerInfo() (*nats.ConsumerInfo, error) {
+	if m.subscription == nil {
+		return nil, errors.New("not subscribed")
 	}
-	_, err = js.Publish("billing.userConsume", payload, opts...)
+	return m.subscription.ConsumerInfo()
+}
+
+// QueueDepth 返回本地缓冲中等待处理的消息数及缓冲容量
+func (m *NatsMQ) QueueDepth() (int, int) {
+	return len(m.cacheChan), cap(m.cacheChan)
+}
+
+// Publish 发布消息到 JetStream，msgId 写入 Nats-Msg-Id 头，重复发布时由服务端去重
+func (m *NatsMQ) Publish(subject string, payload []byte, msgId string) error {
+	_, err := m.js.Publish(subject, payload, nats.MsgId(msgId), nats.AckWait(30*time.Second))
 	if err != nil {
-		logrus.Errorf("Failed to publish message to topic %s: %v", "billing.userConsume", err)
+		logrus.Errorf("Failed to publish message to topic %s: %v", subject, err)
 		return err
 	}
 
-	logrus.Debugf("Published message to topic %s: %s", "billing.userConsume", string(payload))
+	logrus.Debugf("Published message %s to topic %s: %s", msgId, subject, string(payload))
 	return nil
 }
@@ -0,0 +1,157 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultFetchWait = 5 * time.Second
+
+// pullMode 是否使用拉取模式
+// 推送模式下回调阻塞在缓冲上，消息在缓冲中等待时确认期限也在计时；
+// 拉取模式按空闲容量批量拉取，并对等待较久的消息调用 InProgress 延长确认期限
+func (m *NatsMQ) pullMode() bool {
+	return m.config.Mode == "pull"
+}
+
+func (m *NatsMQ) pullSubscribe() error {
+	sub, err := m.js.PullSubscribe(m.config.Topic, m.config.Consumer,
+		nats.Bind(m.streamName(), m.config.Consumer), nats.ManualAck(),
+	)
+	if err != nil {
+		logrus.Errorf("Failed to pull subscribe to topic %s: %v ", m.config.Topic, err)
+		return err
+	}
+	logrus.Infof("Topic: %s pull subscribed, using consumer: %s, batch: %d", m.config.Topic, m.config.Consumer, m.fetchBatch())
+	m.subscription = sub
+	return nil
+}
+
+// fetchBatch 每批最多拉取的消息数，不超过缓冲容量
+func (m *NatsMQ) fetchBatch() int {
+	if m.config.FetchBatch > 0 {
+		return min(m.config.FetchBatch, m.config.BufferSize)
+	}
+	return m.config.BufferSize
+}
+
+// capacity 还能接收的消息数：缓冲容量减去已拉取未处理完的消息
+func (m *NatsMQ) capacity() int {
+	m.inflightMu.Lock()
+	defer m.inflightMu.Unlock()
+	return m.config.BufferSize - len(m.inflight)
+}
+
+// pull 按空闲容量批量拉取消息放入缓冲，没有容量时等待消息处理完成后再拉取
+func (m *NatsMQ) pull() {
+	wait := defaultFetchWait
+	if m.config.FetchWait > 0 {
+		wait = time.Duration(m.config.FetchWait) * time.Second
+	}
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-m.stopping:
+			return
+		default:
+		}
+
+		batch := min(m.fetchBatch(), m.capacity())
+		if batch <= 0 {
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-m.stopping:
+				return
+			case <-m.released:
+			}
+			continue
+		}
+
+		msgs, err := m.subscription.Fetch(batch, nats.MaxWait(wait))
+		if err != nil {
+			if errors.Is(err, nats.ErrTimeout) || errors.Is(err, context.DeadlineExceeded) {
+				continue
+			}
+			if m.Stopping() {
+				return
+			}
+			// 连接断开等情况下稍后重试，重连由客户端负责
+			logrus.Errorf("Failed to fetch from consumer %s: %v", m.config.Consumer, err)
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-m.stopping:
+				return
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		now := time.Now()
+		m.inflightMu.Lock()
+		for _, msg := range msgs {
+			m.inflight[msg] = now
+		}
+		m.inflightMu.Unlock()
+		logrus.Debugf("fetched %d messages from consumer %s", len(msgs), m.config.Consumer)
+		for _, msg := range msgs {
+			m.distributeMessage(msg)
+		}
+	}
+}
+
+// release 消息已 ack、nak 或终止，不再延长其确认期限
+func (m *NatsMQ) release(msg *nats.Msg) {
+	if !m.pullMode() {
+		return
+	}
+	m.inflightMu.Lock()
+	delete(m.inflight, msg)
+	m.inflightMu.Unlock()
+	select {
+	case m.released <- struct{}{}:
+	default:
+	}
+}
+
+// keepAlive 对等待或处理超过半个确认期限的消息调用 InProgress，避免处理较慢的批次被重新投递
+func (m *NatsMQ) keepAlive() {
+	ackWait := m.ackWait()
+	ticker := time.NewTicker(ackWait / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-m.stopping:
+			return
+		case now := <-ticker.C:
+			var due []*nats.Msg
+			m.inflightMu.Lock()
+			for msg, last := range m.inflight {
+				if now.Sub(last) >= ackWait/2 {
+					due = append(due, msg)
+					m.inflight[msg] = now
+				}
+			}
+			m.inflightMu.Unlock()
+
+			for _, msg := range due {
+				// 消息可能恰好已被确认
+				if err := msg.InProgress(); err != nil && !errors.Is(err, nats.ErrMsgAlreadyAckd) {
+					logrus.Warnf("extend ack deadline: %v", err)
+				}
+			}
+			if len(due) > 0 {
+				logrus.Debugf("extended ack deadline of %d messages", len(due))
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/deepissue/fee_server/config"
+	"github.com/nats-io/nats.go"
+)
+
+// blockingConsumer 处理消息时阻塞，直到 release 关闭
+type blockingConsumer struct {
+	started chan struct{}
+	release chan struct{}
+	calls   int
+}
+
+func (c *blockingConsumer) Do(report LLMReportMessage) (bool, error) {
+	c.calls++
+	close(c.started)
+	<-c.release
+	return false, nil
+}
+
+func testNatsMQ(bufferSize int) *NatsMQ {
+	return &NatsMQ{
+		config:    &config.NatsMQConfig{Topic: "billing.nodeUsage", BufferSize: bufferSize, AckWaitMintues: 5},
+		handlers:  make(map[string]*Handler),
+		cacheChan: make(chan *nats.Msg, bufferSize),
+		stopping:  make(chan struct{}),
+		inflight:  make(map[*nats.Msg]time.Time),
+		released:  make(chan struct{}, 1),
+	}
+}
+
+func reportMsg(t *testing.T) *nats.Msg {
+	t.Helper()
+	payload := samplePayloads(t, sampleReport(1))[ContentTypeJSON]
+	return &nats.Msg{Subject: "billing.nodeUsage", Data: payload, Header: nats.Header{}}
+}
+
+// 停止时等待处理中的消息完成，缓冲中和停止后到达的消息留给服务端重新投递，不再交给 handler
+func TestCloseLeavesBufferedMessages(t *testing.T) {
+	mq := testNatsMQ(4)
+	mq.ctx = t.Context()
+	consumer := &blockingConsumer{started: make(chan struct{}), release: make(chan struct{})}
+	mq.AddConsumer("fee", consumer)
+	mq.Start()
+
+	mq.distributeMessage(reportMsg(t))
+	<-consumer.started
+	mq.distributeMessage(reportMsg(t))
+	mq.distributeMessage(reportMsg(t))
+
+	closed := make(chan struct{})
+	go func() {
+		mq.Close(5 * time.Second)
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close returned before the in-flight message was handled")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(consumer.release)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return after the in-flight message was handled")
+	}
+
+	if consumer.calls != 1 {
+		t.Errorf("consumer called %d times, want only the in-flight message", consumer.calls)
+	}
+	if depth, _ := mq.QueueDepth(); depth != 2 {
+		t.Errorf("%d messages left in the buffer, want 2", depth)
+	}
+	mq.distributeMessage(reportMsg(t))
+	if depth, _ := mq.QueueDepth(); depth != 2 {
+		t.Errorf("message delivered after Close was buffered, depth %d", depth)
+	}
+	if !mq.Stopping() {
+		t.Error("Stopping() = false after Close")
+	}
+}
+
+// handler 卡住时 Close 最多等待 timeout
+func TestCloseTimeout(t *testing.T) {
+	mq := testNatsMQ(1)
+	mq.ctx = t.Context()
+	consumer := &blockingConsumer{started: make(chan struct{}), release: make(chan struct{})}
+	defer close(consumer.release)
+	mq.AddConsumer("fee", consumer)
+	mq.Start()
+	mq.distributeMessage(reportMsg(t))
+	<-consumer.started
+
+	start := time.Now()
+	mq.Close(100 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Close took %s with a 100ms timeout", elapsed)
+	}
+}
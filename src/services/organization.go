@@ -0,0 +1,157 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/deepissue/fee_server/models"
+	"github.com/sirupsen/logrus"
+)
+
+// CreateOrg 创建组织及其钱包，创建者成为组织管理员
+func (m *AccountService) CreateOrg(args *OrgArgs) (*models.Organization, error) {
+	session := m.xorm.NewSession()
+	defer session.Close()
+	if err := session.Begin(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	org := models.Organization{Name: args.Name, CreatedAt: now, UpdatedAt: now}
+	if _, err := session.InsertOne(&org); err != nil {
+		logrus.Errorf("insert org %s: %v", args.Name, err)
+		return nil, err
+	}
+	wallet := models.UserWallet{OrgId: org.ID, CreatedAt: now, UpdatedAt: now}
+	if _, err := session.InsertOne(&wallet); err != nil {
+		logrus.Errorf("insert wallet of org %d: %v", org.ID, err)
+		return nil, err
+	}
+	org.WalletId = wallet.Id
+	if _, err := session.ID(org.ID).Cols("wallet_id").Update(&org); err != nil {
+		return nil, err
+	}
+	admin := models.OrgMember{
+		OrgId:     org.ID,
+		UserId:    args.AdminUserId,
+		Role:      models.OrgMemberAdmin,
+		Status:    models.OrgMemberActive,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if _, err := session.InsertOne(&admin); err != nil {
+		logrus.Errorf("insert admin of org %d: %v", org.ID, err)
+		return nil, err
+	}
+	if err := session.Commit(); err != nil {
+		return nil, err
+	}
+	logrus.Infof("org %d (%s) created with wallet %d, admin %d", org.ID, org.Name, org.WalletId, args.AdminUserId)
+	return &org, nil
+}
+
+// SaveMember 按组织和用户创建或修改成员，已累计的消费保持不变
+// 停用成员后其组织钱包的 key 在 Quota 中不再可用，已上报的用量照常扣费
+func (m *AccountService) SaveMember(args *OrgMemberArgs) (*models.OrgMember, error) {
+	if args.Role == "" {
+		args.Role = models.OrgMemberMember
+	}
+	if args.Status == "" {
+		args.Status = models.OrgMemberActive
+	}
+	if args.Role != models.OrgMemberAdmin && args.Role != models.OrgMemberMember {
+		return nil, fmt.Errorf("invalid role: %s", args.Role)
+	}
+	if args.Status != models.OrgMemberActive && args.Status != models.OrgMemberDisabled {
+		return nil, fmt.Errorf("invalid status: %s", args.Status)
+	}
+	if args.DailyLimit < 0 || args.MonthlyLimit < 0 {
+		return nil, fmt.Errorf("limits must not be negative")
+	}
+	if has, err := m.xorm.ID(args.OrgId).Exist(&models.Organization{}); err != nil {
+		return nil, err
+	} else if !has {
+		return nil, fmt.Errorf("org not found: %d", args.OrgId)
+	}
+
+	now := time.Now().Unix()
+	var member models.OrgMember
+	has, err := m.xorm.Where("org_id = ? AND user_id = ?", args.OrgId, args.UserId).Get(&member)
+	if err != nil {
+		return nil, err
+	}
+	member.OrgId = args.OrgId
+	member.UserId = args.UserId
+	member.Role = args.Role
+	member.Status = args.Status
+	member.DailyLimit = args.DailyLimit
+	member.MonthlyLimit = args.MonthlyLimit
+	member.UpdatedAt = now
+	if has {
+		_, err = m.xorm.ID(member.ID).Cols("role", "status", "daily_limit", "monthly_limit", "updated_at").Update(&member)
+	} else {
+		member.CreatedAt = now
+		_, err = m.xorm.InsertOne(&member)
+	}
+	if err != nil {
+		logrus.Errorf("save org %d member %d: %v", args.OrgId, args.UserId, err)
+		return nil, err
+	}
+	return &member, nil
+}
+
+// Members 返回组织的全部成员
+func (m *AccountService) Members(orgId int64) ([]models.OrgMember, error) {
+	var members []models.OrgMember
+	if err := m.xorm.Where("org_id = ?", orgId).Asc("id").Find(&members); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// MemberSpend 成员在组织钱包上的消费汇总（金额单位：微代币）
+type MemberSpend struct {
+	UserId int64 `json:"user_id" xorm:"'user_id'"`
+	Calls  int64 `json:"calls" xorm:"'calls'"`
+	Spent  int64 `json:"spent" xorm:"'spent'"`
+}
+
+// MemberSpends 统计组织钱包 [start, end) 时间段内按成员分组的消费，跨月分表汇总，按消费金额倒序
+func (m *AccountService) MemberSpends(orgId int64, start, end time.Time) ([]MemberSpend, error) {
+	merged := map[int64]*MemberSpend{}
+	err := m.partition.Each(start, end, func(tables models.ConsumeTables) error {
+		sql := fmt.Sprintf(`SELECT user_id, COUNT(*) AS calls, SUM(total_consumed) AS spent
+			FROM %s WHERE org_id = ? AND created_at >= ? AND created_at < ? GROUP BY user_id`, tables.Record)
+
+		var part []MemberSpend
+		if err := m.xorm.SQL(sql, orgId, start.Unix(), end.Unix()).Find(&part); err != nil {
+			return err
+		}
+		for _, row := range part {
+			spend, ok := merged[row.UserId]
+			if !ok {
+				spend = &MemberSpend{UserId: row.UserId}
+				merged[row.UserId] = spend
+			}
+			spend.Calls += row.Calls
+			spend.Spent += row.Spent
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]MemberSpend, 0, len(merged))
+	for _, spend := range merged {
+		result = append(result, *spend)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Spent != result[j].Spent {
+			return result[i].Spent > result[j].Spent
+		}
+		return result[i].UserId < result[j].UserId
+	})
+	return result, nil
+}
@@ -0,0 +1,229 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+	"unicode/utf8"
+
+	"github.com/deepissue/fee_server/config"
+	"github.com/deepissue/fee_server/models"
+	"github.com/sirupsen/logrus"
+	"xorm.io/xorm"
+)
+
+const (
+	defaultOutboxInterval   = time.Second
+	defaultOutboxBatchSize  = 100
+	defaultOutboxMaxBackoff = 5 * time.Minute
+	defaultOutboxRetention  = 7 * 24 * time.Hour
+	outboxCleanupInterval   = time.Hour
+	outboxClaimLease        = 2 * time.Minute // 领取后未能标记结果时，其他实例重新发布之前等待的时间
+)
+
+// OutboxRelay 事务性发件箱：消息与扣费在同一事务中写入 outbox 表，
+// 后台按顺序领取并发布到 NATS、标记为已发送，失败时按指数退避重试。多个实例同时运行时各自领取不同的消息。
+// 发布时以事件 id 作为 Msg-Id，发布成功但未能标记时重复发布的消息由 JetStream 在 DuplicateWindow 内去重
+type OutboxRelay struct {
+	xorm       xorm.EngineInterface
+	mq         *NatsMQ
+	interval   time.Duration
+	batchSize  int
+	maxBackoff time.Duration
+	retention  time.Duration
+	notify     chan struct{}
+}
+
+func NewOutboxRelay(xorm xorm.EngineInterface, mq *NatsMQ, c *config.OutboxConfig) *OutboxRelay {
+	r := &OutboxRelay{
+		xorm:       xorm,
+		mq:         mq,
+		interval:   defaultOutboxInterval,
+		batchSize:  defaultOutboxBatchSize,
+		maxBackoff: defaultOutboxMaxBackoff,
+		retention:  defaultOutboxRetention,
+		notify:     make(chan struct{}, 1),
+	}
+	if c == nil {
+		return r
+	}
+	if c.Interval > 0 {
+		r.interval = time.Duration(c.Interval) * time.Second
+	}
+	if c.BatchSize > 0 {
+		r.batchSize = c.BatchSize
+	}
+	if c.MaxBackoff > 0 {
+		r.maxBackoff = time.Duration(c.MaxBackoff) * time.Second
+	}
+	if c.RetentionDays > 0 {
+		r.retention = time.Duration(c.RetentionDays) * 24 * time.Hour
+	}
+	return r
+}
+
+// Enqueue 在调用方的事务中写入一条待发布事件，主题按事件类型确定
+func (r *OutboxRelay) Enqueue(session *xorm.Session, event *Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	row := &models.Outbox{
+		MsgId:   event.EventId,
+		Subject: r.mq.Subject(event.EventType),
+		Payload: payload,
+		Status:  models.OutboxPending,
+	}
+	if _, err := session.InsertOne(row); err != nil {
+		logrus.Errorf("insert outbox: %v", err)
+		return err
+	}
+	return nil
+}
+
+// Notify 事务提交后唤醒 relay 立即发布，不必等到下一次轮询
+func (r *OutboxRelay) Notify() {
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Pending 返回待发布的消息数
+func (r *OutboxRelay) Pending() (int64, error) {
+	return r.xorm.Where("status = ?", models.OutboxPending).Count(&models.Outbox{})
+}
+
+// DuplicateWindow 同一条消息两次发布之间的最长间隔（一次退避或一个领取租约）再留一倍余量，
+// 流的重复消息检测窗口不能短于此，否则退避后重复发布的消息不会被去重
+func (r *OutboxRelay) DuplicateWindow() time.Duration {
+	return 2 * max(r.maxBackoff, outboxClaimLease)
+}
+
+// Run 轮询并发布待发布的消息，定期清理已发送的消息
+func (r *OutboxRelay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	cleanup := time.NewTicker(outboxCleanupInterval)
+	defer cleanup.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-cleanup.C:
+			r.cleanup()
+		case <-r.notify:
+			r.relay()
+		case <-ticker.C:
+			r.relay()
+		}
+	}
+}
+
+// relay 按写入顺序领取并发布到期的消息，直到没有待发布的消息或发布失败
+// 发布失败时本批中剩余的消息在领取租约到期后重新发布
+func (r *OutboxRelay) relay() {
+	for {
+		rows, err := r.claim()
+		if err != nil {
+			logrus.Errorf("claim outbox: %v", err)
+			return
+		}
+		for i := range rows {
+			if err := r.publish(&rows[i]); err != nil {
+				return
+			}
+		}
+		if len(rows) < r.batchSize {
+			return
+		}
+	}
+}
+
+// claim 在短事务中用 FOR UPDATE SKIP LOCKED 锁定一批到期的消息，并把 next_attempt_at 推迟 outboxClaimLease 作为租约，
+// 其他实例跳过已锁定和已领取的消息；领取的实例退出后，租约到期的消息由其他实例重新发布
+func (r *OutboxRelay) claim() ([]models.Outbox, error) {
+	session := r.xorm.NewSession()
+	defer session.Close()
+	if err := session.Begin(); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var rows []models.Outbox
+	err := session.SQL("SELECT * FROM outbox WHERE status = ? AND next_attempt_at <= ? ORDER BY id LIMIT ? FOR UPDATE SKIP LOCKED",
+		models.OutboxPending, now.Unix(), r.batchSize).Find(&rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, session.Commit()
+	}
+	ids := make([]int64, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row.ID)
+	}
+	lease := &models.Outbox{NextAttemptAt: now.Add(outboxClaimLease).Unix()}
+	if _, err := session.In("id", ids).Cols("next_attempt_at").Update(lease); err != nil {
+		return nil, err
+	}
+	return rows, session.Commit()
+}
+
+func (r *OutboxRelay) publish(row *models.Outbox) error {
+	if err := r.mq.Publish(row.Subject, row.Payload, row.MsgId); err != nil {
+		metricOutbox.WithLabelValues("failed").Inc()
+		row.Attempts++
+		row.NextAttemptAt = time.Now().Add(r.backoff(row.Attempts)).Unix()
+		row.LastError = truncate(err.Error(), 512)
+		if _, err := r.xorm.ID(row.ID).Cols("attempts", "next_attempt_at", "last_error").Update(row); err != nil {
+			logrus.Errorf("update outbox %d: %v", row.ID, err)
+		}
+		logrus.Warnf("publish outbox %d failed (%d attempts), retry at %s: %v",
+			row.ID, row.Attempts, time.Unix(row.NextAttemptAt, 0).Format(time.DateTime), err)
+		return err
+	}
+
+	row.Status = models.OutboxSent
+	row.SentAt = time.Now().Unix()
+	if _, err := r.xorm.ID(row.ID).Cols("status", "sent_at").Update(row); err != nil {
+		// 下次会重复发布，由 Msg-Id 去重
+		logrus.Errorf("mark outbox %d sent: %v", row.ID, err)
+		return err
+	}
+	metricOutbox.WithLabelValues("sent").Inc()
+	return nil
+}
+
+// backoff 第 attempts 次失败后的重试间隔：interval × 2^(attempts-1)，不超过 maxBackoff
+func (r *OutboxRelay) backoff(attempts int) time.Duration {
+	wait := r.interval
+	for i := 1; i < attempts && wait < r.maxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, r.maxBackoff)
+}
+
+// cleanup 删除超过保留期的已发送消息
+func (r *OutboxRelay) cleanup() {
+	before := time.Now().Add(-r.retention).Unix()
+	n, err := r.xorm.Where("status = ? AND sent_at < ?", models.OutboxSent, before).Delete(&models.Outbox{})
+	if err != nil {
+		logrus.Errorf("clean up outbox: %v", err)
+		return
+	}
+	if n > 0 {
+		logrus.Infof("%d sent outbox messages cleaned up", n)
+	}
+}
+
+// truncate 截断为最多 n 字节，不拆开多字节字符
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
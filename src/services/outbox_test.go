@@ -0,0 +1,67 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/deepissue/fee_server/config"
+)
+
+func TestTruncate(t *testing.T) {
+	cases := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exactly", 7, "exactly"},
+		{"abcdef", 3, "abc"},
+		{"发布失败", 6, "发布"},
+		{"发布失败", 7, "发布"},
+		{"发布失败", 8, "发布"},
+		{"a发布", 3, "a"},
+	}
+	for _, c := range cases {
+		got := truncate(c.s, c.n)
+		if got != c.want || !utf8.ValidString(got) || len(got) > c.n {
+			t.Errorf("truncate(%q, %d) = %q, want %q", c.s, c.n, got, c.want)
+		}
+	}
+	long := strings.Repeat("超时", 300)
+	if got := truncate(long, 512); !utf8.ValidString(got) || len(got) > 512 {
+		t.Errorf("truncate of a long error is %d bytes, valid utf-8: %v", len(got), utf8.ValidString(got))
+	}
+}
+
+// 流的去重窗口必须覆盖最长的重试间隔
+func TestOutboxDuplicateWindow(t *testing.T) {
+	for _, c := range []*config.OutboxConfig{nil, {MaxBackoff: 30}, {MaxBackoff: 3600}} {
+		relay := NewOutboxRelay(nil, nil, c)
+		window := relay.DuplicateWindow()
+		if window < relay.maxBackoff || window < outboxClaimLease {
+			t.Errorf("%+v: duplicate window %s shorter than max backoff %s or lease %s", c, window, relay.maxBackoff, outboxClaimLease)
+		}
+		if longest := relay.backoff(100); longest > window {
+			t.Errorf("%+v: backoff %s exceeds the duplicate window %s", c, longest, window)
+		}
+
+		mq := &NatsMQ{config: &config.NatsMQConfig{Topic: "billing.nodeUsage"}}
+		mq.RequireDuplicateWindow(window)
+		stream, err := mq.streamConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stream.Duplicates != window {
+			t.Errorf("%+v: stream duplicates %s, want %s", c, stream.Duplicates, window)
+		}
+	}
+
+	// 不超过流的 max_age
+	mq := &NatsMQ{config: &config.NatsMQConfig{Topic: "billing.nodeUsage", Stream: &config.NatsStreamConfig{MaxAge: 1}}}
+	mq.RequireDuplicateWindow(3 * time.Hour)
+	if stream, err := mq.streamConfig(); err != nil || stream.Duplicates != time.Hour {
+		t.Errorf("duplicates %v (%v), want capped at 1h", stream.Duplicates, err)
+	}
+}
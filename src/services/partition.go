@@ -0,0 +1,129 @@
+package services
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/deepissue/fee_server/models"
+	"github.com/sirupsen/logrus"
+	"xorm.io/xorm"
+)
+
+// ConsumePartition 管理 user_consume 及其明细表的按月分表
+// 写入时每月首次自动建表；查询时跨越时间段内的所有月份分表以及分表之前的历史单表
+type ConsumePartition struct {
+	xorm     xorm.EngineInterface
+	mutex    sync.Mutex
+	existing map[string]bool
+}
+
+func NewConsumePartition(xorm xorm.EngineInterface) *ConsumePartition {
+	return &ConsumePartition{
+		xorm:     xorm,
+		existing: map[string]bool{},
+	}
+}
+
+// Ensure 确保 t 所在月份的分表已创建
+// MySQL 的 DDL 会隐式提交事务，必须在开启扣费事务之前调用
+func (p *ConsumePartition) Ensure(t time.Time) (models.ConsumeTables, error) {
+	tables := models.ConsumeTablesOf(t)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.existing[tables.Record] {
+		return tables, nil
+	}
+
+	for name, bean := range map[string]any{
+		tables.Record: new(models.UserConsumeRecord),
+		tables.Text:   new(models.UserConsumeDetailText),
+		tables.Image:  new(models.UserConsumeDetailImage),
+		tables.Video:  new(models.UserConsumeDetailVideo),
+		tables.Wallet: new(models.UserConsumeDetailWallet),
+	} {
+		if err := p.xorm.Table(name).Sync(bean); err != nil {
+			logrus.Errorf("create consume table %s: %v", name, err)
+			return tables, err
+		}
+	}
+	p.existing[tables.Record] = true
+	logrus.Infof("consume tables of %s ready", tables.Slice)
+	return tables, nil
+}
+
+// Tables 返回与 [start, end) 有交集且已存在的分表，历史单表排在最前
+func (p *ConsumePartition) Tables(start, end time.Time) ([]models.ConsumeTables, error) {
+	candidates := append([]models.ConsumeTables{models.LegacyConsumeTables()}, models.ConsumeTablesBetween(start, end)...)
+	var tables []models.ConsumeTables
+	for _, candidate := range candidates {
+		exists, err := p.exists(candidate.Record)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			tables = append(tables, candidate)
+		}
+	}
+	return tables, nil
+}
+
+// Each 依次在 [start, end) 涉及的每组分表上执行 fn
+func (p *ConsumePartition) Each(start, end time.Time, fn func(tables models.ConsumeTables) error) error {
+	tables, err := p.Tables(start, end)
+	if err != nil {
+		return err
+	}
+	for _, t := range tables {
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SumInt64 在每组分表上执行返回单个整数的查询并求和，query 中用 %s 表示消费记录表名
+func (p *ConsumePartition) SumInt64(start, end time.Time, query string, args ...any) (int64, error) {
+	var total int64
+	err := p.Each(start, end, func(tables models.ConsumeTables) error {
+		var value int64
+		if _, err := p.xorm.SQL(fmt.Sprintf(query, tables.Record), args...).Get(&value); err != nil {
+			return err
+		}
+		total += value
+		return nil
+	})
+	return total, err
+}
+
+// FindRecords 查询 [start, end) 内满足条件的消费记录
+func (p *ConsumePartition) FindRecords(start, end time.Time, query string, args ...any) ([]models.UserConsumeRecord, error) {
+	var records []models.UserConsumeRecord
+	err := p.Each(start, end, func(tables models.ConsumeTables) error {
+		var part []models.UserConsumeRecord
+		if err := p.xorm.Table(tables.Record).Where("created_at >= ? AND created_at < ?", start.Unix(), end.Unix()).
+			And(query, args...).Find(&part); err != nil {
+			return err
+		}
+		records = append(records, part...)
+		return nil
+	})
+	return records, err
+}
+
+func (p *ConsumePartition) exists(table string) (bool, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.existing[table] {
+		return true, nil
+	}
+	exists, err := p.xorm.IsTableExist(table)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		p.existing[table] = true
+	}
+	return exists, nil
+}
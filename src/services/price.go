@@ -4,26 +4,39 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"xorm.io/xorm"
 )
 
 type PriceInfo struct {
-	InputPrice  int `json:"input_price"`  //输入token计费
-	OutputPrice int `json:"output_price"` //输出token计费
-	CachePrice  int `json:"cache_price"`  //缓存token计费
+	InputPrice  Money `json:"input_price"`  //输入token计费（微代币/token）
+	OutputPrice Money `json:"output_price"` //输出token计费
+	CachePrice  Money `json:"cache_price"`  //缓存token计费
 }
 
 func (o PriceInfo) String() string {
 	return fmt.Sprintf("<Price: input:%d, output:%d>", o.InputPrice, o.OutputPrice)
 }
 
+// providerCostKey 上游成本价按实际服务商和实际模型区分
+type providerCostKey struct {
+	providerId string
+	model      string
+}
+
 type PriceService struct {
 	ctx       context.Context
 	xorm      xorm.EngineInterface
 	PriceInfo map[string]PriceInfo
 	mutex     sync.Mutex
+
+	// costs 缓存每个服务商模型的全部成本价版本（按 valid_from 升序），没有成本价时缓存空列表
+	// 价格重新加载时清空，新版本在下一次加载后生效
+	costs map[providerCostKey][]ProviderPrice
+	// missingCosts 已记录过没有成本价的服务商模型，每个只记录一次
+	missingCosts map[providerCostKey]bool
 }
 
 func NewPriceService(ctx context.Context, xorm xorm.EngineInterface) *PriceService {
@@ -31,12 +44,15 @@ func NewPriceService(ctx context.Context, xorm xorm.EngineInterface) *PriceServi
 		ctx:       ctx,
 		xorm:      xorm,
 		PriceInfo: map[string]PriceInfo{},
+		costs:     map[providerCostKey][]ProviderPrice{},
+
+		missingCosts: map[providerCostKey]bool{},
 	}
 }
 
-// FetchProviderPrice 根据agentId、providerName、modelName获取价格信息
-// 先从本地info查找，找不到再去查询数据库，然后加入本地info
-func (m *PriceService) FetchProviderPrice(modelId string) (PriceInfo, bool) {
+// FetchProviderPrice 根据模型id获取 at 时刻生效的售价
+// 优先使用 model_price 中覆盖 at 的最新版本，没有时使用 models_info 中的价格
+func (m *PriceService) FetchProviderPrice(modelId string, at time.Time) (PriceInfo, bool) {
 
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
@@ -46,13 +62,24 @@ func (m *PriceService) FetchProviderPrice(modelId string) (PriceInfo, bool) {
 	// 	return priceInfo, true
 	// }
 
-	// 从数据库中查询
-	type ModelWithProvider struct {
-		ProviderName string `xorm:"provider_name"`
+	var version ModelPrice
+	has, err := m.xorm.Where("model_id = ? AND valid_from <= ? AND (valid_to = 0 OR valid_to > ?)", modelId, at.Unix(), at.Unix()).
+		Desc("valid_from", "id").Get(&version)
+	if err != nil {
+		logrus.Errorf("failed to fetch price version for model_id %s, error: %v", modelId, err)
+		return PriceInfo{}, false
+	}
+	if has {
+		return PriceInfo{
+			InputPrice:  Money(version.InputPrice),
+			OutputPrice: Money(version.OutputPrice),
+			CachePrice:  Money(version.CachePrice),
+		}, true
 	}
 
+	// 从数据库中查询
 	var result ModelsInfo
-	has, err := m.xorm.Where("model_id = ?", modelId).Get(&result)
+	has, err = m.xorm.Where("model_id = ?", modelId).Get(&result)
 
 	if err != nil || !has {
 		logrus.Errorf("failed to fetch price info for model_id %s, error: %v", modelId, err)
@@ -61,11 +88,70 @@ func (m *PriceService) FetchProviderPrice(modelId string) (PriceInfo, bool) {
 
 	// // 将查询结果加入本地缓存
 	priceInfo := PriceInfo{
-		InputPrice:  result.InputPrice,
-		OutputPrice: result.OutputPrice,
-		CachePrice:  result.CachePrice,
+		InputPrice:  Money(result.InputPrice),
+		OutputPrice: Money(result.OutputPrice),
+		CachePrice:  Money(result.CachePrice),
 	}
 	// m.PriceInfo[modelId] = priceInfo
 
 	return priceInfo, true
 }
+
+// FetchProviderCost 根据实际服务商id和实际模型获取 at 时刻生效的上游成本价
+// 成本价版本按服务商模型缓存，缓存未命中时在锁外查询数据库
+func (m *PriceService) FetchProviderCost(actualProviderId, actualModel string, at time.Time) (PriceInfo, bool) {
+	key := providerCostKey{providerId: actualProviderId, model: actualModel}
+
+	m.mutex.Lock()
+	versions, ok := m.costs[key]
+	m.mutex.Unlock()
+	if !ok {
+		var err error
+		if versions, err = m.loadProviderCosts(key); err != nil {
+			logrus.Errorf("failed to fetch provider cost for provider %s, model %s, error: %v", actualProviderId, actualModel, err)
+			return PriceInfo{}, false
+		}
+	}
+
+	// 多个版本覆盖同一时刻时以后生效的为准
+	for i := len(versions) - 1; i >= 0; i-- {
+		version := versions[i]
+		if version.ValidFrom <= at.Unix() && (version.ValidTo == 0 || at.Unix() < version.ValidTo) {
+			return PriceInfo{
+				InputPrice:  Money(version.InputPrice),
+				OutputPrice: Money(version.OutputPrice),
+				CachePrice:  Money(version.CachePrice),
+			}, true
+		}
+	}
+	logrus.Debugf("no provider cost for provider %s, model %s at %d", actualProviderId, actualModel, at.Unix())
+	return PriceInfo{}, false
+}
+
+// loadProviderCosts 查询服务商模型的全部成本价版本并缓存，没有任何版本的服务商模型只告警一次
+func (m *PriceService) loadProviderCosts(key providerCostKey) ([]ProviderPrice, error) {
+	var versions []ProviderPrice
+	if err := m.xorm.Where("actual_provider_id = ? AND actual_model = ?", key.providerId, key.model).
+		Asc("valid_from", "id").Find(&versions); err != nil {
+		return nil, err
+	}
+
+	m.mutex.Lock()
+	m.costs[key] = versions
+	warn := len(versions) == 0 && !m.missingCosts[key]
+	if warn {
+		m.missingCosts[key] = true
+	}
+	m.mutex.Unlock()
+	if warn {
+		logrus.Warnf("no provider cost for provider %s, model %s, margin will not be tracked", key.providerId, key.model)
+	}
+	return versions, nil
+}
+
+// ResetProviderCosts 清空成本价缓存，下次查询时重新加载
+func (m *PriceService) ResetProviderCosts() {
+	m.mutex.Lock()
+	m.costs = map[providerCostKey][]ProviderPrice{}
+	m.mutex.Unlock()
+}
@@ -0,0 +1,73 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/deepissue/core/utils"
+	"github.com/deepissue/fee_server/config"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultPricingReloadInterval = 60 * time.Second
+
+// PricingReloader 从数据库加载图片/视频价格表，并定期、收到 SIGHUP 或调用管理接口时重新加载
+// 定期加载同时让到达 valid_from 的新价格生效；新价格表校验通过后才会替换，失败时继续使用原价格表
+// 每次加载还会清空上游成本价缓存，新增的成本价在下一次加载后生效
+type PricingReloader struct {
+	price    *PriceService
+	interval time.Duration
+}
+
+func NewPricingReloader(price *PriceService, c *config.PriceSheetConfig) (*PricingReloader, error) {
+	InitImageDefault()
+	InitVideoDefault()
+	r := &PricingReloader{
+		price:    price,
+		interval: defaultPricingReloadInterval,
+	}
+	if c != nil && c.ReloadInterval > 0 {
+		r.interval = time.Duration(c.ReloadInterval) * time.Second
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Info 返回当前生效的价格表版本
+func (r *PricingReloader) Info() map[string]PriceSheetInfo {
+	return map[string]PriceSheetInfo{
+		string(ImageReportType): ImagePricing.Info(),
+		string(VideoReportType): VideoPricing.Info(),
+	}
+}
+
+// Reload 重新加载当前已生效的价格
+func (r *PricingReloader) Reload() error {
+	r.price.ResetProviderCosts()
+	if err := r.price.RefreshMediaPricing(time.Now()); err != nil {
+		logrus.Errorf("reload pricing: %v", err)
+		return err
+	}
+	return nil
+}
+
+// Run 定期重新加载价格，并响应 SIGHUP
+func (r *PricingReloader) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	sighup := utils.MakeSighupCh()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sighup:
+			logrus.Info("SIGHUP received, reloading pricing")
+			r.Reload()
+		case <-ticker.C:
+			r.Reload()
+		}
+	}
+}
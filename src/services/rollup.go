@@ -0,0 +1,244 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/deepissue/fee_server/models"
+	"github.com/sirupsen/logrus"
+	"xorm.io/xorm"
+)
+
+const rollupUpsertSQL = `INSERT INTO %s (bucket, user_id, model_id, actual_provider_id, node_id,
+	calls, input_tokens, output_tokens, cache_tokens, images, video_seconds, total_consumed, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON DUPLICATE KEY UPDATE calls = calls + VALUES(calls),
+	input_tokens = input_tokens + VALUES(input_tokens),
+	output_tokens = output_tokens + VALUES(output_tokens),
+	cache_tokens = cache_tokens + VALUES(cache_tokens),
+	images = images + VALUES(images),
+	video_seconds = video_seconds + VALUES(video_seconds),
+	total_consumed = total_consumed + VALUES(total_consumed),
+	updated_at = VALUES(updated_at)`
+
+const rollupBackfillBatch = 1000
+
+// rollupCloseDelay 一天结束后再等待的时间，跨零点提交的扣费事务仍会按前一天累加汇总，这段时间内该天不能重建
+const rollupCloseDelay = 10 * time.Minute
+
+// RollupUsage 一次调用的用量
+type RollupUsage struct {
+	InputTokens  int64
+	OutputTokens int64
+	CacheTokens  int64
+	Images       int64
+	VideoSeconds float64
+}
+
+type rollupKey struct {
+	bucket     int64
+	userId     int64
+	modelId    string
+	providerId string
+	nodeId     string
+}
+
+// RollupService 维护小时/天用量汇总表，供看板查询，避免直接扫描 user_consume
+type RollupService struct {
+	xorm      xorm.EngineInterface
+	partition *ConsumePartition
+}
+
+func NewRollupService(xorm xorm.EngineInterface, partition *ConsumePartition) *RollupService {
+	return &RollupService{xorm: xorm, partition: partition}
+}
+
+func hourBucket(ts int64) int64 {
+	return ts - ts%3600
+}
+
+func dayBucket(ts int64) int64 {
+	t := time.Unix(ts, 0)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()).Unix()
+}
+
+// rollupTables 汇总表及其时间桶，按固定顺序（先小时后天）写入：
+// 并发的扣费事务以相同顺序加锁，不会因顺序相反而死锁（MySQL 1213）导致整笔扣费重试
+var rollupTables = []struct {
+	name   string
+	bucket func(ts int64) int64
+}{
+	{models.UsageRollupHourlyTable, hourBucket},
+	{models.UsageRollupDailyTable, dayBucket},
+}
+
+// Add 在扣费事务内累加一条消费记录的用量
+func (m *RollupService) Add(session *xorm.Session, record *models.UserConsumeRecord, usage RollupUsage) error {
+	for _, table := range rollupTables {
+		if err := m.upsert(session, table.name, rollupKeyOf(table.bucket(record.CreatedAt), record), 1, usage, record.TotalConsumed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *RollupService) upsert(session *xorm.Session, table string, key rollupKey, calls int64, usage RollupUsage, consumed int64) error {
+	_, err := session.Exec(fmt.Sprintf(rollupUpsertSQL, table),
+		key.bucket, key.userId, key.modelId, key.providerId, key.nodeId,
+		calls, usage.InputTokens, usage.OutputTokens, usage.CacheTokens, usage.Images, usage.VideoSeconds,
+		consumed, time.Now().Unix())
+	if err != nil {
+		logrus.Errorf("upsert %s: %v", table, err)
+	}
+	return err
+}
+
+type rollupTotal struct {
+	calls    int64
+	usage    RollupUsage
+	consumed int64
+}
+
+func rollupKeyOf(bucket int64, record *models.UserConsumeRecord) rollupKey {
+	return rollupKey{bucket, record.UserId, record.ModelId, record.ActualProviderId, record.NodeId}
+}
+
+// rollupTotals 按 rollupTables 的顺序返回每个汇总表的空累计
+func rollupTotals() []map[rollupKey]*rollupTotal {
+	totals := make([]map[rollupKey]*rollupTotal, len(rollupTables))
+	for i := range totals {
+		totals[i] = map[rollupKey]*rollupTotal{}
+	}
+	return totals
+}
+
+// addRecordRollups 将一条消费记录的用量累加到每个汇总表对应的时间桶
+func addRecordRollups(totals []map[rollupKey]*rollupTotal, record *models.UserConsumeRecord, usage RollupUsage) {
+	for i, table := range rollupTables {
+		addRollup(totals[i], rollupKeyOf(table.bucket(record.CreatedAt), record), record.TotalConsumed, usage)
+	}
+}
+
+func addRollup(totals map[rollupKey]*rollupTotal, key rollupKey, consumed int64, usage RollupUsage) {
+	total, ok := totals[key]
+	if !ok {
+		total = &rollupTotal{}
+		totals[key] = total
+	}
+	total.calls++
+	total.consumed += consumed
+	total.usage.InputTokens += usage.InputTokens
+	total.usage.OutputTokens += usage.OutputTokens
+	total.usage.CacheTokens += usage.CacheTokens
+	total.usage.Images += usage.Images
+	total.usage.VideoSeconds += usage.VideoSeconds
+}
+
+// Backfill 根据原始消费记录重建 [start, end) 内的汇总，时间范围按天对齐，逐天在事务内删除并重建
+// 只能重建已结束的天：未结束的天仍有扣费在累加汇总，重建会与之冲突而重复或丢失用量
+func (m *RollupService) Backfill(start, end time.Time) error {
+	day := time.Unix(dayBucket(start.Unix()), 0)
+	last := time.Unix(dayBucket(end.Add(-time.Second).Unix()), 0)
+	if closeAt := last.AddDate(0, 0, 1).Add(rollupCloseDelay); time.Now().Before(closeAt) {
+		return fmt.Errorf("usage rollup of %s can not be rebuilt before the day is closed at %s",
+			last.Format("2006-01-02"), closeAt.Format(time.DateTime))
+	}
+	for day.Before(end) {
+		next := day.AddDate(0, 0, 1)
+		if err := m.backfillDay(day, next); err != nil {
+			return fmt.Errorf("backfill %s: %w", day.Format("2006-01-02"), err)
+		}
+		logrus.Infof("usage rollup of %s rebuilt", day.Format("2006-01-02"))
+		day = next
+	}
+	return nil
+}
+
+func (m *RollupService) backfillDay(start, end time.Time) error {
+	totals := rollupTotals()
+
+	err := m.partition.Each(start, end, func(tables models.ConsumeTables) error {
+		var lastId int64
+		for {
+			var records []models.UserConsumeRecord
+			if err := m.xorm.Table(tables.Record).Where("created_at >= ? AND created_at < ? AND id > ?", start.Unix(), end.Unix(), lastId).
+				Asc("id").Limit(rollupBackfillBatch).Find(&records); err != nil {
+				return err
+			}
+			if len(records) == 0 {
+				return nil
+			}
+			lastId = records[len(records)-1].ID
+
+			usages, err := m.loadUsages(tables, records)
+			if err != nil {
+				return err
+			}
+			for i := range records {
+				addRecordRollups(totals, &records[i], usages[records[i].ID])
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	session := m.xorm.NewSession()
+	defer session.Close()
+	if err := session.Begin(); err != nil {
+		return err
+	}
+	for i, table := range rollupTables {
+		if _, err := session.Exec(fmt.Sprintf("DELETE FROM %s WHERE bucket >= ? AND bucket < ?", table.name), start.Unix(), end.Unix()); err != nil {
+			return err
+		}
+		for key, total := range totals[i] {
+			if err := m.upsert(session, table.name, key, total.calls, total.usage, total.consumed); err != nil {
+				return err
+			}
+		}
+	}
+	return session.Commit()
+}
+
+// loadUsages 从明细表读取消费记录对应的用量
+func (m *RollupService) loadUsages(tables models.ConsumeTables, records []models.UserConsumeRecord) (map[int64]RollupUsage, error) {
+	ids := make([]int64, 0, len(records))
+	for _, record := range records {
+		ids = append(ids, record.ID)
+	}
+	usages := make(map[int64]RollupUsage, len(records))
+
+	var texts []models.UserConsumeDetailText
+	if err := m.xorm.Table(tables.Text).In("consume_id", ids).Find(&texts); err != nil {
+		return nil, err
+	}
+	for _, text := range texts {
+		usage := usages[text.ConsumdId]
+		usage.InputTokens += text.InputTokens
+		usage.OutputTokens += text.OutputTokens
+		usage.CacheTokens += text.CacheTokens
+		usages[text.ConsumdId] = usage
+	}
+
+	var images []models.UserConsumeDetailImage
+	if err := m.xorm.Table(tables.Image).In("consume_id", ids).Find(&images); err != nil {
+		return nil, err
+	}
+	for _, image := range images {
+		usage := usages[image.ConsumdId]
+		usage.Images += image.Count
+		usages[image.ConsumdId] = usage
+	}
+
+	var videos []models.UserConsumeDetailVideo
+	if err := m.xorm.Table(tables.Video).In("consume_id", ids).Find(&videos); err != nil {
+		return nil, err
+	}
+	for _, video := range videos {
+		usage := usages[video.ConsumdId]
+		usage.VideoSeconds += video.Seconds
+		usages[video.ConsumdId] = usage
+	}
+	return usages, nil
+}
@@ -0,0 +1,84 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepissue/fee_server/models"
+)
+
+// 未结束的天不能重建，检查在访问数据库之前完成
+func TestBackfillRefusesOpenDays(t *testing.T) {
+	rollup := NewRollupService(nil, nil)
+	today := time.Unix(dayBucket(time.Now().Unix()), 0)
+	cases := map[string][2]time.Time{
+		"today":              {today, today.AddDate(0, 0, 1)},
+		"range ending today": {today.AddDate(0, 0, -3), today.AddDate(0, 0, 1)},
+		"future day":         {today.AddDate(0, 0, 1), today.AddDate(0, 0, 2)},
+		"partial day":        {today.AddDate(0, 0, -1), today.Add(time.Hour)},
+	}
+	for name, period := range cases {
+		err := rollup.Backfill(period[0], period[1])
+		if err == nil || !strings.Contains(err.Error(), "is closed") {
+			t.Errorf("%s: expected the open day to be refused, got %v", name, err)
+		}
+	}
+}
+
+// 汇总表按固定顺序写入，避免并发扣费以相反顺序加锁
+func TestRollupTableOrder(t *testing.T) {
+	if len(rollupTables) != 2 || rollupTables[0].name != models.UsageRollupHourlyTable || rollupTables[1].name != models.UsageRollupDailyTable {
+		t.Fatalf("rollup tables must be written hourly then daily, got %+v", rollupTables)
+	}
+}
+
+// 重建时每条记录按小时、按天归入时间桶，同一桶内的调用次数、用量和金额累加
+func TestRollupTotals(t *testing.T) {
+	day := time.Date(2025, 11, 3, 0, 0, 0, 0, time.Local)
+	at := func(hour, minute int) int64 {
+		return day.Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute).Unix()
+	}
+	record := func(userId int64, createdAt, consumed int64) *models.UserConsumeRecord {
+		return &models.UserConsumeRecord{UserId: userId, ModelId: "m-gpt-4o", ActualProviderId: "p-openai", NodeId: "node-1",
+			TotalConsumed: consumed, CreatedAt: createdAt}
+	}
+	totals := rollupTotals()
+	addRecordRollups(totals, record(42, at(10, 15), 100), RollupUsage{InputTokens: 10, OutputTokens: 5})
+	addRecordRollups(totals, record(42, at(10, 45), 200), RollupUsage{InputTokens: 20, OutputTokens: 10, CacheTokens: 4})
+	addRecordRollups(totals, record(42, at(14, 5), 300), RollupUsage{Images: 2})
+	addRecordRollups(totals, record(43, at(10, 20), 50), RollupUsage{VideoSeconds: 1.5})
+	addRecordRollups(totals, record(42, at(24, 0), 70), RollupUsage{InputTokens: 1})
+
+	key := func(bucket, userId int64) rollupKey {
+		return rollupKey{bucket, userId, "m-gpt-4o", "p-openai", "node-1"}
+	}
+	next := day.AddDate(0, 0, 1).Unix()
+	hourly := map[rollupKey]rollupTotal{
+		key(at(10, 0), 42): {calls: 2, consumed: 300, usage: RollupUsage{InputTokens: 30, OutputTokens: 15, CacheTokens: 4}},
+		key(at(14, 0), 42): {calls: 1, consumed: 300, usage: RollupUsage{Images: 2}},
+		key(at(10, 0), 43): {calls: 1, consumed: 50, usage: RollupUsage{VideoSeconds: 1.5}},
+		key(next, 42):      {calls: 1, consumed: 70, usage: RollupUsage{InputTokens: 1}},
+	}
+	daily := map[rollupKey]rollupTotal{
+		key(day.Unix(), 42): {calls: 3, consumed: 600, usage: RollupUsage{InputTokens: 30, OutputTokens: 15, CacheTokens: 4, Images: 2}},
+		key(day.Unix(), 43): {calls: 1, consumed: 50, usage: RollupUsage{VideoSeconds: 1.5}},
+		key(next, 42):       {calls: 1, consumed: 70, usage: RollupUsage{InputTokens: 1}},
+	}
+	for i, want := range []map[rollupKey]rollupTotal{hourly, daily} {
+		table := rollupTables[i].name
+		if len(totals[i]) != len(want) {
+			t.Errorf("%s: %d buckets, want %d", table, len(totals[i]), len(want))
+		}
+		for k, w := range want {
+			got, ok := totals[i][k]
+			if !ok {
+				t.Errorf("%s: missing bucket %s user %d", table, time.Unix(k.bucket, 0).Format(time.DateTime), k.userId)
+				continue
+			}
+			if *got != w {
+				t.Errorf("%s: bucket %s user %d = %+v, want %+v", table, time.Unix(k.bucket, 0).Format(time.DateTime), k.userId, *got, w)
+			}
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package services
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/deepissue/fee_server/config"
+	"github.com/deepissue/fee_server/models"
+	"github.com/sirupsen/logrus"
+	"xorm.io/xorm"
+)
+
+const (
+	SettlementOpen   = "open"
+	SettlementLocked = "locked"
+
+	PartyNode     = "node"
+	PartyProvider = "provider"
+)
+
+// SettlementReport 一个结算周期的结算单
+type SettlementReport struct {
+	Period models.SettlementPeriod      `json:"period"`
+	Lines  []models.SettlementStatement `json:"lines"`
+}
+
+type settlementAggregate struct {
+	PartyId      string `xorm:"'party_id'"`
+	Calls        int64  `xorm:"'calls'"`
+	GrossAmount  int64  `xorm:"'gross_amount'"`
+	ProviderCost int64  `xorm:"'provider_cost'"`
+}
+
+// SettlementService 按节点和实际服务商汇总用户消费并生成结算单
+type SettlementService struct {
+	xorm      xorm.EngineInterface
+	partition *ConsumePartition
+	config    *config.SettlementConfig
+}
+
+func NewSettlementService(xorm xorm.EngineInterface, partition *ConsumePartition, c *config.SettlementConfig) (*SettlementService, error) {
+	if c == nil {
+		return nil, errors.New("settlement config is missing")
+	}
+	return &SettlementService{xorm: xorm, partition: partition, config: c}, nil
+}
+
+// MonthPeriod 返回 YYYY-MM 对应的结算周期 [start, end)
+func MonthPeriod(month string) (time.Time, time.Time, error) {
+	start, err := time.ParseInLocation("2006-01", month, time.Local)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid period %q, expected YYYY-MM: %w", month, err)
+	}
+	return start, start.AddDate(0, 1, 0), nil
+}
+
+// PreviousMonth 返回 at 所在月份的上一个月（YYYY-MM）
+// 从当月 1 日往前推，避免 3 月 31 日 AddDate(0, -1, 0) 落到 3 月 3 日
+func PreviousMonth(at time.Time) string {
+	first := time.Date(at.Year(), at.Month(), 1, 0, 0, 0, 0, at.Location())
+	return first.AddDate(0, -1, 0).Format("2006-01")
+}
+
+// Settle 结算 [start, end) 周期并锁定
+// 所有尚未结算且创建时间早于 end 的记录都计入本期，因此上一期锁定后才到达的记录会滚入本期。
+// 已锁定的周期直接返回已有结算单。
+func (m *SettlementService) Settle(start, end time.Time) (*SettlementReport, error) {
+	period := models.SettlementPeriod{PeriodStart: start.Unix()}
+	has, err := m.xorm.Get(&period)
+	if err != nil {
+		return nil, err
+	}
+	if has && period.Status == SettlementLocked {
+		logrus.Infof("settlement period %s already locked", start.Format("2006-01-02"))
+		return m.Report(period.ID)
+	}
+
+	// 未结算的记录只可能出现在上一个已锁定周期开始之后的分表中，没有已锁定周期时回溯一年
+	scanFrom := start.AddDate(-1, 0, 0)
+	var last models.SettlementPeriod
+	if found, err := m.xorm.Where("status = ? AND period_start < ?", SettlementLocked, start.Unix()).Desc("period_start").Get(&last); err != nil {
+		return nil, err
+	} else if found {
+		scanFrom = time.Unix(last.PeriodStart, 0)
+	}
+	tables, err := m.partition.Tables(scanFrom, end)
+	if err != nil {
+		return nil, err
+	}
+
+	session := m.xorm.NewSession()
+	defer session.Close()
+	if err := session.Begin(); err != nil {
+		return nil, err
+	}
+
+	if !has {
+		period = models.SettlementPeriod{
+			PeriodStart: start.Unix(),
+			PeriodEnd:   end.Unix(),
+			Status:      SettlementOpen,
+		}
+		if _, err := session.InsertOne(&period); err != nil {
+			return nil, err
+		}
+	}
+
+	parties := []struct {
+		partyType string
+		column    string
+		percent   float64
+	}{
+		{PartyNode, "node_id", m.config.NodeSharePercent},
+		{PartyProvider, "actual_provider_id", m.config.ProviderSharePercent},
+	}
+	totals := make([]map[string]*settlementAggregate, len(parties))
+	for i := range totals {
+		totals[i] = map[string]*settlementAggregate{}
+	}
+
+	for _, t := range tables {
+		// 先在事务内锁定记录再按周期id 汇总：UPDATE 是当前读，普通 SELECT 读的是快照，
+		// 先汇总后锁定时，期间提交的记录会被锁定进本期却不在结算单中，之后再也不会结算
+		result, err := session.Exec(fmt.Sprintf("UPDATE %s SET settle_period_id = ? WHERE settle_period_id = 0 AND created_at < ?", t.Record),
+			period.ID, end.Unix())
+		if err != nil {
+			return nil, err
+		}
+		if locked, err := result.RowsAffected(); err != nil {
+			return nil, err
+		} else if locked == 0 {
+			continue
+		}
+
+		for i, party := range parties {
+			var aggregates []settlementAggregate
+			sql := fmt.Sprintf(`SELECT %[1]s AS party_id, COUNT(*) AS calls,
+				SUM(total_consumed) AS gross_amount, SUM(provider_cost) AS provider_cost
+				FROM %[2]s WHERE settle_period_id = ? GROUP BY %[1]s`, party.column, t.Record)
+			if err := session.SQL(sql, period.ID).Find(&aggregates); err != nil {
+				return nil, err
+			}
+			for _, agg := range aggregates {
+				total, ok := totals[i][agg.PartyId]
+				if !ok {
+					total = &settlementAggregate{PartyId: agg.PartyId}
+					totals[i][agg.PartyId] = total
+				}
+				total.Calls += agg.Calls
+				total.GrossAmount += agg.GrossAmount
+				total.ProviderCost += agg.ProviderCost
+			}
+		}
+	}
+
+	var lines []models.SettlementStatement
+	for i, party := range parties {
+		ids := make([]string, 0, len(totals[i]))
+		for id := range totals[i] {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			agg := totals[i][id]
+			lines = append(lines, models.SettlementStatement{
+				PeriodId:     period.ID,
+				PartyType:    party.partyType,
+				PartyId:      agg.PartyId,
+				Calls:        agg.Calls,
+				GrossAmount:  agg.GrossAmount,
+				ProviderCost: agg.ProviderCost,
+				SharePercent: party.percent,
+				PayoutAmount: sharePayout(agg.GrossAmount, party.percent),
+			})
+		}
+	}
+
+	if len(lines) > 0 {
+		if _, err := session.Insert(&lines); err != nil {
+			logrus.Errorf("insert settlement statements: %v", err)
+			return nil, err
+		}
+	}
+
+	period.Status = SettlementLocked
+	period.LockedAt = time.Now().Unix()
+	if _, err := session.ID(period.ID).Cols("status", "locked_at").Update(&period); err != nil {
+		return nil, err
+	}
+
+	if err := session.Commit(); err != nil {
+		return nil, err
+	}
+	logrus.Infof("settlement period %s locked, %d statement lines", start.Format("2006-01-02"), len(lines))
+	return &SettlementReport{Period: period, Lines: lines}, nil
+}
+
+// Report 读取已生成的结算单
+func (m *SettlementService) Report(periodId int64) (*SettlementReport, error) {
+	report := &SettlementReport{}
+	has, err := m.xorm.ID(periodId).Get(&report.Period)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, fmt.Errorf("settlement period not found: %d", periodId)
+	}
+	if err := m.xorm.Where("period_id = ?", periodId).Asc("party_type", "party_id").Find(&report.Lines); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// sharePayout 按分成比例计算结算金额，比例精确到 0.01%，向下取整
+func sharePayout(amount int64, percent float64) int64 {
+	bps := int64(math.Round(percent * 100))
+	return amount * bps / 10000
+}
+
+// WriteJSON 以 JSON 格式导出结算单
+func (r *SettlementReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteCSV 以 CSV 格式导出结算单
+func (r *SettlementReport) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	header := []string{"period_start", "period_end", "party_type", "party_id", "calls",
+		"gross_amount", "provider_cost", "share_percent", "payout_amount"}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	start := time.Unix(r.Period.PeriodStart, 0).Format("2006-01-02")
+	end := time.Unix(r.Period.PeriodEnd, 0).Format("2006-01-02")
+	for _, line := range r.Lines {
+		row := []string{
+			start, end, line.PartyType, line.PartyId,
+			strconv.FormatInt(line.Calls, 10),
+			strconv.FormatInt(line.GrossAmount, 10),
+			strconv.FormatInt(line.ProviderCost, 10),
+			strconv.FormatFloat(line.SharePercent, 'f', -1, 64),
+			strconv.FormatInt(line.PayoutAmount, 10),
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
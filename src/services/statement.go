@@ -0,0 +1,292 @@
+package services
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deepissue/fee_server/models"
+	"github.com/sirupsen/logrus"
+	"xorm.io/xorm"
+)
+
+// StatementLine 账单中按模型和调用类型汇总的消费
+type StatementLine struct {
+	ModelId    string `json:"model_id" xorm:"'model_id'"`
+	Model      string `json:"model" xorm:"'model'"`
+	ReportType string `json:"report_type" xorm:"'report_type'"`
+	Calls      int64  `json:"calls" xorm:"'calls'"`
+	Amount     int64  `json:"amount" xorm:"'amount'"`
+	Discount   int64  `json:"discount" xorm:"'discount'"`
+}
+
+// Statement 用户月度账单（金额单位：微代币）
+type Statement struct {
+	UserId         int64           `json:"user_id"`
+	Month          string          `json:"month"`
+	PeriodStart    int64           `json:"period_start"`
+	PeriodEnd      int64           `json:"period_end"`
+	OpeningBalance int64           `json:"opening_balance"`
+	TopUps         int64           `json:"top_ups"`
+	Consumed       int64           `json:"consumed"`
+	Discounts      int64           `json:"discounts"`
+	ClosingBalance int64           `json:"closing_balance"`
+	Lines          []StatementLine `json:"lines"`
+	GeneratedAt    int64           `json:"generated_at"`
+
+	Display *StatementDisplay `json:"display,omitempty"` // 按请求币种换算的展示金额，不保存
+}
+
+// StatementService 生成并查询用户月度账单
+type StatementService struct {
+	xorm      xorm.EngineInterface
+	partition *ConsumePartition
+}
+
+func NewStatementService(xorm xorm.EngineInterface, partition *ConsumePartition) *StatementService {
+	return &StatementService{xorm: xorm, partition: partition}
+}
+
+// Run 每小时为上个月还没有账单的用户生成账单，上次失败的用户会在下次检查时重试
+func (m *StatementService) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		month := PreviousMonth(time.Now())
+		if err := m.GenerateMonth(month); err != nil {
+			logrus.Errorf("generate statements of %s: %v", month, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// GenerateMonth 为所有钱包用户生成指定月份的账单，已存在的账单会被跳过，组织钱包不生成用户账单
+func (m *StatementService) GenerateMonth(month string) error {
+	var userIds []int64
+	if err := m.xorm.Table(&models.UserWallet{}).Where("org_id = 0").Distinct("user_id").Find(&userIds); err != nil {
+		return err
+	}
+	generated := 0
+	for _, userId := range userIds {
+		if has, err := m.xorm.Where("user_id = ? AND month = ?", userId, month).Exist(&models.UserStatement{}); err != nil {
+			return err
+		} else if has {
+			continue
+		}
+		statement, err := m.Generate(userId, month)
+		if err != nil {
+			logrus.Errorf("generate statement for user %d of %s: %v", userId, month, err)
+			continue
+		}
+		if err := m.save(statement); err != nil {
+			logrus.Errorf("save statement for user %d of %s: %v", userId, month, err)
+			continue
+		}
+		generated++
+	}
+	if generated > 0 {
+		logrus.Infof("generated %d statements of %s", generated, month)
+	}
+	return nil
+}
+
+// Generate 根据钱包、充值记录和消费记录计算用户某月账单
+func (m *StatementService) Generate(userId int64, month string) (*Statement, error) {
+	start, end, err := MonthPeriod(month)
+	if err != nil {
+		return nil, err
+	}
+	statement := &Statement{
+		UserId:      userId,
+		Month:       month,
+		PeriodStart: start.Unix(),
+		PeriodEnd:   end.Unix(),
+		GeneratedAt: time.Now().Unix(),
+	}
+
+	// 优先沿用上月账单的期末余额作为期初余额
+	previous := models.UserStatement{}
+	has, err := m.xorm.Where("user_id = ? AND month = ?", userId, start.AddDate(0, -1, 0).Format("2006-01")).Get(&previous)
+	if err != nil {
+		return nil, err
+	}
+	if has {
+		statement.OpeningBalance = previous.ClosingBalance
+	} else if statement.OpeningBalance, err = m.balanceAt(userId, start); err != nil {
+		return nil, err
+	}
+
+	if _, err := m.xorm.SQL("SELECT COALESCE(SUM(amount), 0) FROM user_recharge WHERE user_id = ? AND created_at >= ? AND created_at < ?",
+		userId, statement.PeriodStart, statement.PeriodEnd).Get(&statement.TopUps); err != nil {
+		return nil, err
+	}
+
+	// 组织钱包的消费计入组织，不计入成员的个人账单
+	merged := map[[2]string]*StatementLine{}
+	err = m.partition.Each(start, end, func(tables models.ConsumeTables) error {
+		var lines []StatementLine
+		err := m.xorm.SQL(fmt.Sprintf(`SELECT model_id, MAX(model) AS model, consume_type AS report_type, COUNT(*) AS calls,
+			SUM(total_consumed) AS amount, SUM(discount_amount) AS discount
+			FROM %s WHERE user_id = ? AND org_id = 0 AND created_at >= ? AND created_at < ?
+			GROUP BY model_id, consume_type`, tables.Record),
+			userId, statement.PeriodStart, statement.PeriodEnd).Find(&lines)
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			key := [2]string{line.ModelId, line.ReportType}
+			if total, ok := merged[key]; ok {
+				total.Calls += line.Calls
+				total.Amount += line.Amount
+				total.Discount += line.Discount
+				continue
+			}
+			merged[key] = &line
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range merged {
+		statement.Lines = append(statement.Lines, *line)
+		statement.Consumed += line.Amount
+		statement.Discounts += line.Discount
+	}
+	sort.Slice(statement.Lines, func(i, j int) bool {
+		if statement.Lines[i].ModelId != statement.Lines[j].ModelId {
+			return statement.Lines[i].ModelId < statement.Lines[j].ModelId
+		}
+		return statement.Lines[i].ReportType < statement.Lines[j].ReportType
+	})
+	statement.ClosingBalance = statement.OpeningBalance + statement.TopUps - statement.Consumed
+	return statement, nil
+}
+
+// balanceAt 由当前余额倒推某一时刻的余额：当前余额 + 之后的消费 - 之后的充值
+func (m *StatementService) balanceAt(userId int64, at time.Time) (int64, error) {
+	var balance, topUps int64
+	if _, err := m.xorm.SQL("SELECT COALESCE(SUM(balance), 0) FROM user_wallet WHERE user_id = ?", userId).Get(&balance); err != nil {
+		return 0, err
+	}
+	consumed, err := m.partition.SumInt64(at, time.Now().AddDate(0, 1, 0),
+		"SELECT COALESCE(SUM(total_consumed), 0) FROM %s WHERE user_id = ? AND org_id = 0 AND created_at >= ?", userId, at.Unix())
+	if err != nil {
+		return 0, err
+	}
+	if _, err := m.xorm.SQL("SELECT COALESCE(SUM(amount), 0) FROM user_recharge WHERE user_id = ? AND created_at >= ?", userId, at.Unix()).Get(&topUps); err != nil {
+		return 0, err
+	}
+	return balance + consumed - topUps, nil
+}
+
+func (m *StatementService) save(statement *Statement) error {
+	content, err := json.Marshal(statement)
+	if err != nil {
+		return err
+	}
+	_, err = m.xorm.InsertOne(&models.UserStatement{
+		UserId:         statement.UserId,
+		Month:          statement.Month,
+		OpeningBalance: statement.OpeningBalance,
+		TopUps:         statement.TopUps,
+		Consumed:       statement.Consumed,
+		Discounts:      statement.Discounts,
+		ClosingBalance: statement.ClosingBalance,
+		Content:        string(content),
+	})
+	return err
+}
+
+// Find 查询已生成的账单
+func (m *StatementService) Find(userId int64, month string) (*Statement, bool, error) {
+	record := models.UserStatement{}
+	has, err := m.xorm.Where("user_id = ? AND month = ?", userId, month).Get(&record)
+	if err != nil || !has {
+		return nil, false, err
+	}
+	statement := &Statement{}
+	if err := json.Unmarshal([]byte(record.Content), statement); err != nil {
+		return nil, false, err
+	}
+	return statement, true, nil
+}
+
+// WriteCSV 以 CSV 格式导出账单，先输出汇总再输出明细；附加了展示金额时每行追加换算后的金额列
+func (s *Statement) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	header := []string{"user_id", "month", "opening_balance", "top_ups", "consumed", "discounts", "closing_balance"}
+	summary := []string{strconv.FormatInt(s.UserId, 10), s.Month,
+		strconv.FormatInt(s.OpeningBalance, 10), strconv.FormatInt(s.TopUps, 10),
+		strconv.FormatInt(s.Consumed, 10), strconv.FormatInt(s.Discounts, 10),
+		strconv.FormatInt(s.ClosingBalance, 10)}
+	lineHeader := []string{"model_id", "model", "report_type", "calls", "amount", "discount"}
+
+	// 指定了展示币种时，换算后的金额作为额外的列跟在微代币金额之后，例如 consumed_usd
+	d := s.Display
+	if d != nil {
+		suffix := "_" + strings.ToLower(d.Currency)
+		header = append(header, "currency", "rate", "opening_balance"+suffix, "top_ups"+suffix,
+			"consumed"+suffix, "discounts"+suffix, "closing_balance"+suffix)
+		summary = append(summary, d.Currency, strconv.FormatInt(d.Rate, 10), d.OpeningBalance, d.TopUps,
+			d.Consumed, d.Discounts, d.ClosingBalance)
+		lineHeader = append(lineHeader, "amount"+suffix, "discount"+suffix)
+	}
+
+	rows := [][]string{header, summary, {}, lineHeader}
+	for i, line := range s.Lines {
+		row := []string{line.ModelId, line.Model, line.ReportType,
+			strconv.FormatInt(line.Calls, 10), strconv.FormatInt(line.Amount, 10), strconv.FormatInt(line.Discount, 10)}
+		if d != nil {
+			row = append(row, d.Lines[i].Amount, d.Lines[i].Discount)
+		}
+		rows = append(rows, row)
+	}
+	if err := writer.WriteAll(rows); err != nil {
+		return err
+	}
+	return writer.Error()
+}
+
+var statementTemplate = template.Must(template.New("statement").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Statement {{.Month}}</title></head>
+<body>
+<h2>Statement {{.Month}} - User {{.UserId}}</h2>
+{{$d := .Display}}{{with $d}}<p>Amounts in {{.Currency}} at {{.Rate}} micro-coins per {{.Currency}}</p>
+{{end}}<table border="1" cellpadding="4">
+<tr><th></th><th>Micro-coins</th>{{with $d}}<th>{{.Currency}}</th>{{end}}</tr>
+<tr><th>Opening balance</th><td>{{.OpeningBalance}}</td>{{with $d}}<td>{{.OpeningBalance}}</td>{{end}}</tr>
+<tr><th>Top-ups</th><td>{{.TopUps}}</td>{{with $d}}<td>{{.TopUps}}</td>{{end}}</tr>
+<tr><th>Consumed</th><td>{{.Consumed}}</td>{{with $d}}<td>{{.Consumed}}</td>{{end}}</tr>
+<tr><th>Discounts</th><td>{{.Discounts}}</td>{{with $d}}<td>{{.Discounts}}</td>{{end}}</tr>
+<tr><th>Closing balance</th><td>{{.ClosingBalance}}</td>{{with $d}}<td>{{.ClosingBalance}}</td>{{end}}</tr>
+</table>
+<h3>Consumption</h3>
+<table border="1" cellpadding="4">
+<tr><th>Model</th><th>Type</th><th>Calls</th><th>Amount</th><th>Discount</th>{{with $d}}<th>Amount ({{.Currency}})</th><th>Discount ({{.Currency}})</th>{{end}}</tr>
+{{range $i, $line := .Lines}}<tr><td>{{.Model}} ({{.ModelId}})</td><td>{{.ReportType}}</td><td>{{.Calls}}</td><td>{{.Amount}}</td><td>{{.Discount}}</td>{{with $d}}{{with index .Lines $i}}<td>{{.Amount}}</td><td>{{.Discount}}</td>{{end}}{{end}}</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// WriteHTML 将账单渲染为 HTML
+func (s *Statement) WriteHTML(w io.Writer) error {
+	if err := statementTemplate.Execute(w, s); err != nil {
+		return fmt.Errorf("render statement: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package services
+
+import (
+	"bytes"
+	"encoding/csv"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/deepissue/fee_server/models"
+)
+
+func sampleStatement() *Statement {
+	return &Statement{
+		UserId:         42,
+		Month:          "2025-10",
+		OpeningBalance: 5_000_000,
+		TopUps:         10_000_000,
+		Consumed:       3_000_000,
+		Discounts:      500_000,
+		ClosingBalance: 12_000_000,
+		Lines: []StatementLine{
+			{ModelId: "m-gpt-4o", Model: "gpt-4o", ReportType: "text", Calls: 12, Amount: 2_000_000, Discount: 500_000},
+			{ModelId: "m-sora-2", Model: "sora-2", ReportType: "video", Calls: 1, Amount: 1_000_000},
+		},
+	}
+}
+
+func readCSV(t *testing.T, statement *Statement) [][]string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := statement.WriteCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	reader := csv.NewReader(&buf)
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestStatementCSV(t *testing.T) {
+	rows := readCSV(t, sampleStatement())
+	want := [][]string{
+		{"user_id", "month", "opening_balance", "top_ups", "consumed", "discounts", "closing_balance"},
+		{"42", "2025-10", "5000000", "10000000", "3000000", "500000", "12000000"},
+		{"model_id", "model", "report_type", "calls", "amount", "discount"},
+		{"m-gpt-4o", "gpt-4o", "text", "12", "2000000", "500000"},
+		{"m-sora-2", "sora-2", "video", "1", "1000000", "0"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("csv rows:\n got %q\nwant %q", rows, want)
+	}
+}
+
+// 指定展示币种后，换算金额作为额外的列出现在汇总和明细中
+func TestStatementCSVCurrency(t *testing.T) {
+	statement := sampleStatement()
+	statement.Display = statementDisplay(statement, models.ExchangeRate{Currency: CurrencyUSD, MicroCoins: 2_000_000})
+	rows := readCSV(t, statement)
+	want := [][]string{
+		{"user_id", "month", "opening_balance", "top_ups", "consumed", "discounts", "closing_balance",
+			"currency", "rate", "opening_balance_usd", "top_ups_usd", "consumed_usd", "discounts_usd", "closing_balance_usd"},
+		{"42", "2025-10", "5000000", "10000000", "3000000", "500000", "12000000",
+			"USD", "2000000", "2.500000", "5.000000", "1.500000", "0.250000", "6.000000"},
+		{"model_id", "model", "report_type", "calls", "amount", "discount", "amount_usd", "discount_usd"},
+		{"m-gpt-4o", "gpt-4o", "text", "12", "2000000", "500000", "1.000000", "0.250000"},
+		{"m-sora-2", "sora-2", "video", "1", "1000000", "0", "0.500000", "0.000000"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("csv rows:\n got %q\nwant %q", rows, want)
+	}
+}
+
+func TestStatementHTMLCurrency(t *testing.T) {
+	statement := sampleStatement()
+	var plain bytes.Buffer
+	if err := statement.WriteHTML(&plain); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(plain.String(), "USD") {
+		t.Errorf("html without currency should not mention USD")
+	}
+
+	statement.Display = statementDisplay(statement, models.ExchangeRate{Currency: CurrencyUSD, MicroCoins: 2_000_000})
+	var buf bytes.Buffer
+	if err := statement.WriteHTML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	html := buf.String()
+	for _, want := range []string{
+		"<th>USD</th>",
+		"<tr><th>Consumed</th><td>3000000</td><td>1.500000</td></tr>",
+		"<th>Amount (USD)</th><th>Discount (USD)</th>",
+		"<td>2000000</td><td>500000</td><td>1.000000</td><td>0.250000</td></tr>",
+		"<td>1000000</td><td>0</td><td>0.500000</td><td>0.000000</td></tr>",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("html does not contain %q:\n%s", want, html)
+		}
+	}
+}
@@ -1,13 +1,33 @@
 package services
 
+import (
+	"fmt"
+	"math/big"
+)
+
 const MICRO = 1_000_000 // 1 代币 = 1_000_000 微代币
 
 // usedTokens: 实际使用的 token 数
-// priceCredits: 价格 coins/1M（例如 20）
-// 返回值：微代币（int64）
-func CalculateTokenCostMicro(usedTokens int64, priceCredits float64) int64 {
-	// 每个 token 的微代币价格
-	pricePerTokenMicro := (priceCredits * MICRO) / float64(MICRO)
-	totalCost := float64(usedTokens) * pricePerTokenMicro
-	return int64(totalCost + 0.5) // 四舍五入
+// price: 价格 coins/1M（例如 20），即每个 token 的微代币数
+// 返回值：微代币，整数相乘，无需取整；超出 int64 范围时返回错误，不能回绕成负数给钱包充值
+func CalculateTokenCost(usedTokens int64, price Money) (Money, error) {
+	return checkedMoney(tokenCost(usedTokens, price))
+}
+
+// CalculateTextCost 按输入/输出 token 价格计算文本调用费用，超出 int64 范围时返回错误
+func CalculateTextCost(usage TokenUsage, price PriceInfo) (Money, error) {
+	input := tokenCost(usage.InputTokens, price.InputPrice)
+	output := tokenCost(usage.OutputTokens, price.OutputPrice)
+	return checkedMoney(input.Add(input, output))
+}
+
+func tokenCost(usedTokens int64, price Money) *big.Int {
+	return new(big.Int).Mul(big.NewInt(usedTokens), big.NewInt(price.Micro()))
+}
+
+func checkedMoney(amount *big.Int) (Money, error) {
+	if !amount.IsInt64() {
+		return 0, fmt.Errorf("amount %s micro-coins out of range", amount)
+	}
+	return Money(amount.Int64()), nil
 }
@@ -0,0 +1,157 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/deepissue/fee_server/config"
+)
+
+// RejectReason 消息被拒绝并转入死信主题的原因，写入死信消息的 Fee-Reason 头和 fee_rejected_total 指标
+type RejectReason string
+
+const (
+	RejectDecode             RejectReason = "decode_failed"
+	RejectMissingId          RejectReason = "missing_id"
+	RejectFutureTimestamp    RejectReason = "future_timestamp"
+	RejectStaleTimestamp     RejectReason = "stale_timestamp"
+	RejectInvalidCaller      RejectReason = "invalid_caller"
+	RejectUnknownCallerKey   RejectReason = "unknown_caller_key"
+	RejectCallerMismatch     RejectReason = "caller_mismatch"
+	RejectMissingModel       RejectReason = "missing_model"
+	RejectUnknownReportType  RejectReason = "unknown_report_type"
+	RejectInvalidUsage       RejectReason = "invalid_usage"
+	RejectUsageMismatch      RejectReason = "usage_mismatch"
+	RejectTokensOutOfRange   RejectReason = "tokens_out_of_range"
+	RejectUnknownImageOption RejectReason = "unknown_image_option"
+	RejectUnknownVideoOption RejectReason = "unknown_video_option"
+	RejectPriceNotFound      RejectReason = "price_not_found"
+	RejectMaxDeliver         RejectReason = "max_deliver"
+	RejectFailed             RejectReason = "failed" // 其他不可重试的错误
+)
+
+// RejectError 带拒绝原因的错误，消息不会重新投递
+type RejectError struct {
+	Reason RejectReason
+	CallId string
+	Detail string
+}
+
+func (e *RejectError) Error() string {
+	return fmt.Sprintf("%s: call %q: %s", e.Reason, e.CallId, e.Detail)
+}
+
+func rejectf(reason RejectReason, callId string, format string, args ...any) *RejectError {
+	return &RejectError{Reason: reason, CallId: callId, Detail: fmt.Sprintf(format, args...)}
+}
+
+// RejectReasonOf 返回错误对应的拒绝原因，非 RejectError 时为 RejectFailed
+func RejectReasonOf(err error) RejectReason {
+	var reject *RejectError
+	if errors.As(err, &reject) {
+		return reject.Reason
+	}
+	return RejectFailed
+}
+
+// maxCallTokens 一次调用每类 token 数的上限，远超任何模型的上下文长度，超过时视为上报错误
+const maxCallTokens = 1_000_000_000
+
+const (
+	defaultMaxClockSkew = 5 * time.Minute
+	defaultMaxLateness  = 7 * 24 * time.Hour
+)
+
+// ReportWindow 调用时间（timestamp）的允许范围：最多超前当前时间 maxClockSkew，最多落后 maxLateness
+// 超前的时间会按未来的价格计费，过旧的调用可能属于已结算的周期，都拒绝
+type ReportWindow struct {
+	maxClockSkew time.Duration
+	maxLateness  time.Duration
+}
+
+func NewReportWindow(c *config.ReportConfig) ReportWindow {
+	w := ReportWindow{maxClockSkew: defaultMaxClockSkew, maxLateness: defaultMaxLateness}
+	if c == nil {
+		return w
+	}
+	if c.MaxClockSkew > 0 {
+		w.maxClockSkew = time.Duration(c.MaxClockSkew) * time.Second
+	}
+	if c.MaxLateness > 0 {
+		w.maxLateness = time.Duration(c.MaxLateness) * time.Second
+	}
+	return w
+}
+
+// Validate 计费前校验调用上报，返回 *RejectError
+// 携带 timestamp 时必须落在 now 的 window 范围内，未携带时按 now 计费；
+// 文本调用按 model_id 取价，图片/视频按 model 和价格表中的质量、尺寸、分辨率取价；
+// report_type 为空时按文本处理，与早期上报兼容
+func (l *LLMCallData) Validate(window ReportWindow, now time.Time) error {
+	if l.Id == "" {
+		return rejectf(RejectMissingId, l.Id, "id is empty")
+	}
+	if l.Timestamp > 0 {
+		at := time.Unix(l.Timestamp, 0)
+		if ahead := at.Sub(now); ahead > window.maxClockSkew {
+			return rejectf(RejectFutureTimestamp, l.Id, "timestamp %d is %s ahead of now, max clock skew %s", l.Timestamp, ahead, window.maxClockSkew)
+		}
+		if late := now.Sub(at); late > window.maxLateness {
+			return rejectf(RejectStaleTimestamp, l.Id, "timestamp %d is %s old, max lateness %s", l.Timestamp, late, window.maxLateness)
+		}
+	}
+	// 携带 caller_key 时账户由 AccountService.Resolve 按 key 解析，caller 可以为空
+	if l.CallerKey == "" || l.Caller != "" {
+		if _, err := l.ParseUserId(); err != nil {
+			return rejectf(RejectInvalidCaller, l.Id, "caller %q: %v", l.Caller, err)
+		}
+	}
+
+	switch l.ReportType {
+	case "", TextReportType:
+		if l.ModelId == "" {
+			return rejectf(RejectMissingModel, l.Id, "model_id is empty")
+		}
+		var usage TokenUsage
+		if err := l.decodeUsage(&usage); err != nil {
+			return rejectf(RejectInvalidUsage, l.Id, "%v", err)
+		}
+		for _, tokens := range []int64{usage.InputTokens, usage.OutputTokens, usage.CacheTokens, int64(usage.ReasoningTokens)} {
+			if tokens < 0 || tokens > maxCallTokens {
+				return rejectf(RejectTokensOutOfRange, l.Id, "tokens must be between 0 and %d: %+v", maxCallTokens, usage)
+			}
+		}
+	case ImageReportType:
+		if l.Model == "" {
+			return rejectf(RejectMissingModel, l.Id, "model is empty")
+		}
+		var usage ImageUsage
+		if err := l.decodeUsage(&usage); err != nil {
+			return rejectf(RejectInvalidUsage, l.Id, "%v", err)
+		}
+		if usage.Count < 0 {
+			return rejectf(RejectInvalidUsage, l.Id, "negative image count: %d", usage.Count)
+		}
+		if _, ok := ImagePricing.GetImagePriceAt(ImageModel(l.Model), ImageQuality(usage.Quality), ImageSize(usage.Size), l.CalledAt()); !ok {
+			return rejectf(RejectUnknownImageOption, l.Id, "no price for %s, quality %q, size %q", l.Model, usage.Quality, usage.Size)
+		}
+	case VideoReportType:
+		if l.Model == "" {
+			return rejectf(RejectMissingModel, l.Id, "model is empty")
+		}
+		var usage VideoUsage
+		if err := l.decodeUsage(&usage); err != nil {
+			return rejectf(RejectInvalidUsage, l.Id, "%v", err)
+		}
+		if usage.Seconds <= 0 {
+			return rejectf(RejectInvalidUsage, l.Id, "seconds must be positive, got %v", usage.Seconds)
+		}
+		if _, ok := VideoPricing.GetVideoPriceAt(VideoModel(l.Model), VideoResolution(usage.Size), l.CalledAt()); !ok {
+			return rejectf(RejectUnknownVideoOption, l.Id, "no price for %s, resolution %q", l.Model, usage.Size)
+		}
+	default:
+		return rejectf(RejectUnknownReportType, l.Id, "report type %q", l.ReportType)
+	}
+	return nil
+}
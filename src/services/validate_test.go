@@ -0,0 +1,96 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/deepissue/fee_server/config"
+)
+
+func textCall(timestamp int64) *LLMCallData {
+	return &LLMCallData{
+		Id:         "call-1",
+		Caller:     "42",
+		ModelId:    "m-gpt-4o",
+		ReportType: TextReportType,
+		TokenUsage: TokenUsage{InputTokens: 100, OutputTokens: 20},
+		Timestamp:  timestamp,
+	}
+}
+
+func TestValidateTimestamp(t *testing.T) {
+	now := time.Unix(1762171200, 0)
+	window := NewReportWindow(&config.ReportConfig{MaxClockSkew: 60, MaxLateness: 3600})
+	cases := []struct {
+		name      string
+		timestamp int64
+		want      RejectReason // 为空表示通过
+	}{
+		{"no timestamp", 0, ""},
+		{"now", now.Unix(), ""},
+		{"within clock skew", now.Unix() + 60, ""},
+		{"beyond clock skew", now.Unix() + 61, RejectFutureTimestamp},
+		{"far future", now.Unix() + 86400, RejectFutureTimestamp},
+		{"within lateness", now.Unix() - 3600, ""},
+		{"beyond lateness", now.Unix() - 3601, RejectStaleTimestamp},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := textCall(c.timestamp).Validate(window, now)
+			if c.want == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected %s, got nil", c.want)
+			}
+			if reason := RejectReasonOf(err); reason != c.want {
+				t.Fatalf("reason = %s, want %s (%v)", reason, c.want, err)
+			}
+		})
+	}
+}
+
+func TestValidateTokens(t *testing.T) {
+	cases := []struct {
+		name  string
+		usage TokenUsage
+		want  RejectReason // 为空表示通过
+	}{
+		{"zero", TokenUsage{}, ""},
+		{"at limit", TokenUsage{InputTokens: maxCallTokens, OutputTokens: maxCallTokens}, ""},
+		{"negative input", TokenUsage{InputTokens: -1}, RejectTokensOutOfRange},
+		{"negative reasoning", TokenUsage{ReasoningTokens: -1}, RejectTokensOutOfRange},
+		{"absurd output", TokenUsage{OutputTokens: maxCallTokens + 1}, RejectTokensOutOfRange},
+		{"overflowing cache", TokenUsage{CacheTokens: 1 << 62}, RejectTokensOutOfRange},
+	}
+	for _, c := range cases {
+		call := textCall(0)
+		call.TokenUsage = c.usage
+		err := call.Validate(NewReportWindow(nil), time.Now())
+		if c.want == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", c.name, err)
+			}
+			continue
+		}
+		if reason := RejectReasonOf(err); reason != c.want {
+			t.Errorf("%s: reason = %s, want %s (%v)", c.name, reason, c.want, err)
+		}
+	}
+}
+
+func TestNewReportWindowDefaults(t *testing.T) {
+	for _, c := range []*config.ReportConfig{nil, {}} {
+		window := NewReportWindow(c)
+		if window.maxClockSkew != defaultMaxClockSkew || window.maxLateness != defaultMaxLateness {
+			t.Errorf("NewReportWindow(%+v) = %+v, want defaults", c, window)
+		}
+	}
+	now := time.Now()
+	if err := textCall(now.Add(-defaultMaxLateness-time.Second).Unix()).Validate(NewReportWindow(nil), now); RejectReasonOf(err) != RejectStaleTimestamp {
+		t.Errorf("expected %s with the default lateness, got %v", RejectStaleTimestamp, err)
+	}
+}
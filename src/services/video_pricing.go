@@ -1,15 +1,28 @@
 package services
 
 import (
+	"errors"
 	"fmt"
 	"maps"
+	"math"
+	"math/big"
 	"os"
+	"sync/atomic"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 // videoPricing manages video generation pricing
+// The active price sheet is swapped atomically on reload, so readers never observe a partially loaded sheet
 type videoPricing struct {
+	sheet atomic.Pointer[videoPriceSheet]
+}
+
+// videoPriceSheet is an immutable snapshot of the video pricing matrix
+type videoPriceSheet struct {
+	info       PriceSheetInfo
+	schedule   map[videoPriceKey][]priceWindow // 从数据库加载时的全部价格版本，按调用时间查价
 	pricingMap map[VideoModel]map[VideoResolution]float64
 }
 
@@ -74,9 +87,12 @@ func getDefaultVideoPricing() map[VideoModel]map[VideoResolution]float64 {
 
 // NewVideoPricing creates a new videoPricing instance with default pricing
 func NewVideoPricing() *videoPricing {
-	return &videoPricing{
+	p := &videoPricing{}
+	p.sheet.Store(&videoPriceSheet{
+		info:       PriceSheetInfo{Source: "default", LoadedAt: time.Now()},
 		pricingMap: getDefaultVideoPricing(),
-	}
+	})
+	return p
 }
 
 // NewVideoPricingWithConfig creates a new videoPricing instance and loads configuration from file
@@ -98,25 +114,74 @@ func NewVideoPricingWithConfig(configPath string) (*videoPricing, error) {
 }
 
 // LoadFromFile loads pricing configuration from a YAML file and merges with default pricing
+// The file is validated first; on any error the current price sheet stays in use
 func (p *videoPricing) LoadFromFile(configPath string) error {
-	data, err := os.ReadFile(configPath)
+	config, err := ReadVideoPricingConfig(configPath)
 	if err != nil {
 		return err
 	}
 
+	// Merge config into a fresh copy of the default pricing and swap it in
+	sheet := &videoPriceSheet{
+		info: PriceSheetInfo{
+			Version:     config.Version,
+			LastUpdated: config.LastUpdated,
+			Source:      configPath,
+			LoadedAt:    time.Now(),
+		},
+		pricingMap: getDefaultVideoPricing(),
+	}
+	sheet.mergeConfig(config)
+	p.sheet.Store(sheet)
+
+	return nil
+}
+
+// ReadVideoPricingConfig reads and validates a video pricing YAML file
+func ReadVideoPricingConfig(configPath string) (VideoPricingConfig, error) {
 	var config VideoPricingConfig
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return config, err
+	}
 	if err := yaml.Unmarshal(data, &config); err != nil {
-		return fmt.Errorf("failed to parse video pricing config: %w", err)
+		return config, fmt.Errorf("failed to parse video pricing config: %w", err)
 	}
+	if err := config.Validate(); err != nil {
+		return config, fmt.Errorf("invalid video pricing config %s: %w", configPath, err)
+	}
+	return config, nil
+}
 
-	// Merge config into pricing map
-	p.mergeConfig(config)
-
+// Validate checks the configuration before it replaces the live price sheet
+func (c VideoPricingConfig) Validate() error {
+	if c.Version == "" {
+		return errors.New("version is required")
+	}
+	for _, modelConfig := range c.Models {
+		if modelConfig.Model == "" {
+			return errors.New("model name is required")
+		}
+		for _, resolutionConfig := range modelConfig.Resolutions {
+			if resolutionConfig.Resolution == "" {
+				return fmt.Errorf("model %s: resolution is required", modelConfig.Model)
+			}
+			if !(resolutionConfig.Price > 0) || math.IsInf(resolutionConfig.Price, 0) {
+				return fmt.Errorf("model %s, resolution %s: invalid price %v",
+					modelConfig.Model, resolutionConfig.Resolution, resolutionConfig.Price)
+			}
+		}
+	}
 	return nil
 }
 
+// Info returns the version information of the live price sheet
+func (p *videoPricing) Info() PriceSheetInfo {
+	return p.sheet.Load().info
+}
+
 // mergeConfig merges the configuration into the pricing map, overriding default values
-func (p *videoPricing) mergeConfig(config VideoPricingConfig) {
+func (p *videoPriceSheet) mergeConfig(config VideoPricingConfig) {
 	for _, modelConfig := range config.Models {
 		// Skip disabled models
 		if !modelConfig.Enabled {
@@ -138,9 +203,19 @@ func (p *videoPricing) mergeConfig(config VideoPricingConfig) {
 	}
 }
 
-// GetVideoPrice returns the price per second for generating video with the specified parameters
+// GetVideoPrice returns the price per second currently in effect for generating video with the specified parameters
 func (p *videoPricing) GetVideoPrice(model VideoModel, resolution VideoResolution) (float64, bool) {
-	if modelPricing, ok := p.pricingMap[model]; ok {
+	return p.GetVideoPriceAt(model, resolution, time.Now())
+}
+
+// GetVideoPriceAt returns the price per second in effect at the given time
+// Sheets loaded from file have no schedule and always return the loaded price
+func (p *videoPricing) GetVideoPriceAt(model VideoModel, resolution VideoResolution, at time.Time) (float64, bool) {
+	sheet := p.sheet.Load()
+	if sheet.schedule != nil {
+		return priceAt(sheet.schedule[videoPriceKey{model, resolution}], at.Unix())
+	}
+	if modelPricing, ok := sheet.pricingMap[model]; ok {
 		if price, ok := modelPricing[resolution]; ok {
 			return price, true
 		}
@@ -148,13 +223,14 @@ func (p *videoPricing) GetVideoPrice(model VideoModel, resolution VideoResolutio
 	return 0, false
 }
 
-// CalculateVideoCost calculates the total cost for generating video based on duration in seconds
-func (p *videoPricing) CalculateVideoCost(model VideoModel, resolution VideoResolution, durationSeconds float64) (float64, bool) {
-	pricePerSecond, ok := p.GetVideoPrice(model, resolution)
+// CalculateVideoCost calculates the exact cost in USD for generating video based on duration in seconds at the given time
+// Both the price and the duration are taken as the decimals they were written as, so no float drift accumulates
+func (p *videoPricing) CalculateVideoCost(model VideoModel, resolution VideoResolution, durationSeconds float64, at time.Time) (*big.Rat, bool) {
+	pricePerSecond, ok := p.GetVideoPriceAt(model, resolution, at)
 	if !ok {
-		return 0, false
+		return nil, false
 	}
-	return pricePerSecond * durationSeconds, true
+	return new(big.Rat).Mul(DecimalRat(pricePerSecond), DecimalRat(durationSeconds)), true
 }
 
 // GetAllPricing returns a copy of the entire pricing map
@@ -162,7 +238,7 @@ func (p *videoPricing) GetAllPricing() map[VideoModel]map[VideoResolution]float6
 	// Create a deep copy to prevent external modification
 	result := make(map[VideoModel]map[VideoResolution]float64)
 
-	for model, resolutions := range p.pricingMap {
+	for model, resolutions := range p.sheet.Load().pricingMap {
 		result[model] = make(map[VideoResolution]float64)
 		maps.Copy(result[model], resolutions)
 	}
@@ -172,8 +248,9 @@ func (p *videoPricing) GetAllPricing() map[VideoModel]map[VideoResolution]float6
 
 // GetSupportedModels returns a list of all supported video models
 func (p *videoPricing) GetSupportedModels() []VideoModel {
-	models := make([]VideoModel, 0, len(p.pricingMap))
-	for model := range p.pricingMap {
+	pricingMap := p.sheet.Load().pricingMap
+	models := make([]VideoModel, 0, len(pricingMap))
+	for model := range pricingMap {
 		models = append(models, model)
 	}
 	return models
@@ -181,7 +258,7 @@ func (p *videoPricing) GetSupportedModels() []VideoModel {
 
 // GetSupportedResolutions returns a list of supported resolutions for a given model
 func (p *videoPricing) GetSupportedResolutions(model VideoModel) []VideoResolution {
-	if modelPricing, ok := p.pricingMap[model]; ok {
+	if modelPricing, ok := p.sheet.Load().pricingMap[model]; ok {
 		resolutions := make([]VideoResolution, 0, len(modelPricing))
 		for resolution := range modelPricing {
 			resolutions = append(resolutions, resolution)
@@ -199,7 +276,7 @@ func InitVideoDefault() {
 }
 
 // InitVideoPricing initializes the global VideoPricing with pricing from file
-func InitVideoPricing(file string) {
+func InitVideoPricing(file string) error {
 	VideoPricing = NewVideoPricing()
-	VideoPricing.LoadFromFile(file)
+	return VideoPricing.LoadFromFile(file)
 }
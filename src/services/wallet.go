@@ -0,0 +1,179 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/deepissue/fee_server/config"
+	"github.com/deepissue/fee_server/models"
+	"github.com/sirupsen/logrus"
+	"xorm.io/xorm"
+)
+
+var (
+	walletTypes = map[string]bool{
+		models.WalletTypeCredit:  true,
+		models.WalletTypePromo:   true,
+		models.WalletTypeOnchain: true,
+	}
+	defaultWalletPriority  = []string{models.WalletTypePromo, models.WalletTypeCredit, models.WalletTypeOnchain}
+	defaultWalletOverdraft = models.WalletTypeCredit
+)
+
+// WalletPolicy 决定用户的哪些钱包为一次调用付费
+// 按 priority 顺序用各钱包的正余额支付，同类型的多个钱包按 id 顺序；余额都不足时由 overdraft 类型的钱包透支剩余部分。
+// 用量是事后上报的，不会因余额不足拒绝扣费
+type WalletPolicy struct {
+	priority  []string
+	overdraft string
+}
+
+func NewWalletPolicy(c *config.WalletConfig) (*WalletPolicy, error) {
+	p := &WalletPolicy{priority: defaultWalletPriority, overdraft: defaultWalletOverdraft}
+	if c == nil {
+		return p, nil
+	}
+	if len(c.Priority) > 0 {
+		p.priority = c.Priority
+		p.overdraft = ""
+	}
+	if c.Overdraft != "" {
+		p.overdraft = c.Overdraft
+	}
+	for _, walletType := range p.priority {
+		if !walletTypes[walletType] {
+			return nil, fmt.Errorf("unknown wallet type in wallet.priority: %s", walletType)
+		}
+	}
+	if p.overdraft != "" && !walletTypes[p.overdraft] {
+		return nil, fmt.Errorf("unknown wallet type in wallet.overdraft: %s", p.overdraft)
+	}
+	return p, nil
+}
+
+// WalletShare 一个钱包承担的扣费
+type WalletShare struct {
+	Wallet *models.UserWallet
+	Amount int64
+}
+
+// Eligible 按扣费顺序返回参与扣费的钱包
+func (p *WalletPolicy) Eligible(wallets []*models.UserWallet) []*models.UserWallet {
+	var ordered []*models.UserWallet
+	for _, walletType := range p.priority {
+		for _, wallet := range wallets {
+			if wallet.Type() == walletType {
+				ordered = append(ordered, wallet)
+			}
+		}
+	}
+	return ordered
+}
+
+// Split 在 wallets（已按 Eligible 排序）之间分摊 amount 微代币
+func (p *WalletPolicy) Split(wallets []*models.UserWallet, amount int64) []WalletShare {
+	var shares []WalletShare
+	remaining := amount
+	for _, wallet := range wallets {
+		if remaining <= 0 {
+			break
+		}
+		if pay := min(wallet.Balance, remaining); pay > 0 {
+			shares = append(shares, WalletShare{Wallet: wallet, Amount: pay})
+			remaining -= pay
+		}
+	}
+	if remaining <= 0 && len(shares) > 0 {
+		return shares
+	}
+
+	// 余额不足（或金额为 0）时剩余部分由透支钱包承担，合并到它已有的份额中
+	overdraft := wallets[len(wallets)-1]
+	for _, wallet := range wallets {
+		if wallet.Type() == p.overdraft {
+			overdraft = wallet
+			break
+		}
+	}
+	for i := range shares {
+		if shares[i].Wallet == overdraft {
+			shares[i].Amount += remaining
+			return shares
+		}
+	}
+	return append(shares, WalletShare{Wallet: overdraft, Amount: remaining})
+}
+
+// wallets 返回账户参与扣费的钱包并加锁，key 指定了钱包时只返回该钱包，否则按钱包规则选择用户的个人钱包
+func (m *FeeService) wallets(session *xorm.Session, account Account) ([]*models.UserWallet, error) {
+	if account.WalletId != 0 {
+		wallet := models.UserWallet{Id: account.WalletId}
+		has, err := session.ForUpdate().Get(&wallet)
+		if err != nil {
+			return nil, err
+		}
+		// 指定的钱包必须属于该用户，或属于 key 所在的组织
+		owned := wallet.OrgId == 0 && wallet.UserId == account.UserId
+		if wallet.OrgId != 0 {
+			owned = wallet.OrgId == account.OrgId
+		}
+		if !has || !owned {
+			metricWalletNotFound.Inc()
+			return nil, fmt.Errorf("user wallet not found: %d, wallet: %d", account.UserId, account.WalletId)
+		}
+		return []*models.UserWallet{&wallet}, nil
+	}
+
+	var wallets []*models.UserWallet
+	if err := session.ForUpdate().Where("user_id = ? AND org_id = 0", account.UserId).Asc("id").Find(&wallets); err != nil {
+		return nil, err
+	}
+	eligible := m.walletPolicy.Eligible(wallets)
+	if len(eligible) == 0 {
+		metricWalletNotFound.Inc()
+		return nil, fmt.Errorf("user wallet not found: %d", account.UserId)
+	}
+	return eligible, nil
+}
+
+// deductWallets 按钱包规则从 wallets 扣除 amount 微代币，返回各钱包的分摊
+func (m *FeeService) deductWallets(session *xorm.Session, wallets []*models.UserWallet, amount int64, at time.Time) ([]WalletShare, error) {
+	shares := m.walletPolicy.Split(wallets, amount)
+	for _, share := range shares {
+		if share.Amount == 0 {
+			continue
+		}
+		share.Wallet.Balance -= share.Amount
+		share.Wallet.UpdatedAt = at.Unix()
+		// 显式指定列，余额恰好扣为 0 时也要更新
+		rows, err := session.ID(share.Wallet.Id).Cols("balance", "updated_at").Update(share.Wallet)
+		if err != nil {
+			logrus.Errorf("update wallet %d failed, cost: %d", share.Wallet.Id, share.Amount)
+			return nil, err
+		}
+		if rows == 0 {
+			return nil, fmt.Errorf("failed to update wallet: %d, cost: %d", share.Wallet.Id, share.Amount)
+		}
+	}
+	return shares, nil
+}
+
+// insertWalletDetails 写入一条消费记录的钱包分摊明细
+func insertWalletDetails(session *xorm.Session, tables models.ConsumeTables, record *models.UserConsumeRecord, shares []WalletShare) error {
+	details := make([]*models.UserConsumeDetailWallet, 0, len(shares))
+	for _, share := range shares {
+		details = append(details, &models.UserConsumeDetailWallet{
+			ConsumeId:    record.ID,
+			WalletId:     share.Wallet.Id,
+			WalletType:   share.Wallet.Type(),
+			Amount:       share.Amount,
+			BalanceAfter: share.Wallet.Balance,
+			CreatedAt:    record.CreatedAt,
+		})
+	}
+	if _, err := session.Table(tables.Wallet).Insert(&details); err != nil {
+		logrus.Errorf("insert wallet details: %v", err)
+		return err
+	}
+	return nil
+}